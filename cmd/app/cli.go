@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"reverse-proxy/internal/application/config"
+	validation "reverse-proxy/internal/application/validate"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+const usage = `Usage: reverse-proxy [command] [flags]
+
+Commands:
+  serve      run the proxy (the default when no command is given)
+  validate   check the settings and site files without starting the proxy
+  version    print the version
+  ctl        control a running proxy, see "reverse-proxy ctl -h"
+
+Flags of serve and validate:
+  --config <dir>      directory with the site files (default ./config)
+  --settings <file>   settings file (default <config>/settings.yml)
+  --log-level <level> debug, info, warn or error (default info)
+`
+
+// options are the flags shared by the commands that load the configuration.
+type options struct {
+	configDir    string
+	settingsPath string
+	logLevel     slog.Level
+}
+
+// run dispatches args to their command and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve", "validate":
+		opts, err := parseOptions(command, args, stderr)
+		if err != nil {
+			return 2
+		}
+		if command == "validate" {
+			return validate(opts, stdout, stderr)
+		}
+		return serve(opts, stdout)
+	case "version":
+		fmt.Fprintln(stdout, versionString())
+		return 0
+	case "ctl":
+		return runCtl(args, stdout, stderr)
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "Unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+}
+
+func parseOptions(command string, args []string, stderr io.Writer) (*options, error) {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+
+	opts := &options{}
+	flags.StringVar(&opts.configDir, "config", "./config", "directory with the site files")
+	flags.StringVar(&opts.settingsPath, "settings", "", "settings file")
+	level := flags.String("log-level", "info", "log level")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "Unexpected argument %q\n\n", flags.Arg(0))
+		flags.Usage()
+		return nil, errors.New("unexpected argument")
+	}
+	if err := opts.logLevel.UnmarshalText([]byte(*level)); err != nil {
+		fmt.Fprintf(stderr, "Invalid log level %q\n\n", *level)
+		flags.Usage()
+		return nil, err
+	}
+
+	if opts.settingsPath == "" {
+		opts.settingsPath = filepath.Join(opts.configDir, "settings.yml")
+	}
+	return opts, nil
+}
+
+// validate checks the settings and site files and prints every problem
+// found, so a CI job sees all of them in one run.
+func validate(opts *options, stdout, stderr io.Writer) int {
+	report := validation.Config(opts.settingsPath, opts.configDir)
+	if len(report.Problems) > 0 {
+		for _, p := range report.Problems {
+			fmt.Fprintln(stderr, config.Redact(p.String()))
+		}
+		fmt.Fprintf(stderr, "%d problems found\n", len(report.Problems))
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Configuration is valid, %d sites\n", report.Sites)
+	return 0
+}
+
+// versionString returns the version with the commit it was built from, when
+// the build recorded it.
+func versionString() string {
+	s := "reverse-proxy " + version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				s += " (" + setting.Value[:12] + ")"
+			}
+		}
+	}
+	return s + " " + runtime.Version()
+}
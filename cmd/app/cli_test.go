@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	runArgs := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(args, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	t.Run("version", func(t *testing.T) {
+		code, out, _ := runArgs("version")
+		if code != 0 || !strings.HasPrefix(out, "reverse-proxy "+version) {
+			t.Errorf("Expected version output, got %d: %s", code, out)
+		}
+	})
+
+	t.Run("validate configuration", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "settings.yml"), []byte("server:\n  listen: \":8080\"\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "example.com.yml"), []byte("domain: example.com\nproxy:\n  upstream: http://localhost:3000\n"), 0644)
+
+		code, out, errOut := runArgs("validate", "--config", dir)
+		if code != 0 {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, errOut)
+		}
+		if strings.TrimSpace(out) != "Configuration is valid, 1 sites" {
+			t.Errorf("Unexpected output: %s", out)
+		}
+	})
+
+	t.Run("validate broken configuration", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "settings.yml"), []byte("server:\n  listen: \":8080\"\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "broken.yml"), []byte("proxy:\n  upstream: localhost:3000\n"), 0644)
+
+		code, _, errOut := runArgs("validate", "-config", dir)
+		if code != 1 {
+			t.Errorf("Expected exit code 1, got %d", code)
+		}
+		for _, want := range []string{"broken.yml:1:1: domain missing", "broken.yml:2:13: upstream URL localhost:3000", "2 problems found"} {
+			if !strings.Contains(errOut, want) {
+				t.Errorf("Expected %q in the output, got %s", want, errOut)
+			}
+		}
+	})
+
+	t.Run("invalid command lines", func(t *testing.T) {
+		testCases := [][]string{
+			{"frobnicate"},
+			{"serve", "--log-level", "loud"},
+			{"serve", "--no-such-flag"},
+			{"validate", "extra"},
+		}
+		for _, args := range testCases {
+			if code, _, errOut := runArgs(args...); code != 2 || errOut == "" {
+				t.Errorf("Expected exit code 2 with usage for %v, got %d", args, code)
+			}
+		}
+	})
+}
+
+func TestParseOptions(t *testing.T) {
+	var stderr bytes.Buffer
+
+	opts, err := parseOptions("serve", nil, &stderr)
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	if opts.configDir != "./config" || opts.settingsPath != filepath.Join("./config", "settings.yml") || opts.logLevel != slog.LevelInfo {
+		t.Errorf("Unexpected defaults %+v", opts)
+	}
+
+	opts, err = parseOptions("serve", []string{"--config", "/etc/proxy", "--settings", "/etc/settings.yml", "--log-level", "debug"}, &stderr)
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	if opts.configDir != "/etc/proxy" || opts.settingsPath != "/etc/settings.yml" || opts.logLevel != slog.LevelDebug {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+
+	if opts, _ = parseOptions("serve", []string{"--config", "/etc/proxy"}, &stderr); opts.settingsPath != "/etc/proxy/settings.yml" {
+		t.Errorf("Expected settings next to the site files, got %s", opts.settingsPath)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"reverse-proxy/internal/application/admin"
+	"reverse-proxy/internal/application/config"
+	"reverse-proxy/internal/application/site"
+	"strconv"
+	"text/tabwriter"
+)
+
+const ctlUsage = `Usage: reverse-proxy ctl [-socket path] [-json] <command> [arguments]
+
+Commands:
+  sites                                   list the loaded sites
+  upstreams <domain>                      show the upstreams of a site
+  drain [-path p] <domain> <upstream>     send no new clients to an upstream
+  disable [-path p] <domain> <upstream>   send no traffic at all to an upstream
+  enable [-path p] <domain> <upstream>    put an upstream back into rotation
+  reload                                  re-read the site files
+  stats                                   show totals over every site
+`
+
+// errUsage is returned for invalid command lines, after the usage was
+// printed.
+var errUsage = errors.New("invalid usage")
+
+// runCtl runs the ctl subcommand with args and returns the exit code.
+func runCtl(args []string, stdout, stderr io.Writer) int {
+	if err := ctl(args, stdout, stderr); err != nil {
+		if !errors.Is(err, errUsage) {
+			fmt.Fprintln(stderr, "Error:", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func ctl(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, ctlUsage) }
+	socket := flags.String("socket", config.DefaultControlSocket(), "control socket of the running proxy")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	client := admin.NewClient(*socket)
+	out := &output{w: stdout, json: *asJSON}
+	command, rest := flags.Arg(0), flags.Args()[1:]
+
+	switch command {
+	case "sites":
+		sites, err := client.Sites()
+		if err != nil {
+			return err
+		}
+		return out.sites(sites)
+
+	case "upstreams":
+		if len(rest) != 1 {
+			flags.Usage()
+			return errUsage
+		}
+		status, err := client.Site(rest[0])
+		if err != nil {
+			return err
+		}
+		return out.upstreams(status)
+
+	case "drain", "disable", "enable":
+		actionFlags := flag.NewFlagSet(command, flag.ContinueOnError)
+		actionFlags.SetOutput(stderr)
+		actionFlags.Usage = flags.Usage
+		path := actionFlags.String("path", "", "only change the upstream on this path")
+		if err := actionFlags.Parse(rest); err != nil {
+			return errUsage
+		}
+		if actionFlags.NArg() != 2 {
+			flags.Usage()
+			return errUsage
+		}
+
+		domain, upstream := actionFlags.Arg(0), actionFlags.Arg(1)
+		status, err := client.SetUpstreamState(domain, command, upstream, *path)
+		if err != nil {
+			return err
+		}
+		if out.json {
+			return out.encode(status)
+		}
+		fmt.Fprintf(stdout, "%s on %s: %s\n", upstream, domain, stateOf(status, upstream))
+		return nil
+
+	case "reload":
+		count, err := client.Reload()
+		if err != nil {
+			return err
+		}
+		if out.json {
+			return out.encode(map[string]int{"sites": count})
+		}
+		fmt.Fprintf(stdout, "Reloaded, %d sites loaded\n", count)
+		return nil
+
+	case "stats":
+		stats, err := client.Stats()
+		if err != nil {
+			return err
+		}
+		return out.stats(stats)
+
+	default:
+		fmt.Fprintf(stderr, "Unknown command %q\n\n", command)
+		flags.Usage()
+		return errUsage
+	}
+}
+
+// stateOf returns the states of upstream across the paths of status, once
+// per distinct state.
+func stateOf(status site.SiteStatus, upstream string) string {
+	seen := make(map[string]bool)
+	state := ""
+	for _, p := range status.Paths {
+		for _, u := range p.Upstreams {
+			if u.URL != upstream || seen[u.State] {
+				continue
+			}
+			seen[u.State] = true
+			if state != "" {
+				state += ", "
+			}
+			state += u.State
+		}
+	}
+	return state
+}
+
+// output prints results as aligned tables, or as JSON.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+func (o *output) encode(v any) error {
+	encoder := json.NewEncoder(o.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func (o *output) table(header string, rows [][]string) error {
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	for _, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+func (o *output) sites(sites []site.SiteStatus) error {
+	if o.json {
+		return o.encode(sites)
+	}
+
+	rows := make([][]string, 0, len(sites))
+	for _, s := range sites {
+		upstreams, available := 0, 0
+		for _, p := range s.Paths {
+			for _, u := range p.Upstreams {
+				upstreams++
+				if u.Available() {
+					available++
+				}
+			}
+		}
+		rows = append(rows, []string{s.Domain, strconv.Itoa(len(s.Paths)), strconv.Itoa(upstreams), strconv.Itoa(available)})
+	}
+	return o.table("DOMAIN\tPATHS\tUPSTREAMS\tAVAILABLE", rows)
+}
+
+func (o *output) upstreams(status site.SiteStatus) error {
+	if o.json {
+		return o.encode(status)
+	}
+
+	var rows [][]string
+	for _, p := range status.Paths {
+		if p.Upstreams == nil {
+			rows = append(rows, []string{p.Path, p.Upstream, "-", "-", "-", "-", "-", "-"})
+			continue
+		}
+		for _, u := range p.Upstreams {
+			name := u.URL
+			if u.Backup {
+				name += " (backup)"
+			}
+			health := "healthy"
+			switch {
+			case u.Ejected:
+				health = "ejected"
+			case !u.Healthy:
+				health = "unhealthy"
+			case u.Warming:
+				health = "warming"
+			}
+			circuit := u.Circuit
+			if circuit == "" {
+				circuit = "-"
+			}
+			rows = append(rows, []string{
+				p.Path, name, u.State, health, circuit,
+				strconv.FormatInt(u.InFlight, 10), strconv.FormatInt(u.Requests, 10), strconv.FormatInt(u.Failures, 10),
+			})
+		}
+	}
+	return o.table("PATH\tUPSTREAM\tSTATE\tHEALTH\tCIRCUIT\tIN FLIGHT\tREQUESTS\tFAILURES", rows)
+}
+
+func (o *output) stats(stats admin.Stats) error {
+	if o.json {
+		return o.encode(stats)
+	}
+
+	return o.table("STAT\tVALUE", [][]string{
+		{"uptime", stats.Uptime},
+		{"sites", strconv.Itoa(stats.Sites)},
+		{"paths", strconv.Itoa(stats.Paths)},
+		{"upstreams", strconv.Itoa(stats.Upstreams)},
+		{"available", strconv.Itoa(stats.Available)},
+		{"in flight", strconv.FormatInt(stats.InFlight, 10)},
+		{"requests", strconv.FormatInt(stats.Requests, 10)},
+		{"failures", strconv.FormatInt(stats.Failures, 10)},
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/application/admin"
+	"reverse-proxy/internal/application/manager"
+	"strings"
+	"testing"
+)
+
+// startControl serves a manager with one load balanced site on a control
+// socket and returns the socket path.
+func startControl(t *testing.T) string {
+	t.Helper()
+
+	configDir := t.TempDir()
+	site := "domain: example.com\nproxy:\n  upstreams:\n    - http://10.0.0.1:8080\n    - http://10.0.0.2:8080\ntimeouts:\n  read: 5s\n"
+	if err := os.WriteFile(filepath.Join(configDir, "example.com.yml"), []byte(site), 0644); err != nil {
+		t.Fatalf("Failed to write site: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	sites := manager.New(logger, configDir)
+	if err := sites.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	// Unix socket paths are short, t.TempDir can be too long
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "control.sock")
+
+	listener, err := admin.ListenSocket(socket)
+	if err != nil {
+		t.Fatalf("ListenSocket failed: %v", err)
+	}
+	server := &http.Server{Handler: admin.New(logger, sites, "")}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return socket
+}
+
+func runCommand(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runCtl(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCtl(t *testing.T) {
+	socket := startControl(t)
+
+	t.Run("sites", func(t *testing.T) {
+		code, out, errOut := runCommand(t, "-socket", socket, "sites")
+		if code != 0 {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, errOut)
+		}
+
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "DOMAIN") {
+			t.Fatalf("Expected a header and one row, got:\n%s", out)
+		}
+		if fields := strings.Fields(lines[1]); len(fields) != 4 || fields[0] != "example.com" || fields[2] != "2" || fields[3] != "2" {
+			t.Errorf("Expected example.com with 2 of 2 upstreams available, got %v", fields)
+		}
+	})
+
+	t.Run("drain and upstreams", func(t *testing.T) {
+		code, out, errOut := runCommand(t, "-socket", socket, "drain", "example.com", "http://10.0.0.2:8080")
+		if code != 0 {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, errOut)
+		}
+		if strings.TrimSpace(out) != "http://10.0.0.2:8080 on example.com: draining" {
+			t.Errorf("Unexpected output: %s", out)
+		}
+
+		_, out, _ = runCommand(t, "-socket", socket, "upstreams", "example.com")
+		if !strings.Contains(out, "http://10.0.0.2:8080  draining") {
+			t.Errorf("Expected the upstream table to show the drain, got:\n%s", out)
+		}
+
+		runCommand(t, "-socket", socket, "enable", "example.com", "http://10.0.0.2:8080")
+	})
+
+	t.Run("json output", func(t *testing.T) {
+		code, out, errOut := runCommand(t, "-socket", socket, "-json", "stats")
+		if code != 0 {
+			t.Fatalf("Expected exit code 0, got %d: %s", code, errOut)
+		}
+
+		var stats admin.Stats
+		if err := json.Unmarshal([]byte(out), &stats); err != nil {
+			t.Fatalf("Expected JSON output, got %s", out)
+		}
+		if stats.Sites != 1 || stats.Upstreams != 2 || stats.Available != 2 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		code, out, errOut := runCommand(t, "-socket", socket, "reload")
+		if code != 0 || strings.TrimSpace(out) != "Reloaded, 1 sites loaded" {
+			t.Errorf("Expected reload, got %d: %s%s", code, out, errOut)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		testCases := [][]string{
+			{},
+			{"-socket", socket, "frobnicate"},
+			{"-socket", socket, "upstreams"},
+			{"-socket", socket, "drain", "example.com"},
+			{"-socket", socket, "upstreams", "missing.com"},
+			{"-socket", filepath.Join(t.TempDir(), "missing.sock"), "sites"},
+		}
+		for _, args := range testCases {
+			if code, _, errOut := runCommand(t, args...); code == 0 || errOut == "" {
+				t.Errorf("Expected failure with a message for %v, got %d", args, code)
+			}
+		}
+	})
+}
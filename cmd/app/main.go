@@ -3,52 +3,99 @@
 // This application provides a high-performance reverse proxy with support for:
 // - Host-based virtual hosting
 // - Path-based routing
-// - Load balancing (round-robin and random algorithms)
+// - Load balancing (round-robin, weighted-round-robin, random, least-conn, hash and p2c-ewma algorithms)
 // - TLS termination with HTTP->HTTPS redirect
 // - Per-site timeouts and limits
 // - Custom header manipulation
+// - Sites generated from Docker container labels and Kubernetes Ingresses
+// - An admin API to inspect sites and drain or disable upstreams
+// - A control socket and the "ctl" subcommand for operating a running proxy
 //
-// Configuration is YAML-based and supports hot reloading.
+// Configuration is YAML-based and supports hot reloading: the site directory
+// is watched for changes and can be reloaded on demand with SIGHUP. The
+// directory, settings file and log level are set with flags, see usage.
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reverse-proxy/internal/application/admin"
 	"reverse-proxy/internal/application/config"
-	"reverse-proxy/internal/application/host"
-	"reverse-proxy/internal/application/site"
+	"reverse-proxy/internal/application/manager"
+	"reverse-proxy/internal/application/provider"
 	"reverse-proxy/internal/models/global"
 	"strings"
 	"sync"
+	"syscall"
 )
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve runs the proxy until it receives SIGINT or SIGTERM. It returns early
+// when the configuration can't be loaded, a server that fails later exits
+// the process.
+func serve(opts *options, stdout io.Writer) int {
+	logger := slog.New(slog.NewTextHandler(stdout, &slog.HandlerOptions{Level: opts.logLevel, ReplaceAttr: config.RedactAttr}))
 
-	settings, err := config.LoadSettings("./config/settings.yml")
+	settings, err := config.LoadSettings(opts.settingsPath)
 	if err != nil {
-		logger.Error("Failed to load settings", "error", err)
-		os.Exit(1)
+		logger.Error("Failed to load settings", "path", opts.settingsPath, "error", err)
+		return 1
 	}
 
-	sites, err := config.LoadConfigs("./config")
-	if err != nil {
+	sites := manager.New(logger, opts.configDir)
+	sites.SetDuplicates(settings.Sites.Duplicates)
+	if err := sites.Reload(); err != nil {
 		logger.Error("Error loading sites", "error", err)
-		os.Exit(1)
+		return 1
 	}
 
-	configs := make(map[string]http.Handler)
-	for domain, cfg := range sites {
-		handler, err := site.NewSiteHandler(logger, cfg)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	if cfg := settings.Providers.Docker; cfg != nil {
+		docker, err := provider.NewDocker(logger, cfg)
 		if err != nil {
-			logger.Error("Failed to create handler", "domain", domain, "error", err)
-			continue
+			logger.Error("Failed to create docker provider", "error", err)
+			return 1
 		}
-		configs[domain] = handler.Handler
+		sites.AddProvider(ctx, docker)
 	}
 
-	router := host.Router(configs)
+	if cfg := settings.Providers.Kubernetes; cfg != nil {
+		kubernetes, err := provider.NewKubernetes(logger, cfg)
+		if err != nil {
+			logger.Error("Failed to create kubernetes provider", "error", err)
+			return 1
+		}
+		sites.AddProvider(ctx, kubernetes)
+	}
+
+	if *settings.Control.Enabled {
+		listener, err := admin.ListenSocket(settings.Control.Socket)
+		if err != nil {
+			logger.Error("Failed to open control socket", "socket", settings.Control.Socket, "error", err)
+			return 1
+		}
+		// Closing the listener removes the socket
+		defer listener.Close()
+		go controlServer(logger, listener, sites)
+	}
+
+	if *settings.Reload.Watch {
+		go sites.Watch(ctx, settings.Reload.Interval)
+	}
+	go reloadOnSignal(ctx, logger, sites)
+
+	router := sites.Handler()
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
@@ -65,8 +112,52 @@ func main() {
 		}()
 	}
 
+	if settings.Admin != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			adminServer(logger, settings, sites)
+		}()
+	}
+
 	logger.Info("starting app")
-	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(term)
+
+	select {
+	case <-done:
+	case sig := <-term:
+		logger.Info("Received signal, shutting down", "signal", sig.String())
+	}
+	return 0
+}
+
+// reloadOnSignal reloads the site configuration every time the process
+// receives SIGHUP.
+func reloadOnSignal(ctx context.Context, logger *slog.Logger, sites *manager.Manager) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("Received SIGHUP, reloading configuration")
+			if err := sites.Reload(); err != nil {
+				logger.Error("Reload failed, keeping last-known-good config", "error", err)
+			}
+		}
+	}
 }
 
 func defaultServer(logger *slog.Logger, settings *global.Settings, router http.Handler) {
@@ -99,6 +190,34 @@ func defaultServer(logger *slog.Logger, settings *global.Settings, router http.H
 	}
 }
 
+// adminServer serves the admin API on its own listener.
+func adminServer(logger *slog.Logger, settings *global.Settings, sites *manager.Manager) {
+	server := &http.Server{
+		Addr:        settings.Admin.Listen,
+		Handler:     admin.New(logger, sites, settings.Admin.Token),
+		ReadTimeout: settings.Server.Timeouts.Read,
+		IdleTimeout: settings.Server.Timeouts.Idle,
+	}
+
+	logger.Info("Admin API listening on", "addr", settings.Admin.Listen)
+	if err := server.ListenAndServe(); err != nil {
+		logger.Error("Error starting admin server", "error", err)
+		os.Exit(1)
+	}
+}
+
+// controlServer serves the admin API to the ctl subcommand on the control
+// socket.
+func controlServer(logger *slog.Logger, listener net.Listener, sites *manager.Manager) {
+	server := &http.Server{Handler: admin.New(logger, sites, "")}
+
+	logger.Info("Control socket listening on", "socket", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("Error serving control socket", "error", err)
+		os.Exit(1)
+	}
+}
+
 func tlsServer(logger *slog.Logger, settings *global.Settings, router http.Handler) {
 	if settings.Server.TLS != nil {
 		tlsCfg := settings.Server.TLS
@@ -2,4 +2,4 @@ module reverse-proxy
 
 go 1.22
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require gopkg.in/yaml.v3 v3.0.1
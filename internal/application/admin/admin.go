@@ -0,0 +1,305 @@
+// Package admin serves the JSON API operators use to inspect the running
+// proxy, change its sites and take upstreams out of rotation without a
+// reload.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reverse-proxy/internal/application/config"
+	"reverse-proxy/internal/application/manager"
+	"reverse-proxy/internal/application/site"
+	"reverse-proxy/internal/models/global"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSiteBytes limits the size of a site sent to the API.
+const maxSiteBytes = 1 << 20
+
+// actions maps the upstream actions of the API to the state they set.
+var actions = map[string]string{
+	"drain":   site.UpstreamDraining,
+	"disable": site.UpstreamDisabled,
+	"enable":  site.UpstreamActive,
+}
+
+// upstreamRequest names the upstream an action applies to. Without a path
+// the action applies to the upstream on every path of the site.
+type upstreamRequest struct {
+	URL  string `json:"url"`
+	Path string `json:"path"`
+}
+
+// Stats sums up the load balanced upstreams of every site.
+type Stats struct {
+	Uptime    string `json:"uptime"`
+	Sites     int    `json:"sites"`
+	Paths     int    `json:"paths"`
+	Upstreams int    `json:"upstreams"`
+	// Available counts the upstreams that may receive new requests.
+	Available int   `json:"available"`
+	InFlight  int64 `json:"in_flight"`
+	Requests  int64 `json:"requests"`
+	Failures  int64 `json:"failures"`
+}
+
+type api struct {
+	logger  *slog.Logger
+	sites   *manager.Manager
+	started time.Time
+}
+
+// New returns the admin API for the sites of m. When token isn't empty every
+// request must carry it as a bearer token.
+func New(logger *slog.Logger, m *manager.Manager, token string) http.Handler {
+	a := &api{logger: logger, sites: m, started: time.Now()}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sites", a.listSites)
+	mux.HandleFunc("POST /sites", a.createSite)
+	mux.HandleFunc("GET /sites/{domain}", a.getSite)
+	mux.HandleFunc("PUT /sites/{domain}", a.putSite)
+	mux.HandleFunc("DELETE /sites/{domain}", a.deleteSite)
+	mux.HandleFunc("POST /sites/{domain}/upstreams/{action}", a.setUpstreamState)
+	mux.HandleFunc("GET /stats", a.stats)
+	mux.HandleFunc("POST /reload", a.reload)
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (a *api) listSites(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.sites.Sites())
+}
+
+// siteDomain returns the domain in the URL of r the way sites are keyed, so
+// Example.com. names the site example.com.
+func siteDomain(r *http.Request) string {
+	return config.CanonicalDomain(r.PathValue("domain"))
+}
+
+func (a *api) getSite(w http.ResponseWriter, r *http.Request) {
+	domain := siteDomain(r)
+	handler := a.sites.Site(domain)
+	if handler == nil {
+		writeError(w, http.StatusNotFound, "unknown site: "+domain)
+		return
+	}
+	writeJSON(w, http.StatusOK, handler.Status())
+}
+
+func (a *api) createSite(w http.ResponseWriter, r *http.Request) {
+	cfg, persist, err := readSite(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.sites.CreateSite(cfg, persist); err != nil {
+		writeSiteError(w, err)
+		return
+	}
+
+	a.logger.Info("Admin created site", "domain", cfg.Domain, "persist", persist, "remote", r.RemoteAddr)
+	a.writeSite(w, http.StatusCreated, cfg.Domain)
+}
+
+func (a *api) putSite(w http.ResponseWriter, r *http.Request) {
+	domain := siteDomain(r)
+
+	cfg, persist, err := readSite(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if cfg.Domain != domain {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("domain %s doesn't match the URL", cfg.Domain))
+		return
+	}
+
+	created, err := a.sites.PutSite(cfg, persist)
+	if err != nil {
+		writeSiteError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	a.logger.Info("Admin updated site", "domain", domain, "persist", persist, "remote", r.RemoteAddr)
+	a.writeSite(w, status, domain)
+}
+
+func (a *api) deleteSite(w http.ResponseWriter, r *http.Request) {
+	domain := siteDomain(r)
+
+	persist, err := persistParam(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := a.sites.DeleteSite(domain, persist); err != nil {
+		writeSiteError(w, err)
+		return
+	}
+
+	a.logger.Info("Admin deleted site", "domain", domain, "persist", persist, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeSite answers with the status of the site just changed.
+func (a *api) writeSite(w http.ResponseWriter, status int, domain string) {
+	handler := a.sites.Site(domain)
+	if handler == nil {
+		writeError(w, http.StatusNotFound, "unknown site: "+domain)
+		return
+	}
+	writeJSON(w, status, handler.Status())
+}
+
+// readSite decodes the site in the body of r, in YAML or JSON, and the
+// persist query parameter.
+func readSite(r *http.Request) (*global.SiteConfig, bool, error) {
+	persist, err := persistParam(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxSiteBytes))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read site: %w", err)
+	}
+
+	cfg, err := config.ParseSite(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid site: %w", err)
+	}
+	return cfg, persist, nil
+}
+
+func persistParam(r *http.Request) (bool, error) {
+	raw := r.URL.Query().Get("persist")
+	if raw == "" {
+		return false, nil
+	}
+	persist, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid persist parameter: %s", raw)
+	}
+	return persist, nil
+}
+
+// writeSiteError maps the errors of the manager's site changes to a status.
+func writeSiteError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, manager.ErrUnknownSite):
+		status = http.StatusNotFound
+	case errors.Is(err, manager.ErrSiteExists), errors.Is(err, manager.ErrProvidedSite):
+		status = http.StatusConflict
+	case errors.Is(err, manager.ErrNotSaved):
+		status = http.StatusInternalServerError
+	}
+	writeError(w, status, err.Error())
+}
+
+func (a *api) setUpstreamState(w http.ResponseWriter, r *http.Request) {
+	domain, action := siteDomain(r), r.PathValue("action")
+
+	state, ok := actions[action]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown action: "+action)
+		return
+	}
+
+	handler := a.sites.Site(domain)
+	if handler == nil {
+		writeError(w, http.StatusNotFound, "unknown site: "+domain)
+		return
+	}
+
+	var req upstreamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+		writeError(w, http.StatusBadRequest, "request body must be a JSON object with the upstream url")
+		return
+	}
+
+	if err := handler.SetUpstreamState(req.Path, req.URL, state); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, site.ErrUnknownUpstream) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+
+	a.logger.Info("Admin changed upstream state", "domain", domain, "path", req.Path, "upstream", req.URL, "state", state, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, handler.Status())
+}
+
+func (a *api) stats(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{Uptime: time.Since(a.started).Round(time.Second).String()}
+	// The upstreams of a pool are counted once, however many paths share it
+	pools := make(map[string]bool)
+	for _, s := range a.sites.Sites() {
+		stats.Sites++
+		stats.Paths += len(s.Paths)
+		for _, p := range s.Paths {
+			if p.Pool != "" {
+				if pools[p.Pool] {
+					continue
+				}
+				pools[p.Pool] = true
+			}
+			for _, u := range p.Upstreams {
+				stats.Upstreams++
+				if u.Available() {
+					stats.Available++
+				}
+				stats.InFlight += u.InFlight
+				stats.Requests += u.Requests
+				stats.Failures += u.Failures
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *api) reload(w http.ResponseWriter, r *http.Request) {
+	a.logger.Info("Admin requested reload", "remote", r.RemoteAddr)
+	if err := a.sites.Reload(); err != nil {
+		a.logger.Error("Reload failed, keeping last-known-good config", "error", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sites": len(a.sites.Sites())})
+}
+
+// writeJSON writes v with the secrets of the configuration redacted.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(config.RedactValue(v))
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
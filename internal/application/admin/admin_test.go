@@ -0,0 +1,365 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/application/manager"
+	"reverse-proxy/internal/application/site"
+	"strings"
+	"testing"
+)
+
+func newManager(t *testing.T) *manager.Manager {
+	t.Helper()
+	return newManagerIn(t, t.TempDir())
+}
+
+// newManagerIn loads the sites of a manager from dir, which gets one site
+// example.com with two upstreams.
+func newManagerIn(t *testing.T, dir string) *manager.Manager {
+	t.Helper()
+	content := "domain: example.com\nproxy:\n  upstreams:\n    - url: http://a:80\n    - url: http://b:80\ntimeouts:\n  read: 5s\n"
+	if err := os.WriteFile(filepath.Join(dir, "example.com.yml"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write site: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	m := manager.New(logger, dir)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	return m
+}
+
+func call(handler http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAPI(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+
+	t.Run("list sites", func(t *testing.T) {
+		api := New(logger, newManager(t), "")
+
+		rec := call(api, "GET", "/sites", "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+
+		var sites []site.SiteStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &sites); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(sites) != 1 || sites[0].Domain != "example.com" {
+			t.Fatalf("Expected example.com, got %+v", sites)
+		}
+		if upstreams := sites[0].Paths[0].Upstreams; len(upstreams) != 2 || !upstreams[0].Healthy {
+			t.Errorf("Expected 2 healthy upstreams, got %+v", upstreams)
+		}
+	})
+
+	t.Run("drain and enable an upstream", func(t *testing.T) {
+		api := New(logger, newManager(t), "")
+
+		rec := call(api, "POST", "/sites/example.com/upstreams/drain", `{"url": "http://b:80"}`, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var status site.SiteStatus
+		json.Unmarshal(rec.Body.Bytes(), &status)
+		if state := status.Paths[0].Upstreams[1].State; state != site.UpstreamDraining {
+			t.Errorf("Expected b to be draining, got %s", state)
+		}
+
+		rec = call(api, "POST", "/sites/example.com/upstreams/enable", `{"url": "http://b:80"}`, "")
+		json.Unmarshal(rec.Body.Bytes(), &status)
+		if state := status.Paths[0].Upstreams[1].State; state != site.UpstreamActive {
+			t.Errorf("Expected b to be active again, got %s", state)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		api := New(logger, newManager(t), "")
+
+		testCases := []struct {
+			method, path, body string
+			status             int
+		}{
+			{"GET", "/sites/missing.com", "", http.StatusNotFound},
+			{"POST", "/sites/missing.com/upstreams/drain", `{"url": "http://b:80"}`, http.StatusNotFound},
+			{"POST", "/sites/example.com/upstreams/pause", `{"url": "http://b:80"}`, http.StatusNotFound},
+			{"POST", "/sites/example.com/upstreams/drain", `{"url": "http://c:80"}`, http.StatusNotFound},
+			{"POST", "/sites/example.com/upstreams/drain", `not json`, http.StatusBadRequest},
+			{"PATCH", "/sites/example.com", "", http.StatusMethodNotAllowed},
+		}
+		for _, tc := range testCases {
+			if rec := call(api, tc.method, tc.path, tc.body, ""); rec.Code != tc.status {
+				t.Errorf("%s %s: expected status %d, got %d", tc.method, tc.path, tc.status, rec.Code)
+			}
+		}
+	})
+
+	t.Run("domains in the URL are made canonical", func(t *testing.T) {
+		m := newManager(t)
+		api := New(logger, m, "")
+
+		if rec := call(api, "GET", "/sites/Example.COM.", "", ""); rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec := call(api, "POST", "/sites/Example.com/upstreams/drain", `{"url": "http://b:80"}`, ""); rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec := call(api, "DELETE", "/sites/EXAMPLE.com", "", ""); rec.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if m.Site("example.com") != nil {
+			t.Error("Expected example.com to be gone")
+		}
+	})
+
+	t.Run("create, update and delete sites", func(t *testing.T) {
+		m := newManager(t)
+		api := New(logger, m, "")
+
+		rec := call(api, "POST", "/sites", "domain: app.local\nproxy:\n  upstream: http://c:80\n", "")
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec := call(api, "POST", "/sites", "domain: app.local\nproxy:\n  upstream: http://c:80\n", ""); rec.Code != http.StatusConflict {
+			t.Errorf("Expected status 409 for an existing site, got %d", rec.Code)
+		}
+
+		rec = call(api, "PUT", "/sites/app.local", `{"domain": "app.local", "proxy": {"upstreams": ["http://c:80", "http://d:80"]}}`, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var status site.SiteStatus
+		json.Unmarshal(rec.Body.Bytes(), &status)
+		if len(status.Paths) != 1 || len(status.Paths[0].Upstreams) != 2 {
+			t.Errorf("Expected the updated site with 2 upstreams, got %+v", status)
+		}
+
+		if rec := call(api, "DELETE", "/sites/app.local", "", ""); rec.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", rec.Code)
+		}
+		if m.Site("app.local") != nil {
+			t.Error("Expected app.local to be gone")
+		}
+	})
+
+	t.Run("persist", func(t *testing.T) {
+		dir := t.TempDir()
+		api := New(logger, newManagerIn(t, dir), "")
+
+		rec := call(api, "PUT", "/sites/app.local?persist=true", "domain: app.local\nproxy:\n  upstream: http://c:80\n", "")
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "app.local.yml")); err != nil {
+			t.Errorf("Expected app.local.yml to be written: %v", err)
+		}
+	})
+
+	t.Run("persisted references are not interpolated", func(t *testing.T) {
+		t.Setenv("TEST_ADMIN_SECRET", "s3cret-value")
+		dir := t.TempDir()
+		m := newManagerIn(t, dir)
+		api := New(logger, m, "")
+
+		body := "domain: app.local\nproxy:\n  upstream: http://c:80\n  headers:\n    X-Secret: ${TEST_ADMIN_SECRET}\n    X-Price: $$5\n"
+		if rec := call(api, "PUT", "/sites/app.local?persist=true", body, ""); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		headers := m.Site("app.local").Site.Proxy.Headers
+		if headers["X-Secret"] != "${TEST_ADMIN_SECRET}" || headers["X-Price"] != "$$5" {
+			t.Errorf("Expected the headers to stay literal, got %v", headers)
+		}
+	})
+
+	t.Run("invalid sites", func(t *testing.T) {
+		api := New(logger, newManager(t), "")
+
+		testCases := []struct {
+			method, path, body string
+			status             int
+		}{
+			{"POST", "/sites", "proxy:\n  upstream: http://c:80\n", http.StatusBadRequest},
+			{"POST", "/sites", "domain: app.local\n", http.StatusBadRequest},
+			{"POST", "/sites?persist=maybe", "domain: app.local\nproxy:\n  upstream: http://c:80\n", http.StatusBadRequest},
+			{"PUT", "/sites/other.local", "domain: app.local\nproxy:\n  upstream: http://c:80\n", http.StatusBadRequest},
+			{"DELETE", "/sites/missing.com", "", http.StatusNotFound},
+		}
+		for _, tc := range testCases {
+			if rec := call(api, tc.method, tc.path, tc.body, ""); rec.Code != tc.status {
+				t.Errorf("%s %s: expected status %d, got %d: %s", tc.method, tc.path, tc.status, rec.Code, rec.Body.String())
+			}
+		}
+	})
+
+	t.Run("secrets are redacted", func(t *testing.T) {
+		t.Setenv("TEST_UPSTREAM_PASSWORD", "s3cret-password")
+		dir := t.TempDir()
+		content := "domain: private.local\nproxy:\n  upstreams:\n    - http://user:${secret:TEST_UPSTREAM_PASSWORD}@c:80\n"
+		if err := os.WriteFile(filepath.Join(dir, "private.local.yml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write site: %v", err)
+		}
+		api := New(logger, newManagerIn(t, dir), "")
+
+		rec := call(api, "GET", "/sites/private.local", "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if body := rec.Body.String(); strings.Contains(body, "s3cret") || !strings.Contains(body, "[REDACTED]") {
+			t.Errorf("Expected the password to be redacted, got %s", body)
+		}
+	})
+
+	t.Run("token", func(t *testing.T) {
+		api := New(logger, newManager(t), "secret")
+
+		if rec := call(api, "GET", "/sites", "", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 without token, got %d", rec.Code)
+		}
+		if rec := call(api, "GET", "/sites", "", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 with wrong token, got %d", rec.Code)
+		}
+		if rec := call(api, "GET", "/sites", "", "secret"); rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200 with token, got %d", rec.Code)
+		}
+	})
+}
+
+func TestAdminStatsAndReload(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	dir := t.TempDir()
+	m := newManagerIn(t, dir)
+	api := New(logger, m, "")
+
+	call(api, "POST", "/sites/example.com/upstreams/disable", `{"url": "http://a:80"}`, "")
+
+	var stats Stats
+	json.Unmarshal(call(api, "GET", "/stats", "", "").Body.Bytes(), &stats)
+	if stats.Sites != 1 || stats.Paths != 1 || stats.Upstreams != 2 || stats.Available != 1 {
+		t.Errorf("Expected 1 of 2 upstreams available, got %+v", stats)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "other.local.yml"), []byte("domain: other.local\nproxy:\n  upstream: http://c:80\n"), 0644); err != nil {
+		t.Fatalf("Failed to write site: %v", err)
+	}
+	rec := call(api, "POST", "/reload", "", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"sites":2}` {
+		t.Errorf("Expected reload with 2 sites, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	os.WriteFile(filepath.Join(dir, "broken.yml"), []byte("domain: [unclosed"), 0644)
+	if rec := call(api, "POST", "/reload", "", ""); rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 for a broken site file, got %d", rec.Code)
+	}
+}
+
+func TestAdminStatsSharedPool(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "upstreams.d"), 0755); err != nil {
+		t.Fatalf("Failed to create upstreams.d: %v", err)
+	}
+	files := map[string]string{
+		"upstreams.d/api.yml": "upstreams:\n  - http://a:80\n  - http://b:80\n",
+		"one.local.yml":       "domain: one.local\nproxy:\n  pool: api\n",
+		"two.local.yml":       "domain: two.local\nproxy:\n  pool: api\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	m := manager.New(logger, dir)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	var stats Stats
+	json.Unmarshal(call(New(logger, m, ""), "GET", "/stats", "", "").Body.Bytes(), &stats)
+	if stats.Sites != 2 || stats.Paths != 2 || stats.Upstreams != 2 || stats.Available != 2 {
+		t.Errorf("Expected the 2 upstreams of the shared pool to count once, got %+v", stats)
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	// Unix socket paths are short, t.TempDir can be too long
+	dir, err := os.MkdirTemp("", "admin")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "control.sock")
+
+	listener, err := ListenSocket(socket)
+	if err != nil {
+		t.Fatalf("ListenSocket failed: %v", err)
+	}
+	if info, _ := os.Stat(socket); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket mode 0600, got %v", info.Mode().Perm())
+	}
+	if addr := listener.Addr().String(); addr != socket {
+		t.Errorf("Expected address %s, got %s", socket, addr)
+	}
+
+	if _, err := ListenSocket(socket); err == nil {
+		t.Error("Expected error while the socket is in use, got nil")
+	}
+
+	listener.Close()
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed on close, got %v", err)
+	}
+
+	// A socket left behind by a process that is gone is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err = ListenSocket(socket)
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+
+	// A missing directory is created for the owner only
+	nested := filepath.Join(dir, "run", "control.sock")
+	listener, err = ListenSocket(nested)
+	if err != nil {
+		t.Fatalf("ListenSocket failed: %v", err)
+	}
+	listener.Close()
+	if info, _ := os.Stat(filepath.Dir(nested)); info.Mode().Perm() != 0700 {
+		t.Errorf("Expected directory mode 0700, got %v", info.Mode().Perm())
+	}
+
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, nil, 0644)
+	if _, err := ListenSocket(regular); err == nil {
+		t.Error("Expected error for a regular file, got nil")
+	}
+}
@@ -0,0 +1,109 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reverse-proxy/internal/application/site"
+	"time"
+)
+
+// Client calls the admin API of a running proxy through its control socket.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the control socket at the given path.
+func NewClient(socket string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport, Timeout: 30 * time.Second}}
+}
+
+// Sites returns the status of every loaded site.
+func (c *Client) Sites() ([]site.SiteStatus, error) {
+	var sites []site.SiteStatus
+	return sites, c.do(http.MethodGet, "/sites", nil, &sites)
+}
+
+// Site returns the status of the site serving domain.
+func (c *Client) Site(domain string) (site.SiteStatus, error) {
+	var status site.SiteStatus
+	return status, c.do(http.MethodGet, "/sites/"+url.PathEscape(domain), nil, &status)
+}
+
+// SetUpstreamState runs action ("drain", "disable" or "enable") on the
+// upstream of domain, on every path unless path is set, and returns the
+// site's new status.
+func (c *Client) SetUpstreamState(domain, action, upstream, path string) (site.SiteStatus, error) {
+	var status site.SiteStatus
+	req := upstreamRequest{URL: upstream, Path: path}
+	return status, c.do(http.MethodPost, "/sites/"+url.PathEscape(domain)+"/upstreams/"+url.PathEscape(action), req, &status)
+}
+
+// Reload makes the proxy re-read its site files and returns the number of
+// sites loaded.
+func (c *Client) Reload() (int, error) {
+	var result struct {
+		Sites int `json:"sites"`
+	}
+	return result.Sites, c.do(http.MethodPost, "/reload", nil, &result)
+}
+
+// Stats returns the totals over every site.
+func (c *Client) Stats() (Stats, error) {
+	var stats Stats
+	return stats, c.do(http.MethodGet, "/stats", nil, &stats)
+}
+
+// do sends body as JSON and decodes the answer into out. Error answers are
+// returned as errors carrying the API's message.
+func (c *Client) do(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored, every request goes to the socket
+	req, err := http.NewRequest(method, "http://control"+path, reader)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the proxy: %w", err)
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+			return fmt.Errorf("proxy returned status %d", resp.StatusCode)
+		}
+		return errors.New(apiErr.Error)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,16 +12,35 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// LoadConfigs reads every site file in dir. Files declaring the same domain
+// are an error.
 func LoadConfigs(dir string) (map[string]*global.SiteConfig, error) {
+	return LoadConfigsWith(dir, DuplicatesError)
+}
+
+// LoadConfigsWith reads every site file in dir and combines files declaring
+// the same domain according to duplicates, see CombineSites. Relative paths
+// in the files are relative to dir.
+func LoadConfigsWith(dir, duplicates string) (map[string]*global.SiteConfig, error) {
+	var found []string
+	sites, err := loadSites(dir, duplicates, &found)
+	setSecrets(siteSecrets, found, err == nil)
+	return sites, err
+}
+
+// loadSites is LoadConfigsWith, appending the secrets of the files to found.
+func loadSites(dir, duplicates string, found *[]string) (map[string]*global.SiteConfig, error) {
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	sites := make(map[string]*global.SiteConfig)
+	// os.ReadDir sorts by name, which makes the file order of merges stable
+	var domains []string
+	declared := make(map[string][]SiteFile)
 
 	for _, f := range files {
-		if f.IsDir() || !strings.HasSuffix(f.Name(), ".yml") || f.Name() == "settings.yml" {
+		if !isSiteFile(f) {
 			continue
 		}
 
@@ -28,17 +49,233 @@ func LoadConfigs(dir string) (map[string]*global.SiteConfig, error) {
 			return nil, err
 		}
 
-		var cfg global.SiteConfig
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return nil, err
+		cfg, err := parseSiteFile(data, dir, found)
+		if errors.Is(err, errDomainMissing) {
+			return nil, fmt.Errorf("domain missing in %s", f.Name())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
 		}
 
-		if cfg.Domain == "" {
-			return nil, fmt.Errorf("domain missing in %s", f.Name())
+		if _, ok := declared[cfg.Domain]; !ok {
+			domains = append(domains, cfg.Domain)
 		}
+		declared[cfg.Domain] = append(declared[cfg.Domain], SiteFile{Name: f.Name(), Site: ResolveSitePaths(cfg, dir)})
+	}
 
-		sites[cfg.Domain] = &cfg
+	sites := make(map[string]*global.SiteConfig, len(domains))
+	var errs []error
+	for _, domain := range domains {
+		cfg, err := CombineSites(declared[domain], duplicates)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sites[domain] = cfg
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
 
 	return sites, nil
 }
+
+var errDomainMissing = errors.New("domain missing")
+
+// ParseSite decodes a site from YAML, or JSON which is valid YAML too, and
+// checks it like LoadConfigs checks site files. The domain is made canonical.
+// Unlike in site files references aren't interpolated, as the data may come
+// from a client that mustn't read the environment or files of the proxy.
+func ParseSite(data []byte) (*global.SiteConfig, error) {
+	var cfg global.SiteConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return checkSite(&cfg)
+}
+
+// parseSiteFile is ParseSite for the contents of a site file in dir, whose
+// references are interpolated. The secrets among them are appended to found.
+func parseSiteFile(data []byte, dir string, found *[]string) (*global.SiteConfig, error) {
+	var cfg global.SiteConfig
+	if err := decodeInterpolated(data, dir, &cfg, found); err != nil {
+		return nil, err
+	}
+	return checkSite(&cfg)
+}
+
+func checkSite(cfg *global.SiteConfig) (*global.SiteConfig, error) {
+	if err := CheckDomain(cfg.Domain); err != nil {
+		return nil, err
+	}
+	cfg.Domain = CanonicalDomain(cfg.Domain)
+
+	return cfg, nil
+}
+
+// CheckDomain reports whether domain can name a site. It must be set and
+// must not look like a path, since it names the site file.
+func CheckDomain(domain string) error {
+	if domain == "" {
+		return errDomainMissing
+	}
+	if strings.ContainsAny(domain, "/\\") || strings.HasPrefix(domain, ".") {
+		return fmt.Errorf("invalid domain: %s", domain)
+	}
+	return nil
+}
+
+// WriteSite saves cfg to the site file that already holds its domain, or to
+// <domain>.yml in dir if there is none. The file is replaced atomically so a
+// concurrent reload never reads half of it. When several files declare the
+// domain cfg goes to the first, and the others are removed since cfg
+// replaces the site they were merged into. Sites are written the way
+// ParseSite reads them, literally: references in them are escaped so the
+// next load doesn't interpolate them.
+func WriteSite(dir string, cfg *global.SiteConfig) error {
+	var node yaml.Node
+	if err := node.Encode(cfg); err != nil {
+		return err
+	}
+	escape(&node)
+
+	var data bytes.Buffer
+	encoder := yaml.NewEncoder(&data)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	paths, err := siteFiles(dir, cfg.Domain)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, cfg.Domain+".yml")
+	if len(paths) > 0 {
+		path = paths[0]
+	}
+
+	// The temporary file doesn't end in .yml, so it is never loaded
+	tmp, err := os.CreateTemp(dir, "."+cfg.Domain+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	for i := 1; i < len(paths); i++ {
+		if err := os.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveSite deletes the site files holding domain from dir, if there are
+// any.
+func RemoveSite(dir, domain string) error {
+	paths, err := siteFiles(dir, domain)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// siteFiles returns the paths of the site files in dir whose domain is
+// domain, in name order. Files that don't parse are skipped.
+func siteFiles(dir, domain string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	for _, f := range files {
+		if !isSiteFile(f) {
+			continue
+		}
+
+		path := filepath.Join(dir, f.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var cfg global.SiteConfig
+		if yaml.Unmarshal(data, &cfg) == nil && CanonicalDomain(cfg.Domain) == domain {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
+}
+
+// Fingerprint summarises the name, size and modification time of every site
+// and pool file in dir. Two calls return the same value unless one was added,
+// removed or modified in between.
+func Fingerprint(dir string) (string, error) {
+	sites, err := SiteFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	pools, err := PoolFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, path := range append(sites, pools...) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+
+		name, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(&b, "%s:%d:%d;", name, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return b.String(), nil
+}
+
+// SiteFiles returns the paths of the site files in dir, the files
+// LoadConfigs reads.
+func SiteFiles(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, f := range files {
+		if isSiteFile(f) {
+			paths = append(paths, filepath.Join(dir, f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+func isSiteFile(f os.DirEntry) bool {
+	return !f.IsDir() && strings.HasSuffix(f.Name(), ".yml") && f.Name() != "settings.yml"
+}
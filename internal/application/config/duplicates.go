@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"reverse-proxy/internal/application/site"
+	"reverse-proxy/internal/models/global"
+	"strings"
+)
+
+const (
+	// DuplicatesError refuses to load site files that declare the same
+	// domain.
+	DuplicatesError = "error"
+	// DuplicatesMerge combines site files that declare the same domain into
+	// one site with the paths of all of them.
+	DuplicatesMerge = "merge"
+)
+
+// ParseDuplicates returns the duplicates policy named by value, by default
+// DuplicatesError.
+func ParseDuplicates(value string) (string, error) {
+	switch value {
+	case "":
+		return DuplicatesError, nil
+	case DuplicatesError, DuplicatesMerge:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid sites.duplicates %q, must be %q or %q", value, DuplicatesError, DuplicatesMerge)
+	}
+}
+
+// SiteFile is a site and the name of the file it was read from.
+type SiteFile struct {
+	Name string
+	Site *global.SiteConfig
+}
+
+// CanonicalDomain returns domain the way sites are keyed: in lower case and
+// without the trailing dot of a fully qualified name.
+func CanonicalDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// CombineSites returns the site for files that all declare the same domain,
+// given in file name order. More than one file is an error unless duplicates
+// is DuplicatesMerge.
+func CombineSites(files []SiteFile, duplicates string) (*global.SiteConfig, error) {
+	if len(files) == 1 {
+		return files[0].Site, nil
+	}
+
+	if duplicates != DuplicatesMerge {
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = f.Name
+		}
+		last := len(names) - 1
+		return nil, fmt.Errorf("domain %s is declared in %s and %s", files[0].Site.Domain, strings.Join(names[:last], ", "), names[last])
+	}
+
+	return mergeSites(files)
+}
+
+// mergeSites combines files into one site routing the paths of every file.
+// A file without paths contributes "/", and each file's site-wide upstreams
+// and headers are copied into its own paths, so every path proxies the way it
+// did in its file. The listen address and timeouts come from the first file.
+// A path declared in two files is an error, as neither can be preferred.
+func mergeSites(files []SiteFile) (*global.SiteConfig, error) {
+	first := files[0].Site
+	merged := &global.SiteConfig{
+		Domain:   first.Domain,
+		Listen:   first.Listen,
+		Timeouts: first.Timeouts,
+	}
+
+	declared := make(map[string]string)
+	for _, f := range files {
+		for _, p := range standalonePaths(f.Site) {
+			if name, ok := declared[p.Path]; ok {
+				return nil, fmt.Errorf("path %s of %s is declared in %s and %s", p.Path, first.Domain, name, f.Name)
+			}
+			declared[p.Path] = f.Name
+			merged.Proxy.Paths = append(merged.Proxy.Paths, p)
+		}
+	}
+
+	return merged, nil
+}
+
+// standalonePaths returns the paths of cfg with what they take from the site
+// settings filled in, so they route the same without them.
+func standalonePaths(cfg *global.SiteConfig) []global.ProxyPath {
+	root := cfg.Proxy.PathBase
+	if len(cfg.Proxy.Paths) == 0 {
+		return []global.ProxyPath{{Path: "/", PathBase: root}}
+	}
+
+	_, rootBalanced := site.BalancedUpstreams(&root)
+	rootBalanced = rootBalanced || root.Pool != ""
+	paths := make([]global.ProxyPath, len(cfg.Proxy.Paths))
+	for i, p := range cfg.Proxy.Paths {
+		// Paths without upstreams of their own use the site's load balancer
+		if _, ok := site.BalancedUpstreams(&p.PathBase); !ok && p.Pool == "" && rootBalanced {
+			headers := p.Headers
+			p.PathBase = root
+			p.Headers = headers
+		}
+
+		// Site headers are set first, so the path's win
+		if len(root.Headers) > 0 {
+			headers := make(map[string]string, len(root.Headers)+len(p.Headers))
+			for k, v := range root.Headers {
+				headers[k] = v
+			}
+			for k, v := range p.Headers {
+				headers[k] = v
+			}
+			p.Headers = headers
+		}
+
+		paths[i] = p
+	}
+	return paths
+}
@@ -0,0 +1,327 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// reference matches ${NAME}, ${NAME:-default}, ${secret:NAME} and
+// ${file:/path} in a value, and $$ which stands for a literal $.
+var reference = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// InterpolationError is a reference in a configuration file that couldn't
+// be resolved.
+type InterpolationError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *InterpolationError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *InterpolationError) Unwrap() error {
+	return e.Err
+}
+
+// Interpolate replaces the references in the scalar values below node:
+// ${NAME} with the environment variable NAME, ${NAME:-default} with default
+// when NAME is unset or empty, ${secret:NAME} like ${NAME} and
+// ${file:/path} with the contents of the file without trailing newlines,
+// relative to dir. Keys are left alone. Every reference that can't be
+// resolved is returned as an *InterpolationError, joined. The values of
+// secret and file references, but not their defaults, are secrets: see
+// Redact. They stay secrets for as long as the process runs, unlike those of
+// the files the proxy loads, which are replaced by every load.
+func Interpolate(node *yaml.Node, dir string) error {
+	in := interpolation{dir: dir}
+	in.interpolate(node)
+	setSecrets(interpolatedSecrets, in.secrets, false)
+	return errors.Join(in.errs...)
+}
+
+// interpolation holds the errors and the secrets of interpolating a file.
+type interpolation struct {
+	dir     string
+	errs    []error
+	secrets []string
+}
+
+func (in *interpolation) interpolate(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value, err := in.expand(node.Value)
+		if err != nil {
+			in.errs = append(in.errs, &InterpolationError{Line: node.Line, Column: node.Column, Err: err})
+			return
+		}
+		if value == node.Value {
+			return
+		}
+		node.Value = value
+		// Plain scalars are typed by what they hold now, so ${PORT} can be
+		// an int
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			in.interpolate(node.Content[i])
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			in.interpolate(child)
+		}
+	}
+}
+
+// escape doubles every $ in the scalar values below node, so interpolating
+// them gives back the values as they are. Keys are left alone, like by
+// Interpolate.
+func escape(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		node.Value = strings.ReplaceAll(node.Value, "$", "$$")
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			escape(node.Content[i])
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			escape(child)
+		}
+	}
+}
+
+// decodeInterpolated decodes the YAML in data into v after interpolating it,
+// with files referred to relative to dir. The secrets it resolved are
+// appended to found, even if it fails.
+func decodeInterpolated(data []byte, dir string, v any, found *[]string) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		// Empty, v keeps its zero value like with yaml.Unmarshal
+		return nil
+	}
+
+	in := interpolation{dir: dir}
+	in.interpolate(&doc)
+	*found = append(*found, in.secrets...)
+	if err := errors.Join(in.errs...); err != nil {
+		return err
+	}
+	return doc.Decode(v)
+}
+
+// expand resolves the references in s.
+func (in *interpolation) expand(s string) (string, error) {
+	var errs []error
+	expanded := reference.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		value, err := in.resolve(match[2 : len(match)-1])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return value
+	})
+	return expanded, errors.Join(errs...)
+}
+
+// resolve returns the value of the reference ref, the text between ${ and }.
+func (in *interpolation) resolve(ref string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		data, err := os.ReadFile(ResolvePath(in.dir, path))
+		if err != nil {
+			return "", fmt.Errorf("failed to read ${%s}: %w", ref, err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		in.secrets = append(in.secrets, value)
+		return value, nil
+	}
+
+	name, secret := strings.CutPrefix(ref, "secret:")
+	name, fallback, hasDefault := strings.Cut(name, ":-")
+	if !envName.MatchString(name) {
+		return "", fmt.Errorf("invalid reference ${%s}", ref)
+	}
+
+	value, set := os.LookupEnv(name)
+	switch {
+	case value != "":
+		if secret {
+			in.secrets = append(in.secrets, value)
+		}
+		return value, nil
+	case hasDefault:
+		return fallback, nil
+	case !set:
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	default:
+		return "", nil
+	}
+}
+
+// The kinds of configuration secrets are read from.
+const (
+	settingsSecrets     = "settings"
+	siteSecrets         = "sites"
+	poolSecrets         = "pools"
+	interpolatedSecrets = "interpolated"
+)
+
+var secrets struct {
+	sync.RWMutex
+	kinds  map[string][]string // by the kind of configuration holding them
+	values []string            // of all kinds, longest first, so a secret containing another wins
+}
+
+// setSecrets makes found the secrets of the configuration of kind, which
+// Redact replaces whatever their length. Only values marked as secret are
+// found, so ordinary ones such as hosts and ports stay readable. Unless
+// replace is set found is added to the secrets kind had, as when a reload
+// failed and the configuration it read isn't in use yet.
+func setSecrets(kind string, found []string, replace bool) {
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	if secrets.kinds == nil {
+		secrets.kinds = make(map[string][]string)
+	}
+	if replace {
+		secrets.kinds[kind] = nil
+	}
+	for _, value := range found {
+		if value != "" && !slices.Contains(secrets.kinds[kind], value) {
+			secrets.kinds[kind] = append(secrets.kinds[kind], value)
+		}
+	}
+
+	secrets.values = nil
+	for _, values := range secrets.kinds {
+		for _, value := range values {
+			if !slices.Contains(secrets.values, value) {
+				secrets.values = append(secrets.values, value)
+			}
+		}
+	}
+	sort.SliceStable(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// Redacted replaces a secret wherever it appears.
+const Redacted = "[REDACTED]"
+
+// Redact returns s with every secret value of the configuration, from a
+// secret or file reference, replaced by Redacted.
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	for _, v := range secrets.values {
+		s = strings.ReplaceAll(s, v, Redacted)
+	}
+	return s
+}
+
+// RedactValue returns a copy of v with its strings redacted, for values
+// about to be marshalled: redacting the output could change keys and break
+// its syntax. Map keys and unexported fields are left alone.
+func RedactValue(v any) any {
+	if v == nil {
+		return nil
+	}
+	return redactValue(reflect.ValueOf(v)).Interface()
+}
+
+func redactValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.String:
+		redacted := reflect.New(v.Type()).Elem()
+		redacted.SetString(Redact(v.String()))
+		return redacted
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		if v.Kind() == reflect.Interface {
+			redacted := reflect.New(v.Type()).Elem()
+			redacted.Set(redactValue(v.Elem()))
+			return redacted
+		}
+		redacted := reflect.New(v.Type().Elem())
+		redacted.Elem().Set(redactValue(v.Elem()))
+		return redacted
+	case reflect.Struct:
+		redacted := reflect.New(v.Type()).Elem()
+		redacted.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				redacted.Field(i).Set(redactValue(v.Field(i)))
+			}
+		}
+		return redacted
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		redacted := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			redacted.Index(i).Set(redactValue(v.Index(i)))
+		}
+		return redacted
+	case reflect.Array:
+		redacted := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			redacted.Index(i).Set(redactValue(v.Index(i)))
+		}
+		return redacted
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		redacted := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			redacted.SetMapIndex(iter.Key(), redactValue(iter.Value()))
+		}
+		return redacted
+	}
+	return v
+}
+
+// RedactAttr is a slog.HandlerOptions.ReplaceAttr function that redacts
+// secrets from string, error and Stringer attributes.
+func RedactAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindString {
+		a.Value = slog.StringValue(Redact(a.Value.String()))
+		return a
+	}
+	if a.Value.Kind() != slog.KindAny {
+		return a
+	}
+
+	switch v := a.Value.Any().(type) {
+	case error:
+		a.Value = slog.StringValue(Redact(v.Error()))
+	case fmt.Stringer:
+		a.Value = slog.StringValue(Redact(v.String()))
+	}
+	return a
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"path/filepath"
+	"reverse-proxy/internal/models/global"
+)
+
+// ResolvePath returns path relative to dir unless it is empty or absolute.
+// Relative paths in the settings and site files are relative to the
+// directory of the settings file and the configuration directory, so they
+// don't depend on where the proxy is started from.
+func ResolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// ResolveSettingsPaths resolves the file paths of cfg against dir, the
+// directory of the settings file.
+func ResolveSettingsPaths(cfg *global.Settings, dir string) {
+	if t := cfg.Server.TLS; t != nil {
+		t.CertFile = ResolvePath(dir, t.CertFile)
+		t.KeyFile = ResolvePath(dir, t.KeyFile)
+	}
+	if k := cfg.Providers.Kubernetes; k != nil {
+		k.TokenFile = ResolvePath(dir, k.TokenFile)
+		k.CAFile = ResolvePath(dir, k.CAFile)
+	}
+	cfg.Control.Socket = ResolvePath(dir, cfg.Control.Socket)
+}
+
+// ResolveSitePaths returns cfg with the file paths in it resolved against
+// dir, the configuration directory. cfg itself is left as it is, so a site
+// from the admin API can still be written the way it was sent.
+func ResolveSitePaths(cfg *global.SiteConfig, dir string) *global.SiteConfig {
+	resolved := *cfg
+	resolved.Proxy.Discovery = resolveDiscovery(cfg.Proxy.Discovery, dir)
+	resolved.Proxy.Paths = make([]global.ProxyPath, len(cfg.Proxy.Paths))
+	for i, p := range cfg.Proxy.Paths {
+		p.Discovery = resolveDiscovery(p.Discovery, dir)
+		resolved.Proxy.Paths[i] = p
+	}
+	if cfg.Proxy.Paths == nil {
+		resolved.Proxy.Paths = nil
+	}
+	return &resolved
+}
+
+// resolveDiscovery returns d with the path of its target file resolved
+// against dir, copied if that changes it.
+func resolveDiscovery(d *global.Discovery, dir string) *global.Discovery {
+	if d == nil || d.File == nil || d.File.Path == ResolvePath(dir, d.File.Path) {
+		return d
+	}
+
+	file := *d.File
+	file.Path = ResolvePath(dir, file.Path)
+	resolved := *d
+	resolved.File = &file
+	return &resolved
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/models/global"
+	"strings"
+)
+
+// PoolsDir is the directory below the configuration directory holding the
+// upstream pools, one file per pool named after it.
+const PoolsDir = "upstreams.d"
+
+// LoadPools reads every pool file in the upstreams.d directory of dir, by
+// pool name. Without the directory there are no pools. Relative paths in the
+// files are relative to dir, like in site files.
+func LoadPools(dir string) (map[string]*global.Pool, error) {
+	var found []string
+	pools, err := loadPools(dir, &found)
+	setSecrets(poolSecrets, found, err == nil)
+	return pools, err
+}
+
+// loadPools is LoadPools, appending the secrets of the files to found.
+func loadPools(dir string, found *[]string) (map[string]*global.Pool, error) {
+	files, err := PoolFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make(map[string]*global.Pool, len(files))
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var pool global.Pool
+		if err := decodeInterpolated(data, dir, &pool, found); err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", PoolsDir, filepath.Base(path), err)
+		}
+		pool.Discovery = resolveDiscovery(pool.Discovery, dir)
+		pools[PoolName(path)] = &pool
+	}
+
+	return pools, nil
+}
+
+// PoolFiles returns the paths of the pool files of dir, the files LoadPools
+// reads.
+func PoolFiles(dir string) ([]string, error) {
+	files, err := os.ReadDir(filepath.Join(dir, PoolsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".yml") {
+			paths = append(paths, filepath.Join(dir, PoolsDir, f.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// PoolName returns the name of the pool defined in the file at path.
+func PoolName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".yml")
+}
@@ -1,26 +1,69 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"reverse-proxy/internal/models/global"
-
-	"gopkg.in/yaml.v3"
+	"time"
 )
 
+// DefaultControlSocket returns where the control socket is created unless
+// the settings say otherwise: in the user's runtime directory, or in a
+// directory of the user's in the temporary directory without one.
+func DefaultControlSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "reverse-proxy", "control.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("reverse-proxy-%d", os.Getuid()), "control.sock")
+}
+
 func LoadSettings(path string) (*global.Settings, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	// Relative paths are relative to the directory of the settings file
+	dir := filepath.Dir(path)
 	var cfg global.Settings
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	var found []string
+	err = decodeInterpolated(data, dir, &cfg, &found)
+	setSecrets(settingsSecrets, found, err == nil)
+	if err != nil {
 		return nil, err
 	}
+	ResolveSettingsPaths(&cfg, dir)
 
 	if cfg.Server.Listen == "" {
 		cfg.Server.Listen = ":80"
 	}
 
+	if cfg.Admin != nil && cfg.Admin.Listen == "" {
+		cfg.Admin.Listen = "127.0.0.1:9901"
+	}
+
+	if cfg.Control.Enabled == nil {
+		enabled := false
+		cfg.Control.Enabled = &enabled
+	}
+
+	if cfg.Control.Socket == "" {
+		cfg.Control.Socket = DefaultControlSocket()
+	}
+
+	if cfg.Sites.Duplicates, err = ParseDuplicates(cfg.Sites.Duplicates); err != nil {
+		return nil, err
+	}
+
+	if cfg.Reload.Watch == nil {
+		watch := true
+		cfg.Reload.Watch = &watch
+	}
+
+	if cfg.Reload.Interval <= 0 {
+		cfg.Reload.Interval = 2 * time.Second
+	}
+
 	return &cfg, nil
 }
@@ -5,17 +5,43 @@ package host
 import (
 	"net/http"
 	"strings"
+	"sync/atomic"
 )
 
 func Router(sites map[string]http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host := strings.Split(r.Host, ":")[0] // remove port
+	return NewTable(sites)
+}
+
+// Table is a host router whose site map can be replaced while it is serving.
+// Requests that already picked a handler keep using it until they finish.
+type Table struct {
+	sites atomic.Pointer[map[string]http.Handler]
+}
+
+func NewTable(sites map[string]http.Handler) *Table {
+	t := &Table{}
+	t.Swap(sites)
+	return t
+}
+
+// Swap atomically replaces the site map used for new requests.
+func (t *Table) Swap(sites map[string]http.Handler) {
+	if sites == nil {
+		sites = make(map[string]http.Handler)
+	}
+	t.sites.Store(&sites)
+}
+
+func (t *Table) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.Split(r.Host, ":")[0] // remove port
+	// Sites are keyed by lower case domains without the trailing dot
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
 
-		if h, ok := sites[host]; ok {
-			h.ServeHTTP(w, r)
-			return
-		}
+	sites := *t.sites.Load()
+	if h, ok := sites[host]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
 
-		http.NotFound(w, r)
-	})
+	http.NotFound(w, r)
 }
@@ -121,6 +121,24 @@ func TestHostRouter(t *testing.T) {
 		}
 	})
 
+	t.Run("host in upper case with trailing dot", func(t *testing.T) {
+		router := Router(map[string]http.Handler{
+			"example.com": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+		})
+
+		req := httptest.NewRequest("GET", "http://Example.COM./path", nil)
+		req.Host = "Example.COM.:8080"
+		rec := httptest.NewRecorder()
+
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200 for Example.COM., got %d", rec.Code)
+		}
+	})
+
 	t.Run("empty sites map", func(t *testing.T) {
 		sites := map[string]http.Handler{}
 		router := Router(sites)
@@ -139,3 +157,43 @@ func TestHostRouter(t *testing.T) {
 		}
 	})
 }
+
+func TestTable(t *testing.T) {
+	t.Run("swap replaces sites", func(t *testing.T) {
+		oldHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("old"))
+		})
+		newHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("new"))
+		})
+
+		table := NewTable(map[string]http.Handler{"example.com": oldHandler})
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		rec := httptest.NewRecorder()
+		table.ServeHTTP(rec, req)
+		if rec.Body.String() != "old" {
+			t.Errorf("Expected 'old', got '%s'", rec.Body.String())
+		}
+
+		table.Swap(map[string]http.Handler{"example.com": newHandler})
+
+		rec = httptest.NewRecorder()
+		table.ServeHTTP(rec, req)
+		if rec.Body.String() != "new" {
+			t.Errorf("Expected 'new', got '%s'", rec.Body.String())
+		}
+	})
+
+	t.Run("swap with nil map", func(t *testing.T) {
+		table := NewTable(nil)
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		rec := httptest.NewRecorder()
+		table.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", rec.Code)
+		}
+	})
+}
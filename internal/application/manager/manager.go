@@ -0,0 +1,437 @@
+// Package manager owns the live set of site handlers and rebuilds them when
+// the site configuration changes, swapping them into the host router without
+// interrupting requests that are already in flight.
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"reverse-proxy/internal/application/config"
+	"reverse-proxy/internal/application/host"
+	"reverse-proxy/internal/application/site"
+	"reverse-proxy/internal/models/global"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provider produces sites from a source other than the configuration
+// directory, such as a container runtime.
+type Provider interface {
+	Name() string
+	// Run calls update with the complete set of sites of the provider every
+	// time it changes, until ctx is done.
+	Run(ctx context.Context, update func(map[string]*global.SiteConfig))
+}
+
+var (
+	ErrSiteExists   = errors.New("site already exists")
+	ErrUnknownSite  = errors.New("unknown site")
+	ErrProvidedSite = errors.New("site comes from a provider")
+	// ErrNotSaved is returned when a site change was applied but writing it
+	// to the configuration directory failed.
+	ErrNotSaved = errors.New("site applied but not saved")
+)
+
+type Manager struct {
+	logger     *slog.Logger
+	dir        string
+	duplicates string
+	table      *host.Table
+
+	mu       sync.Mutex
+	handlers map[string]*site.Handler
+	files    map[string]*global.SiteConfig
+	provided map[string]map[string]*global.SiteConfig // by provider name
+
+	// overrides holds the sites changed at runtime without saving them. They
+	// win over the site files until the process exits, a nil entry hides the
+	// file's site.
+	overrides map[string]*global.SiteConfig
+
+	// poolFiles holds the pools read from upstreams.d, pools the ones built
+	// from them. running holds every pool load balancer still in use, which
+	// includes replaced ones that sites failing to rebuild hold on to.
+	poolFiles map[string]*global.Pool
+	pools     map[string]pool
+	running   map[*site.LoadBalancer]bool
+}
+
+// pool is the load balancer of an upstream pool and the config it was built
+// from.
+type pool struct {
+	cfg *global.Pool
+	lb  *site.LoadBalancer
+}
+
+func New(logger *slog.Logger, dir string) *Manager {
+	return &Manager{
+		logger:     logger,
+		dir:        dir,
+		duplicates: config.DuplicatesError,
+		table:      host.NewTable(nil),
+		handlers:   make(map[string]*site.Handler),
+		files:      make(map[string]*global.SiteConfig),
+		provided:   make(map[string]map[string]*global.SiteConfig),
+		overrides:  make(map[string]*global.SiteConfig),
+		poolFiles:  make(map[string]*global.Pool),
+		pools:      make(map[string]pool),
+		running:    make(map[*site.LoadBalancer]bool),
+	}
+}
+
+// SetDuplicates sets how site files declaring the same domain are combined
+// from the next reload on, see config.CombineSites.
+func (m *Manager) SetDuplicates(duplicates string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.duplicates = duplicates
+}
+
+// Handler returns the host router serving the current set of sites.
+func (m *Manager) Handler() http.Handler {
+	return m.table
+}
+
+// Sites returns the status of every loaded site, sorted by domain.
+func (m *Manager) Sites() []site.SiteStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]site.SiteStatus, 0, len(m.handlers))
+	for _, handler := range m.handlers {
+		statuses = append(statuses, handler.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Domain < statuses[j].Domain
+	})
+	return statuses
+}
+
+// Site returns the handler serving domain, or nil if no site is loaded for
+// it.
+func (m *Manager) Site(domain string) *site.Handler {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.handlers[domain]
+}
+
+// Reload re-reads the site configuration directory and its upstream pools and
+// swaps the rebuilt handlers into the router. If the directory cannot be
+// loaded the current sites stay in place and the error is returned.
+func (m *Manager) Reload() error {
+	m.mu.Lock()
+	duplicates := m.duplicates
+	m.mu.Unlock()
+
+	sites, err := config.LoadConfigsWith(m.dir, duplicates)
+	if err != nil {
+		return fmt.Errorf("failed to load sites from %s: %w", m.dir, err)
+	}
+
+	pools, err := config.LoadPools(m.dir)
+	if err != nil {
+		return fmt.Errorf("failed to load upstream pools from %s: %w", m.dir, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files = sites
+	m.poolFiles = pools
+	m.apply()
+	return nil
+}
+
+// CreateSite is PutSite for a domain that isn't served yet.
+func (m *Manager) CreateSite(cfg *global.SiteConfig, persist bool) error {
+	_, err := m.putSite(cfg, persist, true)
+	return err
+}
+
+// PutSite adds or replaces the site for cfg.Domain and reports whether it was
+// added. The site is only swapped into the router once its handler is built;
+// if that fails the error is returned and nothing changes. With persist the
+// site is also written to the configuration directory, otherwise the change
+// lasts until the process exits.
+func (m *Manager) PutSite(cfg *global.SiteConfig, persist bool) (bool, error) {
+	return m.putSite(cfg, persist, false)
+}
+
+func (m *Manager) putSite(cfg *global.SiteConfig, persist, mustCreate bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.handlers[cfg.Domain]
+	if exists && mustCreate {
+		return false, fmt.Errorf("%w: %s", ErrSiteExists, cfg.Domain)
+	}
+
+	// Relative paths are relative to the configuration directory, like in
+	// the file the site is persisted to
+	resolved := config.ResolveSitePaths(cfg, m.dir)
+	previous, overridden := m.overrides[cfg.Domain]
+	m.overrides[cfg.Domain] = resolved
+	if err := m.apply()[cfg.Domain]; err != nil {
+		if overridden {
+			m.overrides[cfg.Domain] = previous
+		} else {
+			delete(m.overrides, cfg.Domain)
+		}
+		return false, err
+	}
+
+	if persist {
+		if err := config.WriteSite(m.dir, cfg); err != nil {
+			return !exists, fmt.Errorf("%w: %w", ErrNotSaved, err)
+		}
+		m.files[cfg.Domain] = resolved
+		delete(m.overrides, cfg.Domain)
+	}
+	return !exists, nil
+}
+
+// DeleteSite stops serving domain. With persist its site file is removed as
+// well, otherwise the site comes back when the process restarts. Sites from
+// providers can only be removed at their source.
+func (m *Manager) DeleteSite(domain string, persist bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.handlers[domain]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownSite, domain)
+	}
+	if _, ok := m.files[domain]; !ok && m.overrides[domain] == nil {
+		return fmt.Errorf("%w: %s", ErrProvidedSite, domain)
+	}
+
+	m.overrides[domain] = nil
+	m.apply()
+
+	if persist {
+		if err := config.RemoveSite(m.dir, domain); err != nil {
+			return fmt.Errorf("%w: %w", ErrNotSaved, err)
+		}
+		delete(m.files, domain)
+		delete(m.overrides, domain)
+	}
+	return nil
+}
+
+// AddProvider runs p until ctx is done, serving its sites next to the ones
+// from the configuration directory. A site file wins over a provider for the
+// same domain.
+func (m *Manager) AddProvider(ctx context.Context, p Provider) {
+	go p.Run(ctx, func(sites map[string]*global.SiteConfig) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.provided[p.Name()] = sites
+		m.apply()
+	})
+}
+
+// merged returns the sites from files, runtime overrides and providers.
+// Providers are merged in name order so the result doesn't depend on which
+// one updated last. Their domains are made canonical like the ones of site
+// files. Must be called with m.mu held.
+func (m *Manager) merged() map[string]*global.SiteConfig {
+	sites := make(map[string]*global.SiteConfig, len(m.files))
+	for domain, cfg := range m.files {
+		sites[domain] = cfg
+	}
+	for domain, cfg := range m.overrides {
+		if cfg == nil {
+			delete(sites, domain)
+			continue
+		}
+		sites[domain] = cfg
+	}
+
+	names := make([]string, 0, len(m.provided))
+	for name := range m.provided {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for domain, cfg := range m.provided[name] {
+			if canonical := config.CanonicalDomain(domain); canonical != domain || cfg.Domain != canonical {
+				site := *cfg
+				site.Domain = canonical
+				domain, cfg = canonical, &site
+			}
+			if _, taken := sites[domain]; taken {
+				m.logger.Warn("Ignoring provider site, domain is already configured", "provider", name, "domain", domain)
+				continue
+			}
+			sites[domain] = cfg
+		}
+	}
+	return sites
+}
+
+// buildPools returns the load balancers of the pools, rebuilding the ones
+// whose config changed. A pool that fails to rebuild keeps its previous load
+// balancer. Must be called with m.mu held.
+func (m *Manager) buildPools() map[string]pool {
+	pools := make(map[string]pool, len(m.poolFiles))
+	for name, cfg := range m.poolFiles {
+		previous, hasPrevious := m.pools[name]
+		if hasPrevious && reflect.DeepEqual(previous.cfg, cfg) {
+			pools[name] = previous
+			continue
+		}
+
+		lb, err := site.NewPool(m.logger, name, cfg)
+		if err != nil {
+			if hasPrevious {
+				m.logger.Error("Failed to rebuild pool, keeping previous config", "pool", name, "error", err)
+				pools[name] = previous
+				continue
+			}
+			m.logger.Error("Failed to create pool", "pool", name, "error", err)
+			continue
+		}
+		if hasPrevious {
+			lb.Inherit(previous.lb)
+		}
+		pools[name] = pool{cfg: cfg, lb: lb}
+	}
+	return pools
+}
+
+// apply rebuilds the handlers of changed sites and swaps them into the
+// router. Sites whose handler fails to build keep their previous one, or are
+// left out, and are returned with the error. Sites referring to a pool that
+// was rebuilt are rebuilt with it. Must be called with m.mu held.
+func (m *Manager) apply() map[string]error {
+	sites := m.merged()
+	failed := make(map[string]error)
+
+	pools := m.buildPools()
+	balancers := make(map[string]*site.LoadBalancer, len(pools))
+	for name, p := range pools {
+		balancers[name] = p.lb
+	}
+
+	handlers := make(map[string]*site.Handler, len(sites))
+	for domain, cfg := range sites {
+		previous, hasPrevious := m.handlers[domain]
+
+		// Unchanged sites keep their handler so upstream state survives the
+		// reload, and so do sites whose paths only got other upstreams, such
+		// as a provider's following its endpoints: those change in place
+		if hasPrevious && samePools(previous, balancers) && previous.UpdateUpstreams(cfg) {
+			handlers[domain] = previous
+			continue
+		}
+
+		handler, err := site.NewSiteHandlerWithPools(m.logger, cfg, balancers)
+		if err != nil {
+			failed[domain] = err
+			if hasPrevious {
+				m.logger.Error("Failed to rebuild handler, keeping previous config", "domain", domain, "error", err)
+				handlers[domain] = previous
+				continue
+			}
+			m.logger.Error("Failed to create handler", "domain", domain, "error", err)
+			continue
+		}
+		if hasPrevious {
+			handler.KeepDiscovered(previous)
+			handler.SlowStartAdded(previous)
+			handler.KeepUpstreamStates(previous)
+		}
+		handlers[domain] = handler
+	}
+
+	routes := make(map[string]http.Handler, len(handlers))
+	for domain, handler := range handlers {
+		routes[domain] = handler.Handler
+	}
+
+	m.table.Swap(routes)
+
+	// Requests already in flight keep running on the old handlers, only their
+	// background work is stopped
+	for domain, previous := range m.handlers {
+		if handlers[domain] != previous {
+			previous.Close()
+		}
+	}
+	m.handlers = handlers
+
+	// Pools stop once neither the configuration nor a site uses them
+	running := make(map[*site.LoadBalancer]bool, len(pools))
+	for _, p := range pools {
+		running[p.lb] = true
+	}
+	for _, handler := range handlers {
+		for _, lb := range handler.Pools() {
+			running[lb] = true
+		}
+	}
+	for lb := range m.running {
+		if !running[lb] {
+			lb.Close()
+		}
+	}
+	m.pools = pools
+	m.running = running
+
+	m.logger.Info("Sites loaded", "dir", m.dir, "count", len(handlers))
+	return failed
+}
+
+// samePools reports whether handler uses the current load balancer of every
+// pool it refers to.
+func samePools(handler *site.Handler, pools map[string]*site.LoadBalancer) bool {
+	for name, lb := range handler.Pools() {
+		if pools[name] != lb {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch polls the configuration directory every interval and reloads when a
+// site or pool file is added, removed or modified. It returns once ctx is done.
+func (m *Manager) Watch(ctx context.Context, interval time.Duration) {
+	last, err := config.Fingerprint(m.dir)
+	if err != nil {
+		m.logger.Error("Failed to read config directory", "dir", m.dir, "error", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := config.Fingerprint(m.dir)
+		if err != nil {
+			m.logger.Error("Failed to read config directory", "dir", m.dir, "error", err)
+			continue
+		}
+		if current == last {
+			continue
+		}
+		last = current
+
+		m.logger.Info("Configuration change detected", "dir", m.dir)
+		if err := m.Reload(); err != nil {
+			m.logger.Error("Reload failed, keeping last-known-good config", "error", err)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/application/site"
+	"reverse-proxy/internal/models/global"
+	"testing"
+	"time"
+)
+
+func writeSite(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+func newUpstream(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func get(handler http.Handler, host string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestManagerReload(t *testing.T) {
+	t.Run("swaps in new sites", func(t *testing.T) {
+		first := newUpstream(t, "first")
+		second := newUpstream(t, "second")
+
+		dir := t.TempDir()
+		writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: "+first.URL+"\ntimeouts:\n  read: 5s\n")
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		m := New(logger, dir)
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		if body := get(m.Handler(), "example.com").Body.String(); body != "first" {
+			t.Errorf("Expected 'first', got '%s'", body)
+		}
+
+		writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: "+second.URL+"\ntimeouts:\n  read: 5s\n")
+		writeSite(t, dir, "other.local.yml", "domain: other.local\nproxy:\n  upstream: "+first.URL+"\ntimeouts:\n  read: 5s\n")
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		if body := get(m.Handler(), "example.com").Body.String(); body != "second" {
+			t.Errorf("Expected 'second', got '%s'", body)
+		}
+		if body := get(m.Handler(), "other.local").Body.String(); body != "first" {
+			t.Errorf("Expected 'first' for new site, got '%s'", body)
+		}
+	})
+
+	t.Run("broken file keeps last-known-good config", func(t *testing.T) {
+		upstream := newUpstream(t, "ok")
+
+		dir := t.TempDir()
+		writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: "+upstream.URL+"\ntimeouts:\n  read: 5s\n")
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		m := New(logger, dir)
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: [broken")
+		if err := m.Reload(); err == nil {
+			t.Error("Expected error for broken config, got nil")
+		}
+
+		if body := get(m.Handler(), "example.com").Body.String(); body != "ok" {
+			t.Errorf("Expected 'ok', got '%s'", body)
+		}
+	})
+
+	t.Run("invalid site keeps previous handler", func(t *testing.T) {
+		upstream := newUpstream(t, "ok")
+
+		dir := t.TempDir()
+		writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: "+upstream.URL+"\ntimeouts:\n  read: 5s\n")
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		m := New(logger, dir)
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: \"://bad\"\n")
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		if body := get(m.Handler(), "example.com").Body.String(); body != "ok" {
+			t.Errorf("Expected 'ok', got '%s'", body)
+		}
+	})
+}
+
+func TestManagerWatch(t *testing.T) {
+	t.Run("reloads on file change", func(t *testing.T) {
+		upstream := newUpstream(t, "watched")
+
+		dir := t.TempDir()
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		m := New(logger, dir)
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go m.Watch(ctx, 10*time.Millisecond)
+
+		// Give the watcher a chance to take its first fingerprint
+		time.Sleep(20 * time.Millisecond)
+		writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: "+upstream.URL+"\ntimeouts:\n  read: 5s\n")
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if get(m.Handler(), "example.com").Body.String() == "watched" {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("Expected watcher to pick up new site")
+	})
+}
+
+// staticProvider hands the sites it is given to the manager on demand.
+type staticProvider struct {
+	updates chan map[string]*global.SiteConfig
+}
+
+func (p *staticProvider) Name() string {
+	return "static"
+}
+
+func (p *staticProvider) Run(ctx context.Context, update func(map[string]*global.SiteConfig)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sites := <-p.updates:
+			update(sites)
+		}
+	}
+}
+
+func providedSite(domain, upstream string) *global.SiteConfig {
+	cfg := &global.SiteConfig{Domain: domain, Timeouts: global.Timeouts{Read: 5 * time.Second}}
+	cfg.Proxy.Upstream = upstream
+	return cfg
+}
+
+func TestManagerProviders(t *testing.T) {
+	fromFile := newUpstream(t, "file")
+	fromProvider := newUpstream(t, "provider")
+
+	dir := t.TempDir()
+	writeSite(t, dir, "example.com.yml", "domain: example.com\nproxy:\n  upstream: "+fromFile.URL+"\ntimeouts:\n  read: 5s\n")
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	m := New(logger, dir)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &staticProvider{updates: make(chan map[string]*global.SiteConfig)}
+	m.AddProvider(ctx, p)
+
+	p.updates <- map[string]*global.SiteConfig{
+		"example.com": providedSite("example.com", fromProvider.URL),
+		"app.local":   providedSite("app.local", fromProvider.URL),
+		"Shop.Local.": providedSite("Shop.Local.", fromProvider.URL),
+		"EXAMPLE.com": providedSite("EXAMPLE.com", fromProvider.URL),
+	}
+
+	waitFor := func(host, body string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if get(m.Handler(), host).Body.String() == body {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("Expected '%s' from %s, got '%s'", body, host, get(m.Handler(), host).Body.String())
+	}
+
+	waitFor("app.local", "provider")
+	if body := get(m.Handler(), "example.com").Body.String(); body != "file" {
+		t.Errorf("Expected site file to win, got '%s'", body)
+	}
+	if h := m.Site("shop.local"); h == nil || get(m.Handler(), "shop.local").Body.String() != "provider" {
+		t.Error("Expected the provider's Shop.Local. to be served as shop.local")
+	}
+
+	// Provider sites survive a reload of the files
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	waitFor("app.local", "provider")
+
+	p.updates <- map[string]*global.SiteConfig{}
+	waitFor("app.local", "404 page not found\n")
+	if rec := get(m.Handler(), "app.local"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 once the provider dropped the site, got %d", rec.Code)
+	}
+}
+
+func TestManagerProviderUpstreams(t *testing.T) {
+	first := newUpstream(t, "first")
+	second := newUpstream(t, "second")
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	m := New(logger, t.TempDir())
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &staticProvider{updates: make(chan map[string]*global.SiteConfig)}
+	m.AddProvider(ctx, p)
+
+	// A site like the ones of the Kubernetes provider, a path per Ingress
+	// path with the endpoints of its Service
+	sites := func(upstreams ...string) map[string]*global.SiteConfig {
+		path := global.ProxyPath{Path: "/"}
+		for _, u := range upstreams {
+			path.Upstreams = append(path.Upstreams, global.Upstream{URL: u})
+		}
+		cfg := &global.SiteConfig{Domain: "app.local", Timeouts: global.Timeouts{Read: 5 * time.Second}}
+		cfg.Proxy.Paths = []global.ProxyPath{path}
+		return map[string]*global.SiteConfig{"app.local": cfg}
+	}
+	members := func() []site.UpstreamStatus {
+		if h := m.Site("app.local"); h != nil {
+			return h.Status().Paths[0].Upstreams
+		}
+		return nil
+	}
+	waitFor := func(count int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(members()) != count && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := len(members()); n != count {
+			t.Fatalf("Expected %d upstreams, got %d", count, n)
+		}
+	}
+
+	p.updates <- sites(first.URL)
+	waitFor(1)
+	handler := m.Site("app.local")
+	if body := get(m.Handler(), "app.local").Body.String(); body != "first" {
+		t.Errorf("Expected 'first', got '%s'", body)
+	}
+
+	p.updates <- sites(first.URL, second.URL)
+	waitFor(2)
+	if m.Site("app.local") != handler {
+		t.Error("Expected an endpoint change to keep the handler")
+	}
+	for _, u := range members() {
+		if u.URL == first.URL && u.Requests != 1 {
+			t.Errorf("Expected the kept upstream to keep its 1 request, got %d", u.Requests)
+		}
+	}
+
+	// Other changes still rebuild the site
+	changed := sites(first.URL, second.URL)
+	changed["app.local"].Proxy.Headers = map[string]string{"X-Site": "app"}
+	p.updates <- changed
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Site("app.local") == handler && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.Site("app.local") == handler {
+		t.Error("Expected a header change to rebuild the handler")
+	}
+}
+
+func TestManagerSiteChanges(t *testing.T) {
+	first := newUpstream(t, "first")
+	second := newUpstream(t, "second")
+
+	newManager := func(t *testing.T) (*Manager, string) {
+		t.Helper()
+		dir := t.TempDir()
+		writeSite(t, dir, "main.yml", "domain: example.com\nproxy:\n  upstream: "+first.URL+"\ntimeouts:\n  read: 5s\n")
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		m := New(logger, dir)
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		return m, dir
+	}
+
+	site := func(domain, upstream string) *global.SiteConfig {
+		return &global.SiteConfig{
+			Domain:   domain,
+			Proxy:    global.Proxy{PathBase: global.PathBase{Upstream: upstream}},
+			Timeouts: global.Timeouts{Read: 5 * time.Second},
+		}
+	}
+
+	t.Run("runtime changes outlive reloads", func(t *testing.T) {
+		m, _ := newManager(t)
+
+		if err := m.CreateSite(site("app.local", second.URL), false); err != nil {
+			t.Fatalf("CreateSite failed: %v", err)
+		}
+		if err := m.CreateSite(site("app.local", first.URL), false); !errors.Is(err, ErrSiteExists) {
+			t.Errorf("Expected ErrSiteExists, got %v", err)
+		}
+		if err := m.DeleteSite("example.com", false); err != nil {
+			t.Fatalf("DeleteSite failed: %v", err)
+		}
+
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if body := get(m.Handler(), "app.local").Body.String(); body != "second" {
+			t.Errorf("Expected 'second' from app.local, got '%s'", body)
+		}
+		if rec := get(m.Handler(), "example.com"); rec.Code != http.StatusNotFound {
+			t.Errorf("Expected deleted site to stay gone, got %d", rec.Code)
+		}
+	})
+
+	t.Run("failed change keeps the current site", func(t *testing.T) {
+		m, _ := newManager(t)
+
+		broken := site("example.com", "")
+		if _, err := m.PutSite(broken, true); err == nil {
+			t.Fatal("Expected error for a site without upstream, got nil")
+		}
+		if body := get(m.Handler(), "example.com").Body.String(); body != "first" {
+			t.Errorf("Expected 'first' after the failed change, got '%s'", body)
+		}
+	})
+
+	t.Run("persisted changes", func(t *testing.T) {
+		m, dir := newManager(t)
+
+		created, err := m.PutSite(site("example.com", second.URL), true)
+		if err != nil || created {
+			t.Fatalf("Expected update without error, got %v, %v", created, err)
+		}
+		if created, err = m.PutSite(site("app.local", first.URL), true); err != nil || !created {
+			t.Fatalf("Expected app.local to be created, got %v, %v", created, err)
+		}
+
+		// A restart reads the same sites back
+		restarted := New(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)), dir)
+		if err := restarted.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if body := get(restarted.Handler(), "example.com").Body.String(); body != "second" {
+			t.Errorf("Expected 'second' after restart, got '%s'", body)
+		}
+		if body := get(restarted.Handler(), "app.local").Body.String(); body != "first" {
+			t.Errorf("Expected 'first' after restart, got '%s'", body)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "example.com.yml")); !os.IsNotExist(err) {
+			t.Error("Expected example.com to be written back to main.yml")
+		}
+
+		if err := m.DeleteSite("app.local", true); err != nil {
+			t.Fatalf("DeleteSite failed: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "app.local.yml")); !os.IsNotExist(err) {
+			t.Error("Expected app.local.yml to be removed")
+		}
+	})
+
+	t.Run("provider and unknown sites", func(t *testing.T) {
+		m, _ := newManager(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := &staticProvider{updates: make(chan map[string]*global.SiteConfig)}
+		m.AddProvider(ctx, p)
+		p.updates <- map[string]*global.SiteConfig{"app.local": providedSite("app.local", second.URL)}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for m.Site("app.local") == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if err := m.DeleteSite("app.local", false); !errors.Is(err, ErrProvidedSite) {
+			t.Errorf("Expected ErrProvidedSite, got %v", err)
+		}
+		if err := m.DeleteSite("missing.local", false); !errors.Is(err, ErrUnknownSite) {
+			t.Errorf("Expected ErrUnknownSite, got %v", err)
+		}
+	})
+}
+
+func TestManagerPools(t *testing.T) {
+	first := newUpstream(t, "first")
+	second := newUpstream(t, "second")
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "upstreams.d"), 0755); err != nil {
+		t.Fatalf("Failed to create upstreams.d: %v", err)
+	}
+	writeSite(t, dir, "upstreams.d/api.yml", "upstreams:\n  - "+first.URL+"\n")
+	writeSite(t, dir, "a.com.yml", "domain: a.com\nproxy:\n  pool: api\ntimeouts:\n  read: 5s\n")
+	writeSite(t, dir, "b.com.yml", "domain: b.com\nproxy:\n  paths:\n    - path: /\n      pool: api\ntimeouts:\n  read: 5s\n")
+
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	m := New(logger, dir)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	pool := m.Site("a.com").Pools()["api"]
+	if pool == nil || m.Site("b.com").Pools()["api"] != pool {
+		t.Fatal("Expected both sites to share the pool's load balancer")
+	}
+	if body := get(m.Handler(), "b.com").Body.String(); body != "first" {
+		t.Errorf("Expected 'first', got '%s'", body)
+	}
+
+	t.Run("site changes keep the pool", func(t *testing.T) {
+		writeSite(t, dir, "a.com.yml", "domain: a.com\nproxy:\n  pool: api\ntimeouts:\n  read: 10s\n")
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if m.Site("a.com").Pools()["api"] != pool {
+			t.Error("Expected the rebuilt site to keep the pool's load balancer")
+		}
+	})
+
+	t.Run("pool changes rebuild its sites", func(t *testing.T) {
+		b := m.Site("b.com")
+		writeSite(t, dir, "upstreams.d/api.yml", "upstreams:\n  - "+second.URL+"\n")
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+
+		if m.Site("b.com") == b {
+			t.Error("Expected b.com to be rebuilt with the new pool")
+		}
+		rebuilt := m.Site("a.com").Pools()["api"]
+		if rebuilt == pool || m.Site("b.com").Pools()["api"] != rebuilt {
+			t.Error("Expected both sites to share the rebuilt pool")
+		}
+		for _, host := range []string{"a.com", "b.com"} {
+			if body := get(m.Handler(), host).Body.String(); body != "second" {
+				t.Errorf("Expected 'second' for %s, got '%s'", host, body)
+			}
+		}
+	})
+
+	t.Run("unknown pool keeps previous handler", func(t *testing.T) {
+		writeSite(t, dir, "a.com.yml", "domain: a.com\nproxy:\n  pool: web\ntimeouts:\n  read: 5s\n")
+		if err := m.Reload(); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+		if body := get(m.Handler(), "a.com").Body.String(); body != "second" {
+			t.Errorf("Expected 'second', got '%s'", body)
+		}
+	})
+}
@@ -0,0 +1,323 @@
+// Package provider generates site configurations from sources other than the
+// site files, to be served next to them by the manager.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"reverse-proxy/internal/models/global"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Container labels read by the Docker provider.
+const (
+	LabelDomain = "reverse-proxy.domain"
+	LabelPort   = "reverse-proxy.port"
+	LabelPath   = "reverse-proxy.path"
+	LabelScheme = "reverse-proxy.scheme"
+)
+
+// defaultTimeout is the read and write timeout of generated sites.
+const defaultTimeout = 30 * time.Second
+
+// retryDelay is the wait before reconnecting to a source that failed.
+const retryDelay = 5 * time.Second
+
+// Docker watches the Docker Engine API and turns running containers with a
+// reverse-proxy.domain label into sites.
+type Docker struct {
+	logger  *slog.Logger
+	client  *http.Client
+	network string
+}
+
+// container is the part of a Docker container listing the provider uses.
+type container struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	State           string            `json:"State"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func NewDocker(logger *slog.Logger, cfg *global.Docker) (*Docker, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "unix:///var/run/docker.sock"
+	}
+
+	socket, ok := strings.CutPrefix(endpoint, "unix://")
+	if !ok || socket == "" {
+		return nil, fmt.Errorf("unsupported docker endpoint: %s", endpoint)
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+
+	return &Docker{
+		logger:  logger,
+		client:  &http.Client{Transport: transport},
+		network: cfg.Network,
+	}, nil
+}
+
+func (d *Docker) Name() string {
+	return "docker"
+}
+
+// Run sends the sites of the running containers to update, and again after
+// every container start or stop, until ctx is done. A lost connection is
+// retried after a delay.
+func (d *Docker) Run(ctx context.Context, update func(map[string]*global.SiteConfig)) {
+	var last map[string]*global.SiteConfig
+	send := func(sites map[string]*global.SiteConfig) {
+		// Events that don't change any site aren't worth a reload
+		if last != nil && reflect.DeepEqual(last, sites) {
+			return
+		}
+		last = sites
+		update(sites)
+	}
+
+	for {
+		err := d.watch(ctx, send)
+		if ctx.Err() != nil {
+			return
+		}
+		d.logger.Error("Docker provider disconnected, retrying", "error", err, "delay", retryDelay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// watch subscribes to container events, then lists the containers and lists
+// them again on every event until the event stream ends. Subscribing first
+// means no change between the listing and the subscription is missed.
+func (d *Docker) watch(ctx context.Context, send func(map[string]*global.SiteConfig)) error {
+	filters := `{"type":["container"],"event":["start","stop","die","destroy","pause","unpause"]}`
+	events, err := d.get(ctx, "/events?filters="+url.QueryEscape(filters))
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(events.Body)
+
+	refresh := func() error {
+		containers, err := d.containers(ctx)
+		if err != nil {
+			return err
+		}
+		send(d.sites(containers))
+		return nil
+	}
+
+	if err := refresh(); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(events.Body)
+	for {
+		var event struct {
+			Action string `json:"Action"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return fmt.Errorf("event stream ended: %w", err)
+		}
+		if err := refresh(); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Docker) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("docker API %s: unexpected status %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// containers lists the running containers.
+func (d *Docker) containers(ctx context.Context) ([]container, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	resp, err := d.get(ctx, "/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	var containers []container
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to decode container list: %w", err)
+	}
+	return containers, nil
+}
+
+// sites groups the labelled containers by domain. Containers with a path
+// label become a path of their domain, the others serve the domain root.
+// Containers with invalid labels are logged and skipped.
+func (d *Docker) sites(containers []container) map[string]*global.SiteConfig {
+	// Upstream URLs by domain and path, "" being the root
+	routes := make(map[string]map[string][]string)
+	for _, c := range containers {
+		domain := c.Labels[LabelDomain]
+		if domain == "" || c.State != "running" {
+			continue
+		}
+
+		target, err := d.target(c)
+		if err != nil {
+			d.logger.Warn("Skipping container", "container", c.name(), "error", err)
+			continue
+		}
+
+		if routes[domain] == nil {
+			routes[domain] = make(map[string][]string)
+		}
+		path := c.Labels[LabelPath]
+		routes[domain][path] = append(routes[domain][path], target)
+	}
+
+	sites := make(map[string]*global.SiteConfig, len(routes))
+	for domain, paths := range routes {
+		cfg := &global.SiteConfig{
+			Domain:   domain,
+			Timeouts: global.Timeouts{Read: defaultTimeout, Write: defaultTimeout},
+		}
+
+		if root, ok := paths[""]; ok && len(paths) == 1 {
+			cfg.Proxy.Upstreams = upstreams(root)
+			sites[domain] = cfg
+			continue
+		}
+
+		// With path routing the root needs a path of its own
+		if root, ok := paths[""]; ok {
+			delete(paths, "")
+			paths["/"] = append(paths["/"], root...)
+		}
+		for path, targets := range paths {
+			cfg.Proxy.Paths = append(cfg.Proxy.Paths, global.ProxyPath{
+				Path:     path,
+				PathBase: global.PathBase{Upstreams: upstreams(targets)},
+			})
+		}
+		sort.Slice(cfg.Proxy.Paths, func(i, j int) bool {
+			return cfg.Proxy.Paths[i].Path < cfg.Proxy.Paths[j].Path
+		})
+		sites[domain] = cfg
+	}
+	return sites
+}
+
+// target returns the upstream URL of c from its labels and network address.
+func (d *Docker) target(c container) (string, error) {
+	port := 80
+	if raw, ok := c.Labels[LabelPort]; ok {
+		var err error
+		if port, err = strconv.Atoi(raw); err != nil || port < 1 || port > 65535 {
+			return "", fmt.Errorf("invalid %s label: %s", LabelPort, raw)
+		}
+	}
+
+	scheme := "http"
+	if raw, ok := c.Labels[LabelScheme]; ok {
+		if raw != "http" && raw != "https" {
+			return "", fmt.Errorf("invalid %s label: %s", LabelScheme, raw)
+		}
+		scheme = raw
+	}
+
+	if path, ok := c.Labels[LabelPath]; ok && !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("invalid %s label: %s", LabelPath, path)
+	}
+
+	ip, err := d.address(c)
+	if err != nil {
+		return "", err
+	}
+	return scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port)), nil
+}
+
+// address returns the IP of c on the configured network, or on the first
+// network by name when none is configured.
+func (d *Docker) address(c container) (string, error) {
+	networks := c.NetworkSettings.Networks
+	if d.network != "" {
+		if n, ok := networks[d.network]; ok && n.IPAddress != "" {
+			return n.IPAddress, nil
+		}
+		return "", fmt.Errorf("no address on network %s", d.network)
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no network address")
+}
+
+func (c container) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
+
+// upstreams turns targets into sorted upstream entries without duplicates.
+func upstreams(targets []string) []global.Upstream {
+	sorted := append([]string(nil), targets...)
+	sort.Strings(sorted)
+
+	result := make([]global.Upstream, 0, len(sorted))
+	for i, target := range sorted {
+		if i > 0 && target == sorted[i-1] {
+			continue
+		}
+		result = append(result, global.Upstream{URL: target})
+	}
+	return result
+}
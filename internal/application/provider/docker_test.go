@@ -0,0 +1,184 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/models/global"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves the container listing and event stream of the Docker
+// Engine API on a unix socket.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []map[string]any
+	events     chan string
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, string) {
+	t.Helper()
+
+	// Unix socket paths are short, t.TempDir can be too long
+	dir, err := os.MkdirTemp("", "docker")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "docker.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+
+	fake := &fakeDocker{events: make(chan string, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		json.NewEncoder(w).Encode(fake.containers)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case action := <-fake.events:
+				json.NewEncoder(w).Encode(map[string]string{"Type": "container", "Action": action})
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return fake, "unix://" + socket
+}
+
+func (f *fakeDocker) set(containers ...map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers = containers
+}
+
+func newContainer(name, ip string, labels map[string]string) map[string]any {
+	return map[string]any{
+		"Id":     name + "-id",
+		"Names":  []string{"/" + name},
+		"State":  "running",
+		"Labels": labels,
+		"NetworkSettings": map[string]any{
+			"Networks": map[string]any{
+				"bridge": map[string]string{"IPAddress": ip},
+			},
+		},
+	}
+}
+
+func TestDocker(t *testing.T) {
+	t.Run("containers become sites and follow events", func(t *testing.T) {
+		fake, endpoint := newFakeDocker(t)
+		fake.set(
+			newContainer("web-1", "172.17.0.2", map[string]string{LabelDomain: "app.local", LabelPort: "8080"}),
+			newContainer("db", "172.17.0.9", map[string]string{}),
+		)
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		docker, err := NewDocker(logger, &global.Docker{Endpoint: endpoint})
+		if err != nil {
+			t.Fatalf("NewDocker failed: %v", err)
+		}
+
+		updates := make(chan map[string]*global.SiteConfig, 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go docker.Run(ctx, func(sites map[string]*global.SiteConfig) { updates <- sites })
+
+		sites := receive(t, updates)
+		if len(sites) != 1 || sites["app.local"] == nil {
+			t.Fatalf("Expected only app.local, got %v", sites)
+		}
+		if upstreams := sites["app.local"].Proxy.Upstreams; len(upstreams) != 1 || upstreams[0].URL != "http://172.17.0.2:8080" {
+			t.Errorf("Expected upstream http://172.17.0.2:8080, got %+v", upstreams)
+		}
+
+		fake.set(
+			newContainer("web-1", "172.17.0.2", map[string]string{LabelDomain: "app.local", LabelPort: "8080"}),
+			newContainer("web-2", "172.17.0.3", map[string]string{LabelDomain: "app.local", LabelPort: "8080"}),
+		)
+		fake.events <- "start"
+
+		sites = receive(t, updates)
+		if upstreams := sites["app.local"].Proxy.Upstreams; len(upstreams) != 2 {
+			t.Errorf("Expected 2 upstreams after start, got %+v", upstreams)
+		}
+
+		fake.set()
+		fake.events <- "die"
+
+		if sites = receive(t, updates); len(sites) != 0 {
+			t.Errorf("Expected no sites after the containers stopped, got %v", sites)
+		}
+	})
+
+	t.Run("path labels", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		docker := &Docker{logger: logger}
+
+		var containers []container
+		raw, _ := json.Marshal([]map[string]any{
+			newContainer("web", "10.0.0.1", map[string]string{LabelDomain: "shop.local"}),
+			newContainer("api", "10.0.0.2", map[string]string{LabelDomain: "shop.local", LabelPath: "/api/", LabelScheme: "https", LabelPort: "443"}),
+			newContainer("broken", "10.0.0.3", map[string]string{LabelDomain: "shop.local", LabelPort: "http"}),
+		})
+		if err := json.Unmarshal(raw, &containers); err != nil {
+			t.Fatalf("Failed to decode containers: %v", err)
+		}
+
+		site := docker.sites(containers)["shop.local"]
+		if site == nil || len(site.Proxy.Paths) != 2 {
+			t.Fatalf("Expected 2 paths for shop.local, got %+v", site)
+		}
+
+		root, api := site.Proxy.Paths[0], site.Proxy.Paths[1]
+		if root.Path != "/" || root.Upstreams[0].URL != "http://10.0.0.1:80" {
+			t.Errorf("Expected root path to http://10.0.0.1:80, got %+v", root)
+		}
+		if api.Path != "/api/" || api.Upstreams[0].URL != "https://10.0.0.2:443" {
+			t.Errorf("Expected /api/ to https://10.0.0.2:443, got %+v", api)
+		}
+		if site.Timeouts.Read == 0 || site.Timeouts.Write == 0 {
+			t.Error("Expected generated sites to have timeouts")
+		}
+	})
+
+	t.Run("invalid endpoint", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		if _, err := NewDocker(logger, &global.Docker{Endpoint: "tcp://localhost:2375"}); err == nil {
+			t.Error("Expected error for tcp endpoint, got nil")
+		}
+	})
+}
+
+func receive(t *testing.T, updates chan map[string]*global.SiteConfig) map[string]*global.SiteConfig {
+	t.Helper()
+	select {
+	case sites := <-updates:
+		return sites
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for sites")
+		return nil
+	}
+}
@@ -0,0 +1,551 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"reverse-proxy/internal/models/global"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In-cluster service account files.
+const (
+	serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// labelServiceName links an EndpointSlice to its Service.
+const labelServiceName = "kubernetes.io/service-name"
+
+// Kubernetes watches Ingress, Service and EndpointSlice objects and turns
+// every Ingress host into a site whose paths proxy to the ready endpoints of
+// the backend services.
+type Kubernetes struct {
+	logger       *slog.Logger
+	client       *http.Client
+	endpoint     string
+	tokenFile    string
+	namespace    string
+	ingressClass string
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+	ResourceVersion string            `json:"resourceVersion"`
+}
+
+func (m objectMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+type ingress struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		IngressClassName *string `json:"ingressClassName"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path     string `json:"path"`
+					PathType string `json:"pathType"`
+					Backend  struct {
+						Service *struct {
+							Name string `json:"name"`
+							Port struct {
+								Number int    `json:"number"`
+								Name   string `json:"name"`
+							} `json:"port"`
+						} `json:"service"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type service struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type endpointSlice struct {
+	Metadata objectMeta `json:"metadata"`
+	Ports    []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+func NewKubernetes(logger *slog.Logger, cfg *global.Kubernetes) (*Kubernetes, error) {
+	k := &Kubernetes{
+		logger:       logger,
+		endpoint:     strings.TrimSuffix(cfg.Endpoint, "/"),
+		tokenFile:    cfg.TokenFile,
+		namespace:    cfg.Namespace,
+		ingressClass: cfg.IngressClass,
+	}
+
+	caFile := cfg.CAFile
+	if k.endpoint == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("kubernetes endpoint not set and not running in a cluster")
+		}
+		k.endpoint = "https://" + net.JoinHostPort(host, port)
+		if k.tokenFile == "" {
+			k.tokenFile = serviceAccountToken
+		}
+		if caFile == "" {
+			caFile = serviceAccountCA
+		}
+	}
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{}}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kubernetes CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	k.client = &http.Client{Transport: transport}
+
+	return k, nil
+}
+
+func (k *Kubernetes) Name() string {
+	return "kubernetes"
+}
+
+// Run sends the sites described by the Ingresses to update, and again every
+// time an Ingress or EndpointSlice changes, until ctx is done. When a watch
+// fails everything is listed again after a delay.
+func (k *Kubernetes) Run(ctx context.Context, update func(map[string]*global.SiteConfig)) {
+	var last map[string]*global.SiteConfig
+	send := func(sites map[string]*global.SiteConfig) {
+		if last != nil && reflect.DeepEqual(last, sites) {
+			return
+		}
+		last = sites
+		update(sites)
+	}
+
+	for {
+		err := k.sync(ctx, send)
+		if ctx.Err() != nil {
+			return
+		}
+		k.logger.Error("Kubernetes provider disconnected, retrying", "error", err, "delay", retryDelay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// watchEvent is one line of a Kubernetes watch stream.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// sync lists the Ingresses, Services and EndpointSlices, then applies the
+// changes from watching them until a watch fails.
+func (k *Kubernetes) sync(ctx context.Context, send func(map[string]*global.SiteConfig)) error {
+	ingresses := make(map[string]ingress)
+	services := make(map[string]service)
+	slices := make(map[string]endpointSlice)
+
+	ingressVersion, err := k.list(ctx, k.path("networking.k8s.io", "ingresses"), func(raw json.RawMessage) error {
+		var ing ingress
+		if err := json.Unmarshal(raw, &ing); err != nil {
+			return err
+		}
+		ingresses[ing.Metadata.key()] = ing
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	serviceVersion, err := k.list(ctx, k.path("", "services"), func(raw json.RawMessage) error {
+		var svc service
+		if err := json.Unmarshal(raw, &svc); err != nil {
+			return err
+		}
+		services[svc.Metadata.key()] = svc
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sliceVersion, err := k.list(ctx, k.path("discovery.k8s.io", "endpointslices"), func(raw json.RawMessage) error {
+		var slice endpointSlice
+		if err := json.Unmarshal(raw, &slice); err != nil {
+			return err
+		}
+		slices[slice.Metadata.key()] = slice
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	send(k.sites(ingresses, services, slices))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type change struct {
+		resource string
+		event    watchEvent
+	}
+	changes := make(chan change)
+	errs := make(chan error, 3)
+
+	watch := func(group, resource, version string) {
+		errs <- k.watch(ctx, k.path(group, resource), version, func(event watchEvent) {
+			select {
+			case changes <- change{resource: resource, event: event}:
+			case <-ctx.Done():
+			}
+		})
+	}
+	go watch("networking.k8s.io", "ingresses", ingressVersion)
+	go watch("", "services", serviceVersion)
+	go watch("discovery.k8s.io", "endpointslices", sliceVersion)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case c := <-changes:
+			switch c.resource {
+			case "ingresses":
+				var ing ingress
+				if err := json.Unmarshal(c.event.Object, &ing); err != nil {
+					return err
+				}
+				if c.event.Type == "DELETED" {
+					delete(ingresses, ing.Metadata.key())
+				} else {
+					ingresses[ing.Metadata.key()] = ing
+				}
+			case "services":
+				var svc service
+				if err := json.Unmarshal(c.event.Object, &svc); err != nil {
+					return err
+				}
+				if c.event.Type == "DELETED" {
+					delete(services, svc.Metadata.key())
+				} else {
+					services[svc.Metadata.key()] = svc
+				}
+			default:
+				var slice endpointSlice
+				if err := json.Unmarshal(c.event.Object, &slice); err != nil {
+					return err
+				}
+				if c.event.Type == "DELETED" {
+					delete(slices, slice.Metadata.key())
+				} else {
+					slices[slice.Metadata.key()] = slice
+				}
+			}
+			send(k.sites(ingresses, services, slices))
+		}
+	}
+}
+
+// path returns the API path of a resource, scoped to the namespace if one
+// is configured. An empty group is the core API.
+func (k *Kubernetes) path(group, resource string) string {
+	base := "/apis/" + group + "/v1/"
+	if group == "" {
+		base = "/api/v1/"
+	}
+	if k.namespace != "" {
+		return base + "namespaces/" + k.namespace + "/" + resource
+	}
+	return base + resource
+}
+
+func (k *Kubernetes) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Service account tokens are rotated, so the file is read every time
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kubernetes token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API %s: unexpected status %d", path, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// list calls add for every item of a resource and returns the resource
+// version to start watching from.
+func (k *Kubernetes) list(ctx context.Context, path string, add func(json.RawMessage) error) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	resp, err := k.get(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	var list struct {
+		Metadata objectMeta        `json:"metadata"`
+		Items    []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+
+	for _, item := range list.Items {
+		if err := add(item); err != nil {
+			return "", fmt.Errorf("failed to decode item of %s: %w", path, err)
+		}
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch streams the changes to a resource after version to handle until the
+// stream ends or reports an error.
+func (k *Kubernetes) watch(ctx context.Context, path, version string, handle func(watchEvent)) error {
+	resp, err := k.get(ctx, path+"?watch=1&allowWatchBookmarks=true&resourceVersion="+version)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var event watchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("failed to decode watch event of %s: %w", path, err)
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			handle(event)
+		case "ERROR":
+			// Usually 410 Gone: the version is too old and a new list is needed
+			return fmt.Errorf("watch of %s failed: %s", path, event.Object)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("watch of %s ended", path)
+}
+
+// matchesClass reports whether ing belongs to the configured ingress class.
+func (k *Kubernetes) matchesClass(ing ingress) bool {
+	if k.ingressClass == "" {
+		return true
+	}
+	if class := ing.Spec.IngressClassName; class != nil {
+		return *class == k.ingressClass
+	}
+	return ing.Metadata.Annotations["kubernetes.io/ingress.class"] == k.ingressClass
+}
+
+// sites turns every Ingress host into a site. Ingresses are applied in
+// namespace/name order, so when two claim the same host and path the first
+// one wins. Paths whose service has no ready endpoint are left out, and so
+// are hosts without any path left.
+func (k *Kubernetes) sites(ingresses map[string]ingress, services map[string]service, slices map[string]endpointSlice) map[string]*global.SiteConfig {
+	keys := make([]string, 0, len(ingresses))
+	for key := range ingresses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sites := make(map[string]*global.SiteConfig)
+	for _, key := range keys {
+		ing := ingresses[key]
+		if !k.matchesClass(ing) {
+			continue
+		}
+
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" || rule.HTTP == nil {
+				continue
+			}
+
+			for _, p := range rule.HTTP.Paths {
+				backend := p.Backend.Service
+				if backend == nil {
+					continue
+				}
+
+				pattern := muxPattern(p.Path, p.PathType)
+				portName, ok := servicePortName(services, ing.Metadata.Namespace, backend.Name, backend.Port.Name, backend.Port.Number)
+				if !ok {
+					continue
+				}
+				targets := endpoints(slices, ing.Metadata.Namespace, backend.Name, portName)
+				if len(targets) == 0 {
+					continue
+				}
+
+				cfg := sites[rule.Host]
+				if cfg == nil {
+					cfg = &global.SiteConfig{
+						Domain:   rule.Host,
+						Timeouts: global.Timeouts{Read: defaultTimeout, Write: defaultTimeout},
+					}
+					sites[rule.Host] = cfg
+				}
+
+				if hasPath(cfg, pattern) {
+					k.logger.Warn("Ignoring duplicate ingress path", "ingress", key, "host", rule.Host, "path", pattern)
+					continue
+				}
+				cfg.Proxy.Paths = append(cfg.Proxy.Paths, global.ProxyPath{
+					Path:     pattern,
+					PathBase: global.PathBase{Upstreams: upstreams(targets)},
+				})
+			}
+		}
+	}
+
+	for _, cfg := range sites {
+		sort.Slice(cfg.Proxy.Paths, func(i, j int) bool {
+			return cfg.Proxy.Paths[i].Path < cfg.Proxy.Paths[j].Path
+		})
+	}
+	return sites
+}
+
+// muxPattern turns an Ingress path into a ServeMux pattern. Prefix paths,
+// the default, match their whole subtree.
+func muxPattern(path, pathType string) string {
+	if path == "" {
+		path = "/"
+	}
+	if pathType != "Exact" && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path
+}
+
+func hasPath(cfg *global.SiteConfig, path string) bool {
+	for _, p := range cfg.Proxy.Paths {
+		if p.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// servicePortName returns the name of the port of a service an Ingress
+// backend refers to, by name or by number. EndpointSlices carry the name of
+// the service port, not its number, which the service may map to any target
+// port. The name of a service's only port may be empty. It reports false if
+// the service or the port is unknown.
+func servicePortName(services map[string]service, namespace, name, portName string, portNumber int) (string, bool) {
+	if portName != "" {
+		return portName, true
+	}
+
+	svc, ok := services[namespace+"/"+name]
+	if !ok {
+		return "", false
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Port == portNumber {
+			return p.Name, true
+		}
+	}
+	return "", false
+}
+
+// endpoints returns the URLs of the ready endpoints of the service port
+// named portName.
+func endpoints(slices map[string]endpointSlice, namespace, service, portName string) []string {
+	var targets []string
+	for _, slice := range slices {
+		if slice.Metadata.Namespace != namespace || slice.Metadata.Labels[labelServiceName] != service {
+			continue
+		}
+
+		port := 0
+		for _, p := range slice.Ports {
+			if p.Name == portName {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// A missing condition means ready
+			if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				targets = append(targets, "http://"+net.JoinHostPort(address, strconv.Itoa(port)))
+			}
+		}
+	}
+	return targets
+}
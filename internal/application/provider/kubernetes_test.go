@@ -0,0 +1,270 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/models/global"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPIServer serves lists and watches of Ingresses, Services and
+// EndpointSlices the way the Kubernetes API server does.
+type fakeAPIServer struct {
+	mu      sync.Mutex
+	items   map[string][]any // by resource
+	watches map[string]chan map[string]any
+	auth    string
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, *httptest.Server) {
+	t.Helper()
+	fake := &fakeAPIServer{
+		items: make(map[string][]any),
+		watches: map[string]chan map[string]any{
+			"ingresses":      make(chan map[string]any, 10),
+			"services":       make(chan map[string]any, 10),
+			"endpointslices": make(chan map[string]any, 10),
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		fake.auth = r.Header.Get("Authorization")
+		fake.mu.Unlock()
+
+		resource := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if r.URL.Query().Get("watch") == "" {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]any{
+				"metadata": map[string]string{"resourceVersion": "1"},
+				"items":    fake.items[resource],
+			})
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-fake.watches[resource]:
+				json.NewEncoder(w).Encode(event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+func newIngress(name, host, path, service string, port int) map[string]any {
+	return newIngressPort(name, host, path, service, map[string]any{"number": port})
+}
+
+// newIngressPort refers to the service port by number or by name.
+func newIngressPort(name, host, path, service string, port map[string]any) map[string]any {
+	return map[string]any{
+		"metadata": map[string]any{"name": name, "namespace": "default"},
+		"spec": map[string]any{
+			"rules": []any{map[string]any{
+				"host": host,
+				"http": map[string]any{
+					"paths": []any{map[string]any{
+						"path":     path,
+						"pathType": "Prefix",
+						"backend": map[string]any{
+							"service": map[string]any{"name": service, "port": port},
+						},
+					}},
+				},
+			}},
+		},
+	}
+}
+
+// newService has a single port named http, mapped to another target port.
+func newService(name string, port int) map[string]any {
+	return map[string]any{
+		"metadata": map[string]any{"name": name, "namespace": "default"},
+		"spec": map[string]any{
+			"ports": []any{map[string]any{"name": "http", "port": port, "targetPort": port + 8000}},
+		},
+	}
+}
+
+func newSlice(name, service string, port int, ready map[string]bool) map[string]any {
+	var endpoints []any
+	for address, isReady := range ready {
+		endpoints = append(endpoints, map[string]any{
+			"addresses":  []string{address},
+			"conditions": map[string]any{"ready": isReady},
+		})
+	}
+	return map[string]any{
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": "default",
+			"labels":    map[string]string{"kubernetes.io/service-name": service},
+		},
+		"ports":     []any{map[string]any{"name": "http", "port": port}},
+		"endpoints": endpoints,
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	t.Run("ingresses become sites and follow changes", func(t *testing.T) {
+		fake, server := newFakeAPIServer(t)
+		fake.items["ingresses"] = []any{newIngress("web", "app.example.com", "/", "web", 80)}
+		fake.items["services"] = []any{newService("web", 80)}
+		fake.items["endpointslices"] = []any{newSlice("web-abc", "web", 8080, map[string]bool{"10.1.0.1": true, "10.1.0.2": false})}
+
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		os.WriteFile(tokenFile, []byte("secret-token\n"), 0600)
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		k, err := NewKubernetes(logger, &global.Kubernetes{Endpoint: server.URL, TokenFile: tokenFile})
+		if err != nil {
+			t.Fatalf("NewKubernetes failed: %v", err)
+		}
+
+		updates := make(chan map[string]*global.SiteConfig, 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go k.Run(ctx, func(sites map[string]*global.SiteConfig) { updates <- sites })
+
+		sites := receive(t, updates)
+		site := sites["app.example.com"]
+		if site == nil || len(site.Proxy.Paths) != 1 {
+			t.Fatalf("Expected app.example.com with one path, got %v", sites)
+		}
+		if upstreams := site.Proxy.Paths[0].Upstreams; len(upstreams) != 1 || upstreams[0].URL != "http://10.1.0.1:8080" {
+			t.Errorf("Expected only the ready endpoint, got %+v", upstreams)
+		}
+
+		fake.mu.Lock()
+		auth := fake.auth
+		fake.mu.Unlock()
+		if auth != "Bearer secret-token" {
+			t.Errorf("Expected bearer token, got '%s'", auth)
+		}
+
+		fake.watches["endpointslices"] <- map[string]any{
+			"type":   "MODIFIED",
+			"object": newSlice("web-abc", "web", 8080, map[string]bool{"10.1.0.1": true, "10.1.0.2": true}),
+		}
+		sites = receive(t, updates)
+		if upstreams := sites["app.example.com"].Proxy.Paths[0].Upstreams; len(upstreams) != 2 {
+			t.Errorf("Expected 2 endpoints once both are ready, got %+v", upstreams)
+		}
+
+		fake.watches["ingresses"] <- map[string]any{
+			"type":   "DELETED",
+			"object": newIngress("web", "app.example.com", "/", "web", 80),
+		}
+		if sites = receive(t, updates); len(sites) != 0 {
+			t.Errorf("Expected no sites after the ingress was deleted, got %v", sites)
+		}
+	})
+
+	t.Run("translation", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		k := &Kubernetes{logger: logger, ingressClass: "proxy"}
+
+		decode := func(raw map[string]any, into any) {
+			data, _ := json.Marshal(raw)
+			if err := json.Unmarshal(data, into); err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+		}
+
+		var api, other, noEndpoints ingress
+		decode(newIngress("api", "shop.example.com", "/api", "api", 8080), &api)
+		decode(newIngress("other", "other.example.com", "/", "web", 80), &other)
+		decode(newIngress("empty", "shop.example.com", "/empty", "missing", 80), &noEndpoints)
+		class := "proxy"
+		api.Spec.IngressClassName = &class
+		noEndpoints.Spec.IngressClassName = &class
+
+		var svc service
+		decode(newService("api", 8080), &svc)
+		var slice endpointSlice
+		decode(newSlice("api-1", "api", 8080, map[string]bool{"10.1.0.5": true}), &slice)
+
+		sites := k.sites(
+			map[string]ingress{"default/api": api, "default/other": other, "default/empty": noEndpoints},
+			map[string]service{"default/api": svc},
+			map[string]endpointSlice{"default/api-1": slice},
+		)
+
+		if len(sites) != 1 {
+			t.Fatalf("Expected only the site of the matching class, got %v", sites)
+		}
+		paths := sites["shop.example.com"].Proxy.Paths
+		if len(paths) != 1 || paths[0].Path != "/api/" {
+			t.Errorf("Expected prefix path /api/ only, got %+v", paths)
+		}
+	})
+
+	t.Run("backend ports are resolved through the service", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		k := &Kubernetes{logger: logger}
+
+		decode := func(raw map[string]any, into any) {
+			data, _ := json.Marshal(raw)
+			if err := json.Unmarshal(data, into); err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+		}
+
+		// Service port 80 named http targets 8080 on the pods
+		var svc service
+		decode(newService("web", 80), &svc)
+		var slice endpointSlice
+		decode(newSlice("web-1", "web", 8080, map[string]bool{"10.1.0.7": true}), &slice)
+		services := map[string]service{"default/web": svc}
+		slices := map[string]endpointSlice{"default/web-1": slice}
+
+		testCases := []struct {
+			name     string
+			port     map[string]any
+			expected string
+		}{
+			{"service port number", map[string]any{"number": 80}, "http://10.1.0.7:8080"},
+			{"port name", map[string]any{"name": "http"}, "http://10.1.0.7:8080"},
+			{"target port number", map[string]any{"number": 8080}, ""},
+			{"unknown name", map[string]any{"name": "metrics"}, ""},
+		}
+		for _, tc := range testCases {
+			var ing ingress
+			decode(newIngressPort("web", "app.example.com", "/", "web", tc.port), &ing)
+
+			sites := k.sites(map[string]ingress{"default/web": ing}, services, slices)
+			got := ""
+			if site := sites["app.example.com"]; site != nil {
+				got = site.Proxy.Paths[0].Upstreams[0].URL
+			}
+			if got != tc.expected {
+				t.Errorf("%s: expected '%s', got '%s'", tc.name, tc.expected, got)
+			}
+		}
+	})
+
+	t.Run("outside a cluster without endpoint", func(t *testing.T) {
+		t.Setenv("KUBERNETES_SERVICE_HOST", "")
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		if _, err := NewKubernetes(logger, &global.Kubernetes{}); err == nil {
+			t.Error("Expected error without endpoint, got nil")
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package site
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"testing"
+)
+
+func TestBackupUpstreams(t *testing.T) {
+	t.Run("backups idle while a primary is available", func(t *testing.T) {
+		lb := testBalancer(t,
+			[]string{"http://localhost:3000", "http://localhost:3001"},
+			withBackups("http://localhost:4000"),
+		)
+		lb.upstreams[0].healthy.Store(false)
+
+		for i := 0; i < 10; i++ {
+			if u := lb.Next(); u.String() != "http://localhost:3001" {
+				t.Errorf("Expected the remaining primary, got %s", u)
+			}
+		}
+	})
+
+	t.Run("fail over to backups and back", func(t *testing.T) {
+		lb := testBalancer(t,
+			[]string{"http://localhost:3000"},
+			withBackups("http://localhost:4000", "http://localhost:4001"),
+		)
+		primary := lb.upstreams[0]
+		primary.ejected.Store(true)
+
+		used := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			used[lb.Next().String()] = true
+		}
+		if len(used) != 2 || used["http://localhost:3000"] {
+			t.Errorf("Expected traffic spread over both backups, got %v", used)
+		}
+
+		primary.ejected.Store(false)
+		if u := lb.Next(); u.String() != "http://localhost:3000" {
+			t.Errorf("Expected traffic back on the primary, got %s", u)
+		}
+	})
+
+	t.Run("open circuits fail over instead of failing fast", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"},
+			withBackups("http://localhost:4000"),
+			withBreakers(&global.CircuitBreaker{ConsecutiveFailures: 1}),
+		)
+
+		lb.observe(lb.upstreams[0], http.StatusBadGateway, nil)
+		if u := lb.Next(); u == nil || u.String() != "http://localhost:4000" {
+			t.Errorf("Expected the backup, got %v", u)
+		}
+	})
+
+	t.Run("primaries are preferred when everything is down", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"}, withBackups("http://localhost:4000"))
+		for _, u := range lb.upstreams {
+			u.healthy.Store(false)
+		}
+
+		if u := lb.Next(); u.String() != "http://localhost:3000" {
+			t.Errorf("Expected the primary, got %s", u)
+		}
+	})
+
+	t.Run("sticky clients leave the backup once a primary is back", func(t *testing.T) {
+		primary := newNamedUpstream(t, "primary")
+		backup := newNamedUpstream(t, "backup")
+
+		lb := testBalancer(t, []string{primary.URL}, withBackups(backup.URL), withSticky(&global.Sticky{Secret: "test"}))
+		proxy := NewLoadBalancedProxy(lb, lb.logger, &global.SiteConfig{Domain: "example.com"})
+
+		lb.upstreams[0].healthy.Store(false)
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		if rec.Body.String() != "backup" {
+			t.Fatalf("Expected response from backup, got '%s'", rec.Body.String())
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Expected an affinity cookie, got %d cookies", len(cookies))
+		}
+
+		lb.upstreams[0].healthy.Store(true)
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.AddCookie(cookies[0])
+		rec = httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Body.String() != "primary" {
+			t.Errorf("Expected response from primary, got '%s'", rec.Body.String())
+		}
+	})
+
+	t.Run("single upstream with backups is load balanced", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		cfg := &global.SiteConfig{Domain: "example.com"}
+		cfg.Proxy.Upstream = "http://localhost:3000"
+		cfg.Proxy.BackupUpstreams = []global.Upstream{{URL: "http://localhost:4000"}}
+
+		h, err := NewSiteHandler(logger, cfg)
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		if h.lb == nil {
+			t.Fatal("Expected a load balancer for a single upstream with backups")
+		}
+
+		statuses := h.lb.Upstreams()
+		if len(statuses) != 2 || statuses[0].Backup || !statuses[1].Backup {
+			t.Errorf("Expected one primary and one backup, got %+v", statuses)
+		}
+	})
+}
@@ -0,0 +1,569 @@
+package site
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"reverse-proxy/internal/models/global"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstream is a single member of a LoadBalancer together with the runtime
+// state used to decide whether it may receive traffic.
+type upstream struct {
+	url     *url.URL
+	id      string
+	weight  int
+	backup  bool
+	healthy atomic.Bool
+	ejected atomic.Bool
+
+	// inflight counts requests currently being proxied to the upstream
+	inflight atomic.Int64
+
+	// currentWeight is the smooth weighted round-robin state, guarded by
+	// LoadBalancer.mu
+	currentWeight float64
+
+	// Passive health state, see LoadBalancer.observe, and the latency
+	// average, see LoadBalancer.recordLatency
+	mu                sync.Mutex
+	consecutiveErrors int
+	ejections         int
+	readmittedAt      time.Time
+	readmit           *time.Timer
+	ewma              float64
+	lastSample        time.Time
+
+	// breaker is nil unless circuit breaking is enabled
+	breaker *circuitBreaker
+
+	// warmingSince is when the upstream's slow start began in Unix
+	// nanoseconds, or 0 if it never warmed up
+	warmingSince atomic.Int64
+
+	// state is set by operators, see SetUpstreamState
+	state atomic.Int32
+
+	// requests and failures count the completed attempts sent to the
+	// upstream, see LoadBalancer.observe
+	requests atomic.Int64
+	failures atomic.Int64
+}
+
+// available reports whether u may be picked for new requests.
+func (u *upstream) available() bool {
+	return u.serving() && u.state.Load() == stateActive
+}
+
+// serving is available without the operator's drain, for requests of
+// clients already pinned to u.
+func (u *upstream) serving() bool {
+	return u.healthy.Load() && !u.ejected.Load() && u.breaker.allows() && u.state.Load() != stateDisabled
+}
+
+// UpstreamStatus is a point-in-time view of a load balancer member.
+type UpstreamStatus struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Backup   bool   `json:"backup,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Ejected  bool   `json:"ejected"`
+	Circuit  string `json:"circuit,omitempty"`
+	Warming  bool   `json:"warming,omitempty"`
+	State    string `json:"state"`
+	InFlight int64  `json:"in_flight"`
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"`
+}
+
+// Available reports whether the upstream could be picked for new requests
+// when the status was taken.
+func (s UpstreamStatus) Available() bool {
+	return s.Healthy && !s.Ejected && s.Circuit != CircuitOpen && s.State == UpstreamActive
+}
+
+type LoadBalancer struct {
+	upstreams    []*upstream
+	algorithm    string
+	currentIndex uint64
+	mu           sync.Mutex
+	logger       *slog.Logger
+	outlier      *outlierDetector
+	ring         *hashRing
+	hashKey      func(r *http.Request) string
+	sticky       *stickiness
+	retry        *retryPolicy
+	breakers     *breakerSettings
+	slowStart    *slowStart
+
+	// discovery and static are the discovery source and the static members
+	// next to the discovered ones, discovered is set once a lookup succeeded
+	discovery  *global.Discovery
+	static     []global.Upstream
+	discovered atomic.Bool
+
+	// transport carries the requests to every member, so everything
+	// proxying through the load balancer shares its connections
+	transport *http.Transport
+
+	// onBackup is set while traffic goes to the backup upstreams, guarded
+	// by mu
+	onBackup bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func NewLoadBalancer(upstreams []string, algorithm string) (*LoadBalancer, error) {
+	weighted := make([]global.Upstream, 0, len(upstreams))
+	for _, raw := range upstreams {
+		weighted = append(weighted, global.Upstream{URL: raw})
+	}
+	return NewWeightedLoadBalancer(weighted, algorithm)
+}
+
+// NewWeightedLoadBalancer is like NewLoadBalancer but takes upstreams with
+// weights. A zero weight counts as 1.
+func NewWeightedLoadBalancer(upstreams []global.Upstream, algorithm string) (*LoadBalancer, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no valid upstreams provided")
+	}
+	return newBalancer(upstreams, algorithm)
+}
+
+// newBalancer is NewWeightedLoadBalancer without the check for upstreams, for
+// load balancers whose members are discovered at runtime.
+func newBalancer(upstreams []global.Upstream, algorithm string) (*LoadBalancer, error) {
+	lb := &LoadBalancer{
+		algorithm: algorithm,
+		logger:    slog.Default(),
+		transport: newTransport(),
+		stop:      make(chan struct{}),
+	}
+
+	for _, cfg := range upstreams {
+		member, err := newUpstream(cfg)
+		if err != nil {
+			return nil, err
+		}
+		lb.upstreams = append(lb.upstreams, member)
+	}
+
+	if algorithm == "hash" {
+		lb.ring = newHashRing(lb.upstreams)
+		lb.hashKey, _ = parseHashKey("")
+	}
+
+	return lb, nil
+}
+
+func newUpstream(cfg global.Upstream) (*upstream, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL: %s", cfg.URL)
+	}
+	if cfg.Weight < 0 {
+		return nil, fmt.Errorf("invalid weight %d for upstream %s", cfg.Weight, cfg.URL)
+	}
+
+	member := &upstream{url: u, id: upstreamID(u), weight: max(cfg.Weight, 1)}
+	member.healthy.Store(true)
+	return member, nil
+}
+
+// AddBackups adds upstreams that only receive traffic while none of the
+// primary upstreams is available.
+func (lb *LoadBalancer) AddBackups(backups []global.Upstream) error {
+	members := make([]*upstream, 0, len(backups))
+	for _, cfg := range backups {
+		member, err := newUpstream(cfg)
+		if err != nil {
+			return err
+		}
+		member.backup = true
+		members = append(members, member)
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.upstreams = append(lb.upstreams, members...)
+	if lb.ring != nil {
+		lb.ring = newHashRing(lb.upstreams)
+	}
+	return nil
+}
+
+// SetUpstreams replaces the primary members of the load balancer. Members
+// whose URL is still listed keep their state, new ones get a circuit breaker
+// and slow start like the configured ones, and removed ones finish the
+// requests they are already serving. Backups are left alone.
+func (lb *LoadBalancer) SetUpstreams(upstreams []global.Upstream) error {
+	return lb.setUpstreams(upstreams, true)
+}
+
+// setUpstreams is SetUpstreams with the slow start of new members optional,
+// for filling a load balancer that doesn't serve traffic yet.
+func (lb *LoadBalancer) setUpstreams(upstreams []global.Upstream, warm bool) error {
+	members := make([]*upstream, 0, len(upstreams))
+	listed := make(map[string]bool, len(upstreams))
+	for _, cfg := range upstreams {
+		member, err := newUpstream(cfg)
+		if err != nil {
+			return err
+		}
+		if key := member.url.String(); !listed[key] {
+			listed[key] = true
+			members = append(members, member)
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	current := make(map[string]*upstream, len(lb.upstreams))
+	var backups []*upstream
+	for _, u := range lb.upstreams {
+		if u.backup {
+			backups = append(backups, u)
+		} else {
+			current[u.url.String()] = u
+		}
+	}
+
+	// Refreshes mostly find the members they already have, which keep the
+	// ring
+	changed := false
+	next := make([]*upstream, 0, len(members)+len(backups))
+	for _, member := range members {
+		key := member.url.String()
+		if u, ok := current[key]; ok {
+			changed = changed || u.weight != member.weight
+			u.weight = member.weight
+			delete(current, key)
+			next = append(next, u)
+			continue
+		}
+
+		changed = true
+
+		if lb.breakers != nil {
+			member.breaker = newCircuitBreaker(lb.breakers)
+		}
+		lb.logger.Info("Upstream added", "upstream", key, "weight", member.weight)
+		if warm {
+			lb.warm(member)
+		}
+		next = append(next, member)
+	}
+	for key, u := range current {
+		changed = true
+		u.stopReadmit()
+		lb.logger.Info("Upstream removed", "upstream", key)
+	}
+
+	lb.upstreams = append(next, backups...)
+	if lb.ring != nil && changed {
+		lb.ring = newHashRing(lb.upstreams)
+	}
+	return nil
+}
+
+// members returns a snapshot of the current members, primaries first.
+func (lb *LoadBalancer) members() []*upstream {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	return append([]*upstream(nil), lb.upstreams...)
+}
+
+// Next returns the upstream for the next request, or nil if the circuit of
+// every upstream is open.
+func (lb *LoadBalancer) Next() *url.URL {
+	u := lb.pick(nil, nil)
+	if u == nil {
+		return nil
+	}
+	return u.url
+}
+
+// Upstreams reports the current state of every member.
+func (lb *LoadBalancer) Upstreams() []UpstreamStatus {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	statuses := make([]UpstreamStatus, 0, len(lb.upstreams))
+	for _, u := range lb.upstreams {
+		status := UpstreamStatus{
+			URL:      u.url.String(),
+			Weight:   u.weight,
+			Backup:   u.backup,
+			Healthy:  u.healthy.Load(),
+			Ejected:  u.ejected.Load(),
+			State:    stateNames[u.state.Load()],
+			InFlight: u.inflight.Load(),
+			Requests: u.requests.Load(),
+			Failures: u.failures.Load(),
+		}
+		if u.breaker != nil {
+			status.Circuit = u.breaker.State()
+		}
+		if lb.slowStart != nil {
+			status.Warming = lb.slowStart.factor(u, time.Now()) < 1
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// SetHashKey configures which part of the request the "hash" algorithm uses,
+// see parseHashKey for the accepted forms.
+func (lb *LoadBalancer) SetHashKey(spec string) error {
+	hashKey, err := parseHashKey(spec)
+	if err != nil {
+		return err
+	}
+
+	lb.hashKey = hashKey
+	return nil
+}
+
+// pick chooses the upstream for r, avoiding the ones in exclude unless no
+// other candidate is left, and counts r as a trial request when its circuit
+// is half-open. The request may be nil for algorithms that don't look at it.
+func (lb *LoadBalancer) pick(r *http.Request, exclude map[*upstream]bool) *upstream {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	candidates := lb.candidates()
+	if len(exclude) > 0 {
+		remaining := make([]*upstream, 0, len(candidates))
+		for _, u := range candidates {
+			if !exclude[u] {
+				remaining = append(remaining, u)
+			}
+		}
+		if len(remaining) > 0 {
+			candidates = remaining
+		}
+	}
+
+	// A half-open circuit takes a limited number of trial requests, a member
+	// whose trials are all taken is left out
+	for len(candidates) > 0 {
+		u := lb.choose(r, candidates)
+		ok, from, to := u.breaker.tryAcquire()
+		lb.logTransition(u, from, to)
+		if ok {
+			return u
+		}
+
+		remaining := make([]*upstream, 0, len(candidates)-1)
+		for _, c := range candidates {
+			if c != u {
+				remaining = append(remaining, c)
+			}
+		}
+		candidates = remaining
+	}
+	return nil
+}
+
+// choose picks one of candidates with the algorithm of the load balancer.
+// Must be called with lb.mu held.
+func (lb *LoadBalancer) choose(r *http.Request, candidates []*upstream) *upstream {
+	switch lb.algorithm {
+	case "random":
+		return lb.random(candidates)
+	case "least-conn":
+		return lb.leastConn(candidates)
+	case "weighted-round-robin":
+		return lb.smoothWeighted(candidates, true)
+	case "hash":
+		return lb.consistentHash(r, candidates)
+	case "p2c-ewma":
+		return lb.p2cEWMA(candidates)
+	default:
+		// Round-robin, also the default. While an upstream warms up it
+		// takes turns in proportion to its share instead
+		if lb.warming(candidates) {
+			return lb.smoothWeighted(candidates, false)
+		}
+		index := atomic.AddUint64(&lb.currentIndex, 1) - 1
+		return candidates[index%uint64(len(candidates))]
+	}
+}
+
+// random picks a candidate at random, warming upstreams in proportion to
+// their share.
+func (lb *LoadBalancer) random(candidates []*upstream) *upstream {
+	if !lb.warming(candidates) {
+		return candidates[rand.IntN(len(candidates))]
+	}
+
+	var total float64
+	for _, u := range candidates {
+		total += lb.share(u)
+	}
+	x := rand.Float64() * total
+	for _, u := range candidates {
+		if x -= lb.share(u); x < 0 {
+			return u
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// leastConn picks the candidate with the fewest in-flight requests, counted
+// against the share of warming upstreams. The scan starts at a rotating
+// offset so ties are broken round-robin.
+func (lb *LoadBalancer) leastConn(candidates []*upstream) *upstream {
+	offset := atomic.AddUint64(&lb.currentIndex, 1) - 1
+
+	var best *upstream
+	var bestLoad float64
+	for i := range candidates {
+		u := candidates[(offset+uint64(i))%uint64(len(candidates))]
+		load := float64(u.inflight.Load()+1) / lb.share(u)
+		if best == nil || load < bestLoad {
+			best, bestLoad = u, load
+		}
+	}
+	return best
+}
+
+// smoothWeighted implements nginx's smooth weighted round-robin: every pick
+// raises each candidate's current weight by its weight and lowers the winner's
+// by the total, which spreads picks of heavy upstreams out evenly instead of
+// sending them in bursts. Weights are scaled by the share of warming
+// upstreams, and taken as 1 unless weighted. Must be called with lb.mu held.
+func (lb *LoadBalancer) smoothWeighted(candidates []*upstream, weighted bool) *upstream {
+	var best *upstream
+	var total float64
+	for _, u := range candidates {
+		weight := lb.share(u)
+		if weighted {
+			weight *= float64(u.weight)
+		}
+		u.currentWeight += weight
+		total += weight
+		if best == nil || u.currentWeight > best.currentWeight {
+			best = u
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// consistentHash picks the ring owner of the request's hash key among the
+// candidates. A warming upstream owns the part of its ring points matching
+// its share, so it takes over its keys gradually and each key moves once.
+func (lb *LoadBalancer) consistentHash(r *http.Request, candidates []*upstream) *upstream {
+	key := ""
+	if r != nil {
+		key = lb.hashKey(r)
+	}
+
+	var usable map[*upstream]bool
+	if len(candidates) < len(lb.upstreams) {
+		usable = make(map[*upstream]bool, len(candidates))
+		for _, u := range candidates {
+			usable[u] = true
+		}
+	}
+
+	return lb.ring.get(key, usable, lb.share)
+}
+
+// candidates returns the upstreams that may currently receive traffic: the
+// available primaries, or the available backups if there are none. When
+// every upstream is down all of them are returned, primaries first, since
+// sending a request to a possibly-dead upstream beats refusing it outright.
+// Upstreams with an open circuit are the exception: the point of the circuit
+// breaker is to fail fast instead. So are upstreams an operator drained or
+// disabled. Must be called with lb.mu held.
+func (lb *LoadBalancer) candidates() []*upstream {
+	primaries := make([]*upstream, 0, len(lb.upstreams))
+	var backups []*upstream
+	for _, u := range lb.upstreams {
+		if !u.available() {
+			continue
+		}
+		if u.backup {
+			backups = append(backups, u)
+		} else {
+			primaries = append(primaries, u)
+		}
+	}
+
+	switch {
+	case len(primaries) > 0:
+		lb.useBackups(false)
+		return primaries
+	case len(backups) > 0:
+		lb.useBackups(true)
+		return backups
+	}
+
+	var fallback []*upstream
+	for _, backup := range []bool{false, true} {
+		for _, u := range lb.upstreams {
+			if u.backup == backup && u.breaker.allows() && u.state.Load() == stateActive {
+				fallback = append(fallback, u)
+			}
+		}
+		if len(fallback) > 0 {
+			break
+		}
+	}
+	return fallback
+}
+
+// useBackups records whether traffic goes to the backups and logs when that
+// changes. Must be called with lb.mu held.
+func (lb *LoadBalancer) useBackups(on bool) {
+	if lb.onBackup == on {
+		return
+	}
+	lb.onBackup = on
+
+	if on {
+		lb.logger.Warn("No primary upstream available, failing over to backups")
+		return
+	}
+	lb.logger.Info("Primary upstreams available again, leaving backups")
+}
+
+// primaryAvailable reports whether any primary upstream may receive traffic.
+func (lb *LoadBalancer) primaryAvailable() bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for _, u := range lb.upstreams {
+		if !u.backup && u.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops the background work started for the load balancer and closes
+// its idle connections. Requests that still hold a reference to it keep
+// working.
+func (lb *LoadBalancer) Close() {
+	lb.stopOnce.Do(func() {
+		close(lb.stop)
+		lb.transport.CloseIdleConnections()
+		for _, u := range lb.members() {
+			u.stopReadmit()
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package site
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"testing"
+)
+
+// balancerOption configures a load balancer made by testBalancer.
+type balancerOption func(*balancerConfig)
+
+type balancerConfig struct {
+	algorithm string
+	weights   []int
+	setup     []func(lb *LoadBalancer) error
+}
+
+func withAlgorithm(algorithm string) balancerOption {
+	return func(c *balancerConfig) { c.algorithm = algorithm }
+}
+
+// withWeights gives the upstreams, in order, the weights.
+func withWeights(weights ...int) balancerOption {
+	return func(c *balancerConfig) { c.weights = weights }
+}
+
+func withSetup(setup func(lb *LoadBalancer) error) balancerOption {
+	return func(c *balancerConfig) { c.setup = append(c.setup, setup) }
+}
+
+func withBreakers(cfg *global.CircuitBreaker) balancerOption {
+	return withSetup(func(lb *LoadBalancer) error { return lb.EnableCircuitBreakers(cfg) })
+}
+
+func withSlowStart(cfg *global.SlowStart) balancerOption {
+	return withSetup(func(lb *LoadBalancer) error { return lb.EnableSlowStart(cfg) })
+}
+
+func withSticky(cfg *global.Sticky) balancerOption {
+	return withSetup(func(lb *LoadBalancer) error { return lb.EnableSticky(cfg) })
+}
+
+func withRetries(cfg *global.Retry) balancerOption {
+	return withSetup(func(lb *LoadBalancer) error { return lb.EnableRetries(cfg) })
+}
+
+func withBackups(urls ...string) balancerOption {
+	return withSetup(func(lb *LoadBalancer) error {
+		var backups []global.Upstream
+		for _, u := range urls {
+			backups = append(backups, global.Upstream{URL: u})
+		}
+		return lb.AddBackups(backups)
+	})
+}
+
+// testBalancer returns a load balancer over upstreams that logs nowhere,
+// round-robin unless opts say otherwise, and is closed when the test ends.
+func testBalancer(t *testing.T, upstreams []string, opts ...balancerOption) *LoadBalancer {
+	t.Helper()
+	cfg := balancerConfig{algorithm: "round-robin"}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	members := make([]global.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		members[i].URL = u
+		if i < len(cfg.weights) {
+			members[i].Weight = cfg.weights[i]
+		}
+	}
+	lb, err := NewWeightedLoadBalancer(members, cfg.algorithm)
+	if err != nil {
+		t.Fatalf("NewWeightedLoadBalancer failed: %v", err)
+	}
+	lb.logger = slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	t.Cleanup(lb.Close)
+
+	for _, setup := range cfg.setup {
+		if err := setup(lb); err != nil {
+			t.Fatalf("Failed to configure the load balancer: %v", err)
+		}
+	}
+	return lb
+}
+
+func TestLeastConn(t *testing.T) {
+	t.Run("picks least loaded upstream", func(t *testing.T) {
+		lb := testBalancer(t, []string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+			"http://localhost:3002",
+		}, withAlgorithm("least-conn"))
+
+		lb.upstreams[0].inflight.Store(5)
+		lb.upstreams[1].inflight.Store(1)
+		lb.upstreams[2].inflight.Store(3)
+
+		for i := 0; i < 3; i++ {
+			if target := lb.Next(); target.String() != "http://localhost:3001" {
+				t.Errorf("Expected least loaded upstream http://localhost:3001, got %s", target)
+			}
+		}
+	})
+
+	t.Run("ties are broken round-robin", func(t *testing.T) {
+		lb := testBalancer(t, []string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+		}, withAlgorithm("least-conn"))
+
+		urls := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			urls[lb.Next().String()]++
+		}
+
+		for url, count := range urls {
+			if count != 2 {
+				t.Errorf("Expected %s to be used 2 times, got %d", url, count)
+			}
+		}
+	})
+
+	t.Run("in-flight requests are tracked by the proxy", func(t *testing.T) {
+		release := make(chan struct{})
+		started := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer slow.Close()
+
+		lb := testBalancer(t, []string{slow.URL}, withAlgorithm("least-conn"))
+		proxy := NewLoadBalancedProxy(lb, lb.logger, &global.SiteConfig{Domain: "example.com"})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+		}()
+
+		<-started
+		if n := lb.upstreams[0].inflight.Load(); n != 1 {
+			t.Errorf("Expected 1 in-flight request, got %d", n)
+		}
+
+		close(release)
+		<-done
+		if n := lb.upstreams[0].inflight.Load(); n != 0 {
+			t.Errorf("Expected 0 in-flight requests, got %d", n)
+		}
+	})
+}
+
+func TestSmoothWeightedRoundRobin(t *testing.T) {
+	t.Run("honours weights without bursts", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://big:3000", "http://small:3000"},
+			withAlgorithm("weighted-round-robin"), withWeights(4, 1))
+
+		urls := make(map[string]int)
+		previous := ""
+		for i := 0; i < 10; i++ {
+			target := lb.Next().String()
+			urls[target]++
+			if target == "http://small:3000" && previous == "http://small:3000" {
+				t.Error("Expected small upstream not to be picked twice in a row")
+			}
+			previous = target
+		}
+
+		if urls["http://big:3000"] != 8 || urls["http://small:3000"] != 2 {
+			t.Errorf("Expected 8/2 split, got %v", urls)
+		}
+	})
+
+	t.Run("zero weight counts as one", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://a:3000", "http://b:3000"},
+			withAlgorithm("weighted-round-robin"), withWeights(0, 0))
+
+		urls := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			urls[lb.Next().String()]++
+		}
+
+		for url, count := range urls {
+			if count != 2 {
+				t.Errorf("Expected %s to be used 2 times, got %d", url, count)
+			}
+		}
+	})
+
+	t.Run("negative weight", func(t *testing.T) {
+		_, err := NewWeightedLoadBalancer([]global.Upstream{{URL: "http://a:3000", Weight: -1}}, "weighted-round-robin")
+		if err == nil {
+			t.Error("Expected error for negative weight, got nil")
+		}
+	})
+}
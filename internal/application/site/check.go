@@ -0,0 +1,74 @@
+package site
+
+import (
+	"fmt"
+	"reverse-proxy/internal/models/global"
+)
+
+// algorithms lists the load balancing algorithms pick implements. Any other
+// name falls back to round-robin at runtime.
+var algorithms = []string{"round-robin", "random", "least-conn", "weighted-round-robin", "hash", "p2c-ewma"}
+
+// CheckLoadBalance applies the rules newLoadBalancer applies to cfg without
+// starting anything. The problems are keyed by the YAML key of the option
+// they are about.
+func CheckLoadBalance(cfg *global.LoadBalance) map[string]error {
+	problems := make(map[string]error)
+
+	if cfg.Algorithm != "" && !knownAlgorithm(cfg.Algorithm) {
+		problems["algorithm"] = fmt.Errorf("unknown load balancing algorithm: %s", cfg.Algorithm)
+	}
+	if cfg.HashKey != "" {
+		if _, err := parseHashKey(cfg.HashKey); err != nil {
+			problems["hash_key"] = err
+		}
+	}
+	if cfg.HealthCheck != nil {
+		if _, err := newHealthChecker(cfg.HealthCheck); err != nil {
+			problems["health_check"] = err
+		}
+	}
+	if cfg.OutlierDetection != nil {
+		if _, err := newOutlierDetector(cfg.OutlierDetection); err != nil {
+			problems["outlier_detection"] = err
+		}
+	}
+	if cfg.Sticky != nil {
+		if _, err := newStickiness(cfg.Sticky); err != nil {
+			problems["sticky"] = err
+		}
+	}
+	if cfg.Retry != nil {
+		if _, err := newRetryPolicy(cfg.Retry); err != nil {
+			problems["retry"] = err
+		}
+	}
+	if cfg.CircuitBreaker != nil {
+		if _, err := newBreakerSettings(cfg.CircuitBreaker); err != nil {
+			problems["circuit_breaker"] = err
+		}
+	}
+	if cfg.SlowStart != nil {
+		if _, err := newSlowStart(cfg.SlowStart); err != nil {
+			problems["slow_start"] = err
+		}
+	}
+
+	return problems
+}
+
+// CheckDiscovery applies the rules StartDiscovery applies to cfg without
+// looking anything up.
+func CheckDiscovery(cfg *global.Discovery) error {
+	_, err := newDiscoverer(cfg)
+	return err
+}
+
+func knownAlgorithm(name string) bool {
+	for _, a := range algorithms {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package site
+
+import (
+	"reverse-proxy/internal/models/global"
+	"testing"
+)
+
+func TestCheckLoadBalance(t *testing.T) {
+	problems := CheckLoadBalance(&global.LoadBalance{Algorithm: "least-conn", HealthCheck: &global.HealthCheck{Path: "/health"}})
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+
+	problems = CheckLoadBalance(&global.LoadBalance{
+		Algorithm:   "fastest",
+		HashKey:     "header:",
+		HealthCheck: &global.HealthCheck{Interval: "5x"},
+		SlowStart:   &global.SlowStart{MinWeight: 2},
+	})
+	for _, key := range []string{"algorithm", "hash_key", "health_check", "slow_start"} {
+		if problems[key] == nil {
+			t.Errorf("Expected a problem with %s, got %v", key, problems)
+		}
+	}
+	if len(problems) != 4 {
+		t.Errorf("Expected 4 problems, got %v", problems)
+	}
+}
+
+func TestCheckDiscovery(t *testing.T) {
+	if err := CheckDiscovery(&global.Discovery{DNS: &global.DNSDiscovery{Name: "api.internal", Port: 8080}}); err != nil {
+		t.Errorf("Expected valid discovery, got %v", err)
+	}
+	if err := CheckDiscovery(&global.Discovery{}); err == nil {
+		t.Error("Expected an error without a source")
+	}
+}
@@ -0,0 +1,276 @@
+package site
+
+import (
+	"fmt"
+	"reverse-proxy/internal/models/global"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// windowBuckets is the number of buckets the rolling window is split into.
+const windowBuckets = 10
+
+// breakerSettings holds the parsed form of a global.CircuitBreaker.
+type breakerSettings struct {
+	consecutiveFailures int
+	errorRate           float64
+	minRequests         int
+	window              time.Duration
+	openTimeout         time.Duration
+	halfOpenRequests    int
+}
+
+func newBreakerSettings(cfg *global.CircuitBreaker) (*breakerSettings, error) {
+	s := &breakerSettings{
+		consecutiveFailures: 5,
+		errorRate:           0.5,
+		minRequests:         20,
+		window:              10 * time.Second,
+		openTimeout:         30 * time.Second,
+		halfOpenRequests:    1,
+	}
+
+	if cfg.ConsecutiveFailures > 0 {
+		s.consecutiveFailures = cfg.ConsecutiveFailures
+	}
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+		return nil, fmt.Errorf("invalid circuit breaker error rate: %v", cfg.ErrorRate)
+	}
+	if cfg.ErrorRate > 0 {
+		s.errorRate = cfg.ErrorRate
+	}
+	if cfg.MinRequests > 0 {
+		s.minRequests = cfg.MinRequests
+	}
+	var err error
+	if cfg.Window != "" {
+		if s.window, err = time.ParseDuration(cfg.Window); err != nil || s.window <= 0 {
+			return nil, fmt.Errorf("invalid circuit breaker window: %s", cfg.Window)
+		}
+	}
+	if cfg.OpenTimeout != "" {
+		if s.openTimeout, err = time.ParseDuration(cfg.OpenTimeout); err != nil || s.openTimeout <= 0 {
+			return nil, fmt.Errorf("invalid circuit breaker open timeout: %s", cfg.OpenTimeout)
+		}
+	}
+	if cfg.HalfOpenRequests > 0 {
+		s.halfOpenRequests = cfg.HalfOpenRequests
+	}
+
+	return s, nil
+}
+
+// bucket counts the requests of one slice of the rolling window.
+type bucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+// circuitBreaker tracks the circuit state of a single upstream.
+type circuitBreaker struct {
+	settings *breakerSettings
+
+	mu          sync.Mutex
+	state       string
+	openedAt    time.Time
+	consecutive int
+	buckets     [windowBuckets]bucket
+	trials      int // half-open requests started
+	successes   int // half-open requests succeeded
+}
+
+func newCircuitBreaker(settings *breakerSettings) *circuitBreaker {
+	return &circuitBreaker{settings: settings, state: CircuitClosed}
+}
+
+// State returns the current circuit state. An open circuit whose timeout has
+// passed reports as half-open since the next request will be a trial.
+func (cb *circuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.settings.openTimeout {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// allows reports whether the upstream may be picked. It doesn't change
+// state and may be out of date by the time the upstream is used; tryAcquire
+// decides.
+func (cb *circuitBreaker) allows() bool {
+	if cb == nil {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		return time.Since(cb.openedAt) >= cb.settings.openTimeout
+	case CircuitHalfOpen:
+		return cb.trials < cb.settings.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// tryAcquire is called when the upstream is picked for a request. It moves
+// an open circuit whose timeout passed to half-open and takes one of the
+// trial requests, and reports false when the circuit is open or every trial
+// is taken. The returned transition is empty unless the state changed.
+func (cb *circuitBreaker) tryAcquire() (ok bool, from, to string) {
+	if cb == nil {
+		return true, "", ""
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen {
+		if time.Since(cb.openedAt) < cb.settings.openTimeout {
+			return false, "", ""
+		}
+		from, to = cb.state, CircuitHalfOpen
+		cb.state = CircuitHalfOpen
+		cb.trials = 0
+		cb.successes = 0
+	}
+	if cb.state == CircuitHalfOpen {
+		if cb.trials >= cb.settings.halfOpenRequests {
+			return false, from, to
+		}
+		cb.trials++
+	}
+	return true, from, to
+}
+
+// release gives back the trial slot of a request that ended without an
+// outcome, such as one whose client went away.
+func (cb *circuitBreaker) release() {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen && cb.trials > 0 {
+		cb.trials--
+	}
+}
+
+// record adds the outcome of a request and returns the state transition it
+// caused, if any.
+func (cb *circuitBreaker) record(failed bool) (from, to string) {
+	if cb == nil {
+		return "", ""
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	from = cb.state
+
+	switch cb.state {
+	case CircuitHalfOpen:
+		if failed {
+			cb.open(now)
+			break
+		}
+		cb.successes++
+		if cb.successes >= cb.settings.halfOpenRequests {
+			cb.state = CircuitClosed
+			cb.consecutive = 0
+			cb.buckets = [windowBuckets]bucket{}
+		}
+	case CircuitClosed:
+		b := cb.bucket(now)
+		b.total++
+		if failed {
+			b.failures++
+			cb.consecutive++
+		} else {
+			cb.consecutive = 0
+		}
+
+		total, failures := cb.counts(now)
+		if cb.consecutive >= cb.settings.consecutiveFailures ||
+			(total >= cb.settings.minRequests && float64(failures)/float64(total) >= cb.settings.errorRate) {
+			cb.open(now)
+		}
+	}
+
+	if cb.state == from {
+		return "", ""
+	}
+	return from, cb.state
+}
+
+func (cb *circuitBreaker) open(now time.Time) {
+	cb.state = CircuitOpen
+	cb.openedAt = now
+	cb.consecutive = 0
+}
+
+// bucket returns the bucket for now, resetting it if it belongs to an
+// earlier turn of the window.
+func (cb *circuitBreaker) bucket(now time.Time) *bucket {
+	width := cb.settings.window / windowBuckets
+	start := now.Truncate(width)
+	b := &cb.buckets[(start.UnixNano()/int64(width))%windowBuckets]
+	if !b.start.Equal(start) {
+		*b = bucket{start: start}
+	}
+	return b
+}
+
+// counts sums the requests within the window ending at now.
+func (cb *circuitBreaker) counts(now time.Time) (total, failures int) {
+	for _, b := range cb.buckets {
+		if now.Sub(b.start) < cb.settings.window {
+			total += b.total
+			failures += b.failures
+		}
+	}
+	return total, failures
+}
+
+// EnableCircuitBreakers gives every upstream of the load balancer its own
+// circuit breaker.
+func (lb *LoadBalancer) EnableCircuitBreakers(cfg *global.CircuitBreaker) error {
+	settings, err := newBreakerSettings(cfg)
+	if err != nil {
+		return err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.breakers = settings
+	for _, u := range lb.upstreams {
+		u.breaker = newCircuitBreaker(settings)
+	}
+	return nil
+}
+
+// logTransition logs a circuit state change of u.
+func (lb *LoadBalancer) logTransition(u *upstream, from, to string) {
+	if to == "" {
+		return
+	}
+	if to == CircuitOpen {
+		lb.logger.Warn("Circuit breaker state changed", "upstream", u.url.String(), "from", from, "to", to)
+		return
+	}
+	lb.logger.Info("Circuit breaker state changed", "upstream", u.url.String(), "from", from, "to", to)
+}
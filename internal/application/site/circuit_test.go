@@ -0,0 +1,244 @@
+package site
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("consecutive failures open the circuit", func(t *testing.T) {
+		lb := testBalancer(t, []string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+		}, withBreakers(&global.CircuitBreaker{ConsecutiveFailures: 3}))
+
+		failing := lb.upstreams[0]
+		for i := 0; i < 3; i++ {
+			lb.observe(failing, http.StatusBadGateway, nil)
+		}
+
+		if state := failing.breaker.State(); state != CircuitOpen {
+			t.Fatalf("Expected circuit to be open, got %s", state)
+		}
+		for i := 0; i < 4; i++ {
+			if u := lb.Next(); u != lb.upstreams[1].url {
+				t.Errorf("Expected open upstream to be skipped, got %s", u)
+			}
+		}
+	})
+
+	t.Run("successes reset the consecutive count", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"}, withBreakers(&global.CircuitBreaker{ConsecutiveFailures: 3}))
+
+		u := lb.upstreams[0]
+		for i := 0; i < 10; i++ {
+			failed := i%2 == 0
+			if failed {
+				lb.observe(u, 0, http.ErrHandlerTimeout)
+			} else {
+				lb.observe(u, http.StatusOK, nil)
+			}
+		}
+
+		if state := u.breaker.State(); state != CircuitClosed {
+			t.Errorf("Expected circuit to stay closed, got %s", state)
+		}
+	})
+
+	t.Run("error rate opens the circuit after min requests", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"}, withBreakers(&global.CircuitBreaker{
+			ConsecutiveFailures: 100,
+			ErrorRate:           0.5,
+			MinRequests:         10,
+		}))
+
+		u := lb.upstreams[0]
+		for i := 0; i < 9; i++ {
+			lb.observe(u, http.StatusOK+(i%2)*300, nil)
+		}
+		if state := u.breaker.State(); state != CircuitClosed {
+			t.Fatalf("Expected circuit to stay closed below min requests, got %s", state)
+		}
+
+		lb.observe(u, http.StatusInternalServerError, nil)
+		if state := u.breaker.State(); state != CircuitOpen {
+			t.Errorf("Expected circuit to open at 50%% errors, got %s", state)
+		}
+	})
+
+	t.Run("half-open trial closes the circuit on success", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"}, withBreakers(&global.CircuitBreaker{
+			ConsecutiveFailures: 1,
+			OpenTimeout:         "20ms",
+		}))
+
+		u := lb.upstreams[0]
+		lb.observe(u, http.StatusServiceUnavailable, nil)
+		if u.breaker.allows() {
+			t.Fatal("Expected open circuit to reject requests")
+		}
+
+		time.Sleep(30 * time.Millisecond)
+		if state := u.breaker.State(); state != CircuitHalfOpen {
+			t.Fatalf("Expected circuit to be half-open, got %s", state)
+		}
+
+		if ok, _, _ := u.breaker.tryAcquire(); !ok {
+			t.Fatal("Expected a trial request while half-open")
+		}
+		if ok, _, _ := u.breaker.tryAcquire(); ok {
+			t.Error("Expected only one trial request while half-open")
+		}
+
+		lb.observe(u, http.StatusOK, nil)
+		if state := u.breaker.State(); state != CircuitClosed {
+			t.Errorf("Expected circuit to close after a successful trial, got %s", state)
+		}
+	})
+
+	t.Run("half-open trial reopens the circuit on failure", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"}, withBreakers(&global.CircuitBreaker{
+			ConsecutiveFailures: 1,
+			OpenTimeout:         "20ms",
+		}))
+
+		u := lb.upstreams[0]
+		lb.observe(u, http.StatusServiceUnavailable, nil)
+		time.Sleep(30 * time.Millisecond)
+
+		u.breaker.tryAcquire()
+		lb.observe(u, http.StatusServiceUnavailable, nil)
+		if state := u.breaker.State(); state != CircuitOpen {
+			t.Errorf("Expected circuit to reopen after a failed trial, got %s", state)
+		}
+	})
+
+	t.Run("concurrent picks share the trial requests", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"}, withBreakers(&global.CircuitBreaker{
+			ConsecutiveFailures: 1,
+			OpenTimeout:         "20ms",
+			HalfOpenRequests:    2,
+		}))
+
+		u := lb.upstreams[0]
+		lb.observe(u, http.StatusServiceUnavailable, nil)
+		time.Sleep(30 * time.Millisecond)
+
+		var picked atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if lb.pick(nil, nil) != nil {
+					picked.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := picked.Load(); n != 2 {
+			t.Errorf("Expected 2 trial requests, got %d", n)
+		}
+	})
+
+	t.Run("open circuits fail fast with 503", func(t *testing.T) {
+		var hits atomic.Int32
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer backend.Close()
+
+		lb := testBalancer(t, []string{backend.URL}, withBreakers(&global.CircuitBreaker{ConsecutiveFailures: 2}))
+		proxy := NewLoadBalancedProxy(lb, lb.logger, &global.SiteConfig{Domain: "example.com"})
+
+		codes := make([]int, 4)
+		for i := range codes {
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+			codes[i] = rec.Code
+		}
+
+		if codes[0] != http.StatusBadGateway || codes[1] != http.StatusBadGateway {
+			t.Errorf("Expected the first two requests to reach the upstream, got %v", codes)
+		}
+		if codes[2] != http.StatusServiceUnavailable || codes[3] != http.StatusServiceUnavailable {
+			t.Errorf("Expected requests to fail fast once open, got %v", codes)
+		}
+		if hits.Load() != 2 {
+			t.Errorf("Expected 2 upstream hits, got %d", hits.Load())
+		}
+	})
+
+	t.Run("site timeouts count as upstream failures", func(t *testing.T) {
+		release := make(chan struct{})
+		hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer hanging.Close()
+		defer close(release)
+
+		handler, err := NewSiteHandler(slog.New(slog.NewTextHandler(io.Discard, nil)), &global.SiteConfig{
+			Domain: "example.com",
+			Proxy: global.Proxy{
+				PathBase: global.PathBase{
+					Upstreams: []global.Upstream{{URL: hanging.URL}},
+					LoadBalance: &global.LoadBalance{
+						CircuitBreaker: &global.CircuitBreaker{ConsecutiveFailures: 1},
+					},
+				},
+			},
+			Timeouts: global.Timeouts{Read: 50 * time.Millisecond},
+		})
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		defer handler.Close()
+
+		rec := httptest.NewRecorder()
+		handler.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+
+		// The proxy may still be recording the failure when the timeout
+		// handler has answered
+		waitFor(t, func() bool { return handler.lb.upstreams[0].breaker.State() == CircuitOpen })
+	})
+
+	t.Run("status reports circuit state", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000"}, withBreakers(&global.CircuitBreaker{ConsecutiveFailures: 1}))
+
+		if status := lb.Upstreams()[0]; status.Circuit != CircuitClosed {
+			t.Errorf("Expected circuit 'closed', got '%s'", status.Circuit)
+		}
+
+		lb.observe(lb.upstreams[0], 0, http.ErrHandlerTimeout)
+		if status := lb.Upstreams()[0]; status.Circuit != CircuitOpen {
+			t.Errorf("Expected circuit 'open', got '%s'", status.Circuit)
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://localhost:3000"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		if err := lb.EnableCircuitBreakers(&global.CircuitBreaker{ErrorRate: 1.5}); err == nil {
+			t.Error("Expected error for invalid error rate, got nil")
+		}
+
+		if err := lb.EnableCircuitBreakers(&global.CircuitBreaker{OpenTimeout: "soon"}); err == nil {
+			t.Error("Expected error for invalid open timeout, got nil")
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package site
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reverse-proxy/internal/models/global"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulEntry is the part of a /v1/health/service entry the discoverer uses.
+type consulEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Tags    []string          `json:"Tags"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+// consulDiscoverer holds the parsed form of a global.ConsulDiscovery.
+type consulDiscoverer struct {
+	address    string
+	service    string
+	tag        string
+	datacenter string
+	token      string
+	scheme     string
+	blockFor   time.Duration
+	client     *http.Client
+
+	// index is the X-Consul-Index of the last answer, the next query blocks
+	// until the catalog moves past it
+	mu    sync.Mutex
+	index uint64
+}
+
+func newConsulDiscoverer(cfg *global.ConsulDiscovery) (*consulDiscoverer, error) {
+	d := &consulDiscoverer{
+		address:    strings.TrimSuffix(cfg.Address, "/"),
+		service:    cfg.Service,
+		tag:        cfg.Tag,
+		datacenter: cfg.Datacenter,
+		token:      cfg.Token,
+		scheme:     "http",
+		blockFor:   5 * time.Minute,
+		client:     &http.Client{},
+	}
+
+	if d.service == "" {
+		return nil, fmt.Errorf("consul discovery needs a service")
+	}
+
+	if d.address == "" {
+		d.address = "http://127.0.0.1:8500"
+	}
+	if u, err := url.Parse(d.address); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid consul address: %s", cfg.Address)
+	}
+
+	if cfg.Scheme != "" {
+		if cfg.Scheme != "http" && cfg.Scheme != "https" {
+			return nil, fmt.Errorf("invalid consul discovery scheme: %s", cfg.Scheme)
+		}
+		d.scheme = cfg.Scheme
+	}
+
+	var err error
+	if cfg.Wait != "" {
+		if d.blockFor, err = time.ParseDuration(cfg.Wait); err != nil || d.blockFor <= 0 {
+			return nil, fmt.Errorf("invalid consul wait: %s", cfg.Wait)
+		}
+	}
+
+	return d, nil
+}
+
+// interval is the pause between blocking queries, which return as soon as
+// the service changes.
+func (d *consulDiscoverer) interval() time.Duration {
+	return time.Second
+}
+
+func (d *consulDiscoverer) wait() time.Duration {
+	return d.blockFor
+}
+
+func (d *consulDiscoverer) String() string {
+	return "consul:" + d.service
+}
+
+// discover returns the passing instances of the service. After the first
+// call it blocks until the service changes or the wait time is over.
+func (d *consulDiscoverer) discover(ctx context.Context) ([]global.Upstream, error) {
+	d.mu.Lock()
+	index := d.index
+	d.mu.Unlock()
+
+	query := url.Values{}
+	query.Set("passing", "1")
+	query.Set("index", strconv.FormatUint(index, 10))
+	query.Set("wait", strconv.Itoa(int(d.blockFor/time.Second))+"s")
+	if d.tag != "" {
+		query.Set("tag", d.tag)
+	}
+	if d.datacenter != "" {
+		query.Set("dc", d.datacenter)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.address+"/v1/health/service/"+url.PathEscape(d.service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.token != "" {
+		req.Header.Set("X-Consul-Token", d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned status %d", resp.StatusCode)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode consul response: %w", err)
+	}
+
+	// An index that goes backwards means the catalog was reset, start over
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || next < index {
+		next = 0
+	}
+	d.mu.Lock()
+	d.index = next
+	d.mu.Unlock()
+
+	upstreams := make([]global.Upstream, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		upstreams = append(upstreams, global.Upstream{
+			URL:    d.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Weight: consulWeight(entry),
+		})
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool {
+		return upstreams[i].URL < upstreams[j].URL
+	})
+	return upstreams, nil
+}
+
+// consulWeight returns the weight from the "weight" meta key, or else from a
+// "weight=<n>" tag. Missing or invalid weights count as the default.
+func consulWeight(entry consulEntry) int {
+	raw, ok := entry.Service.Meta["weight"]
+	if !ok {
+		for _, tag := range entry.Service.Tags {
+			if value, found := strings.CutPrefix(tag, "weight="); found {
+				raw, ok = value, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return 0
+	}
+
+	weight, err := strconv.Atoi(raw)
+	if err != nil || weight < 0 {
+		return 0
+	}
+	return weight
+}
@@ -0,0 +1,195 @@
+package site
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul answers health queries for one service and blocks queries that
+// are already at the current index until the instances change.
+type fakeConsul struct {
+	mu        sync.Mutex
+	index     uint64
+	instances []map[string]any
+	changed   chan struct{}
+	query     map[string]string
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *httptest.Server) {
+	t.Helper()
+	fake := &fakeConsul{index: 1, changed: make(chan struct{})}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/api" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fake.mu.Lock()
+		fake.query = map[string]string{
+			"passing": r.URL.Query().Get("passing"),
+			"tag":     r.URL.Query().Get("tag"),
+			"dc":      r.URL.Query().Get("dc"),
+			"token":   r.Header.Get("X-Consul-Token"),
+		}
+		index, changed := fake.index, fake.changed
+		fake.mu.Unlock()
+
+		if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(fake.index, 10))
+		json.NewEncoder(w).Encode(fake.instances)
+	}))
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+func (f *fakeConsul) set(instances ...map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances = instances
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func consulInstance(node, address string, port int, tags []string, meta map[string]string) map[string]any {
+	return map[string]any{
+		"Node":    map[string]string{"Address": node},
+		"Service": map[string]any{"Address": address, "Port": port, "Tags": tags, "Meta": meta},
+	}
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	t.Run("passing instances with weights", func(t *testing.T) {
+		fake, server := newFakeConsul(t)
+		fake.set(
+			consulInstance("10.0.0.1", "", 8080, nil, nil),
+			consulInstance("10.0.0.9", "10.0.0.2", 8080, []string{"primary", "weight=3"}, nil),
+			consulInstance("10.0.0.3", "", 9090, []string{"weight=3"}, map[string]string{"weight": "5"}),
+		)
+
+		d, err := newConsulDiscoverer(&global.ConsulDiscovery{
+			Address:    server.URL,
+			Service:    "api",
+			Tag:        "primary",
+			Datacenter: "eu-1",
+			Token:      "acl-token",
+		})
+		if err != nil {
+			t.Fatalf("newConsulDiscoverer failed: %v", err)
+		}
+
+		upstreams, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatalf("discover failed: %v", err)
+		}
+
+		expected := []global.Upstream{
+			{URL: "http://10.0.0.1:8080"},
+			{URL: "http://10.0.0.2:8080", Weight: 3},
+			{URL: "http://10.0.0.3:9090", Weight: 5},
+		}
+		if len(upstreams) != len(expected) {
+			t.Fatalf("Expected %d upstreams, got %+v", len(expected), upstreams)
+		}
+		for i, u := range upstreams {
+			if u != expected[i] {
+				t.Errorf("Expected %+v, got %+v", expected[i], u)
+			}
+		}
+
+		fake.mu.Lock()
+		query := fake.query
+		fake.mu.Unlock()
+		if query["passing"] != "1" || query["tag"] != "primary" || query["dc"] != "eu-1" || query["token"] != "acl-token" {
+			t.Errorf("Unexpected query %v", query)
+		}
+	})
+
+	t.Run("blocking query returns on change", func(t *testing.T) {
+		fake, server := newFakeConsul(t)
+		fake.set(consulInstance("10.0.0.1", "", 8080, nil, nil))
+
+		d, err := newConsulDiscoverer(&global.ConsulDiscovery{Address: server.URL, Service: "api"})
+		if err != nil {
+			t.Fatalf("newConsulDiscoverer failed: %v", err)
+		}
+		if _, err := d.discover(context.Background()); err != nil {
+			t.Fatalf("discover failed: %v", err)
+		}
+
+		result := make(chan []global.Upstream, 1)
+		go func() {
+			upstreams, _ := d.discover(context.Background())
+			result <- upstreams
+		}()
+
+		select {
+		case <-result:
+			t.Fatal("Expected the query to block until the service changes")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		fake.set(
+			consulInstance("10.0.0.1", "", 8080, nil, nil),
+			consulInstance("10.0.0.2", "", 8080, nil, nil),
+		)
+
+		select {
+		case upstreams := <-result:
+			if len(upstreams) != 2 {
+				t.Errorf("Expected 2 upstreams after the change, got %+v", upstreams)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the blocking query")
+		}
+	})
+
+	t.Run("members follow the catalog", func(t *testing.T) {
+		fake, server := newFakeConsul(t)
+		fake.set(consulInstance("10.0.0.1", "", 8080, nil, nil))
+
+		lb := newDiscoveryBalancer(t)
+		if err := lb.StartDiscovery(&global.Discovery{Consul: &global.ConsulDiscovery{Address: server.URL, Service: "api"}}, nil); err != nil {
+			t.Fatalf("StartDiscovery failed: %v", err)
+		}
+		waitFor(t, func() bool { return len(memberURLs(lb)) == 1 })
+
+		fake.set(consulInstance("10.0.0.2", "", 8080, nil, nil))
+		waitFor(t, func() bool {
+			urls := memberURLs(lb)
+			return len(urls) == 1 && urls[0] == "http://10.0.0.2:8080"
+		})
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		testCases := []*global.ConsulDiscovery{
+			{},
+			{Service: "api", Address: "not a url"},
+			{Service: "api", Scheme: "grpc"},
+			{Service: "api", Wait: "forever"},
+		}
+		for _, cfg := range testCases {
+			if _, err := newConsulDiscoverer(cfg); err == nil {
+				t.Errorf("Expected error for %+v, got nil", cfg)
+			}
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Upstream states operators can set at runtime. A draining upstream gets no
+// new clients but keeps serving the ones pinned to it by sticky sessions, a
+// disabled one gets no traffic at all.
+const (
+	UpstreamActive   = "active"
+	UpstreamDraining = "draining"
+	UpstreamDisabled = "disabled"
+)
+
+const (
+	stateActive int32 = iota
+	stateDraining
+	stateDisabled
+)
+
+var stateNames = [...]string{
+	stateActive:   UpstreamActive,
+	stateDraining: UpstreamDraining,
+	stateDisabled: UpstreamDisabled,
+}
+
+// ErrUnknownUpstream is returned when a state change names an upstream the
+// load balancer or site doesn't have.
+var ErrUnknownUpstream = errors.New("unknown upstream")
+
+func parseState(name string) (int32, error) {
+	for state, n := range stateNames {
+		if n == name {
+			return int32(state), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid upstream state: %s", name)
+}
+
+// SetUpstreamState sets the state of the member with the given URL. An
+// upstream that goes back to active ramps up like a recovered one.
+func (lb *LoadBalancer) SetUpstreamState(rawURL, state string) error {
+	next, err := parseState(state)
+	if err != nil {
+		return err
+	}
+
+	var member *upstream
+	for _, u := range lb.members() {
+		if u.url.String() == rawURL {
+			member = u
+			break
+		}
+	}
+	if member == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownUpstream, rawURL)
+	}
+
+	previous := member.state.Swap(next)
+	if previous == next {
+		return nil
+	}
+
+	lb.logger.Info("Upstream state changed", "upstream", rawURL, "from", stateNames[previous], "to", state)
+	if next == stateActive {
+		lb.warm(member)
+	}
+	return nil
+}
+
+// PathStatus is a point-in-time view of one path of a site. Upstream is set
+// for paths proxied to a single upstream, Upstreams for load balanced ones,
+// and Pool when their load balancer is a shared pool.
+type PathStatus struct {
+	Path      string           `json:"path"`
+	Upstream  string           `json:"upstream,omitempty"`
+	Pool      string           `json:"pool,omitempty"`
+	Algorithm string           `json:"algorithm,omitempty"`
+	Upstreams []UpstreamStatus `json:"upstreams,omitempty"`
+}
+
+// SiteStatus is a point-in-time view of a site and its paths.
+type SiteStatus struct {
+	Domain string       `json:"domain"`
+	Paths  []PathStatus `json:"paths"`
+}
+
+// Status reports the paths of the site and the state of their upstreams.
+func (h *Handler) Status() SiteStatus {
+	status := SiteStatus{Domain: h.Site.Domain, Paths: make([]PathStatus, 0, len(h.routes))}
+	for _, r := range h.routes {
+		path := PathStatus{Path: r.path, Upstream: r.upstream, Pool: r.pool}
+		if r.lb != nil {
+			path.Algorithm = r.lb.algorithm
+			path.Upstreams = r.lb.Upstreams()
+		}
+		status.Paths = append(status.Paths, path)
+	}
+	return status
+}
+
+// SetUpstreamState sets the state of the upstream with the given URL on every
+// load balanced path of the site, or only on path when it isn't empty.
+func (h *Handler) SetUpstreamState(path, rawURL, state string) error {
+	if _, err := parseState(state); err != nil {
+		return err
+	}
+
+	found := false
+	for _, r := range h.routes {
+		if r.lb == nil || (path != "" && r.path != path) {
+			continue
+		}
+		err := r.lb.SetUpstreamState(rawURL, state)
+		if errors.Is(err, ErrUnknownUpstream) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("%w: %s", ErrUnknownUpstream, rawURL)
+	}
+	return nil
+}
+
+// KeepUpstreamStates copies the states operators set on the upstreams of
+// previous to the same upstreams of h, so a drained upstream stays drained
+// when its site is rebuilt. Pools keep their own states.
+func (h *Handler) KeepUpstreamStates(previous *Handler) {
+	states := make(map[string]map[string]int32)
+	for _, r := range previous.routes {
+		if r.lb == nil || r.pool != "" {
+			continue
+		}
+		for _, u := range r.lb.members() {
+			if state := u.state.Load(); state != stateActive {
+				if states[r.path] == nil {
+					states[r.path] = make(map[string]int32)
+				}
+				states[r.path][u.url.String()] = state
+			}
+		}
+	}
+
+	for _, r := range h.routes {
+		if r.lb == nil || r.pool != "" {
+			continue
+		}
+		for _, u := range r.lb.members() {
+			if state, ok := states[r.path][u.url.String()]; ok {
+				u.state.Store(state)
+			}
+		}
+	}
+}
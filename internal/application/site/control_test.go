@@ -0,0 +1,174 @@
+package site
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"reverse-proxy/internal/models/global"
+	"testing"
+)
+
+func TestUpstreamState(t *testing.T) {
+	t.Run("drain keeps pinned clients", func(t *testing.T) {
+		a := newNamedUpstream(t, "a")
+		b := newNamedUpstream(t, "b")
+		lb, proxy := newStickyProxy(t, []string{a.URL, b.URL})
+
+		first, cookie := send(proxy, nil)
+		drained := a.URL
+		if first == "b" {
+			drained = b.URL
+		}
+		if err := lb.SetUpstreamState(drained, UpstreamDraining); err != nil {
+			t.Fatalf("SetUpstreamState failed: %v", err)
+		}
+
+		if body, _ := send(proxy, cookie); body != first {
+			t.Errorf("Expected pinned client to stay on draining %s, got %s", first, body)
+		}
+		for i := 0; i < 4; i++ {
+			if body, _ := send(proxy, nil); body == first {
+				t.Errorf("Expected new clients to avoid draining %s", first)
+			}
+		}
+	})
+
+	t.Run("disable takes the upstream out completely", func(t *testing.T) {
+		a := newNamedUpstream(t, "a")
+		b := newNamedUpstream(t, "b")
+		lb, proxy := newStickyProxy(t, []string{a.URL, b.URL})
+
+		first, cookie := send(proxy, nil)
+		disabled := a.URL
+		if first == "b" {
+			disabled = b.URL
+		}
+		if err := lb.SetUpstreamState(disabled, UpstreamDisabled); err != nil {
+			t.Fatalf("SetUpstreamState failed: %v", err)
+		}
+
+		body, reissued := send(proxy, cookie)
+		if body == first || reissued == nil {
+			t.Errorf("Expected pinned client to be moved off disabled %s, got %s", first, body)
+		}
+
+		if err := lb.SetUpstreamState(disabled, UpstreamActive); err != nil {
+			t.Fatalf("SetUpstreamState failed: %v", err)
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			body, _ := send(proxy, nil)
+			seen[body] = true
+		}
+		if !seen[first] {
+			t.Errorf("Expected re-enabled %s to receive traffic again, got %v", first, seen)
+		}
+	})
+
+	t.Run("all disabled", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://a:80"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+		lb.SetUpstreamState("http://a:80", UpstreamDisabled)
+
+		if next := lb.Next(); next != nil {
+			t.Errorf("Expected no upstream while all are disabled, got %v", next)
+		}
+	})
+
+	t.Run("unknown upstream and state", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://a:80"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		if err := lb.SetUpstreamState("http://b:80", UpstreamDraining); !errors.Is(err, ErrUnknownUpstream) {
+			t.Errorf("Expected ErrUnknownUpstream, got %v", err)
+		}
+		if err := lb.SetUpstreamState("http://a:80", "paused"); err == nil {
+			t.Error("Expected error for invalid state, got nil")
+		}
+	})
+
+	t.Run("counters", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://a:80"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+		u := lb.members()[0]
+		lb.observe(u, 200, nil)
+		lb.observe(u, 503, nil)
+		lb.observe(u, 0, errors.New("connection refused"))
+
+		status := lb.Upstreams()[0]
+		if status.Requests != 3 || status.Failures != 2 {
+			t.Errorf("Expected 3 requests and 2 failures, got %d and %d", status.Requests, status.Failures)
+		}
+		if status.State != UpstreamActive {
+			t.Errorf("Expected state active, got %s", status.State)
+		}
+	})
+}
+
+func TestHandlerStatus(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	cfg := &global.SiteConfig{
+		Domain: "example.com",
+		Proxy: global.Proxy{
+			Paths: []global.ProxyPath{
+				{Path: "/api/", PathBase: global.PathBase{Upstreams: []global.Upstream{{URL: "http://a:80"}, {URL: "http://b:80"}}}},
+				{Path: "/", PathBase: global.PathBase{Upstream: "http://c:80"}},
+			},
+		},
+	}
+
+	t.Run("paths and upstreams", func(t *testing.T) {
+		h, err := NewSiteHandler(logger, cfg)
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		defer h.Close()
+
+		status := h.Status()
+		if status.Domain != "example.com" || len(status.Paths) != 2 {
+			t.Fatalf("Expected 2 paths for example.com, got %+v", status)
+		}
+		if api := status.Paths[0]; api.Path != "/api/" || api.Algorithm != "round-robin" || len(api.Upstreams) != 2 {
+			t.Errorf("Expected balanced /api/ with 2 upstreams, got %+v", api)
+		}
+		if root := status.Paths[1]; root.Upstream != "http://c:80" || root.Upstreams != nil {
+			t.Errorf("Expected single upstream for /, got %+v", root)
+		}
+	})
+
+	t.Run("states survive a rebuild", func(t *testing.T) {
+		previous, err := NewSiteHandler(logger, cfg)
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		defer previous.Close()
+
+		if err := previous.SetUpstreamState("", "http://c:80", UpstreamDraining); !errors.Is(err, ErrUnknownUpstream) {
+			t.Errorf("Expected ErrUnknownUpstream for a single upstream path, got %v", err)
+		}
+		if err := previous.SetUpstreamState("/api/", "http://b:80", UpstreamDraining); err != nil {
+			t.Fatalf("SetUpstreamState failed: %v", err)
+		}
+
+		current, err := NewSiteHandler(logger, cfg)
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		defer current.Close()
+		current.KeepUpstreamStates(previous)
+
+		states := make(map[string]string)
+		for _, u := range current.Status().Paths[0].Upstreams {
+			states[u.URL] = u.State
+		}
+		if states["http://a:80"] != UpstreamActive || states["http://b:80"] != UpstreamDraining {
+			t.Errorf("Expected b to stay draining, got %v", states)
+		}
+	})
+}
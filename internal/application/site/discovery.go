@@ -0,0 +1,179 @@
+package site
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"reverse-proxy/internal/models/global"
+	"time"
+)
+
+// lookupTimeout bounds a single discovery lookup.
+const lookupTimeout = 10 * time.Second
+
+// discoverer finds upstreams in a source outside the site configuration.
+type discoverer interface {
+	// discover returns the upstreams the source currently lists.
+	discover(ctx context.Context) ([]global.Upstream, error)
+	// interval returns the time between lookups.
+	interval() time.Duration
+	String() string
+}
+
+// blockingDiscoverer is implemented by discoverers whose lookups wait for a
+// change, which lookupTimeout must leave time for.
+type blockingDiscoverer interface {
+	wait() time.Duration
+}
+
+// authoritativeDiscoverer is implemented by discoverers whose sources list
+// their upstreams explicitly, so finding none means there are none rather
+// than that the source is having trouble.
+type authoritativeDiscoverer interface {
+	authoritative() bool
+}
+
+func newDiscoverer(cfg *global.Discovery) (discoverer, error) {
+	sources := 0
+	for _, set := range []bool{cfg.DNS != nil, cfg.File != nil, cfg.Consul != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("only one discovery source may be configured")
+	}
+
+	switch {
+	case cfg.DNS != nil:
+		return newDNSDiscoverer(cfg.DNS)
+	case cfg.File != nil:
+		return newFileDiscoverer(cfg.File)
+	case cfg.Consul != nil:
+		return newConsulDiscoverer(cfg.Consul)
+	default:
+		return nil, fmt.Errorf("no discovery source configured")
+	}
+}
+
+// StartDiscovery keeps the primary members of the load balancer in sync with
+// the upstreams found by the configured source, on top of the static ones.
+// Lookups run in the background, the first one right away, so a slow source
+// doesn't hold up building the site. Until one succeeds only the static
+// members are used, see KeepDiscovered.
+func (lb *LoadBalancer) StartDiscovery(cfg *global.Discovery, static []global.Upstream) error {
+	d, err := newDiscoverer(cfg)
+	if err != nil {
+		return err
+	}
+
+	lb.discovery = cfg
+	lb.static = static
+	go lb.runDiscovery(d, static)
+	return nil
+}
+
+func (lb *LoadBalancer) runDiscovery(d discoverer, static []global.Upstream) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-lb.stop
+		cancel()
+	}()
+
+	// The first members aren't added to a running load balancer
+	lb.refresh(ctx, d, static, false)
+
+	ticker := time.NewTicker(d.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C:
+		}
+
+		lb.refresh(ctx, d, static, true)
+	}
+}
+
+// refresh looks the upstreams up and makes them the members. The current
+// members are kept when the lookup fails, or finds nothing in a source that
+// isn't authoritative, so a flaky source doesn't take the site down. An
+// authoritative source finding nothing leaves only the static members.
+func (lb *LoadBalancer) refresh(ctx context.Context, d discoverer, static []global.Upstream, warm bool) {
+	timeout := lookupTimeout
+	if b, ok := d.(blockingDiscoverer); ok {
+		timeout += b.wait()
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	found, err := d.discover(ctx)
+	if err != nil {
+		lb.logger.Error("Upstream discovery failed, keeping current members", "source", d.String(), "error", err)
+		return
+	}
+	if len(found) == 0 {
+		if a, ok := d.(authoritativeDiscoverer); !ok || !a.authoritative() {
+			lb.logger.Warn("Upstream discovery found nothing, keeping current members", "source", d.String())
+			return
+		}
+		lb.logger.Warn("Upstream discovery lists no upstreams", "source", d.String())
+	}
+
+	upstreams := make([]global.Upstream, 0, len(static)+len(found))
+	upstreams = append(upstreams, static...)
+	upstreams = append(upstreams, found...)
+	if err := lb.setUpstreams(upstreams, warm); err != nil {
+		lb.logger.Error("Failed to apply discovered upstreams", "source", d.String(), "error", err)
+		return
+	}
+	lb.discovered.Store(true)
+}
+
+// KeepDiscovered gives the load balancers of h the members that previous
+// discovered for the same path with the same source, until their own first
+// lookup succeeds, so a rebuilt site doesn't fall back to its static members
+// meanwhile. Pools are left out, see Inherit.
+func (h *Handler) KeepDiscovered(previous *Handler) {
+	for _, r := range h.routes {
+		if r.lb == nil || r.pool != "" {
+			continue
+		}
+		for _, p := range previous.routes {
+			if p.path == r.path && p.lb != nil && p.pool == "" {
+				r.lb.adoptDiscovered(p.lb)
+			}
+		}
+	}
+}
+
+// adoptDiscovered makes the members previous discovered members of lb, next
+// to its own static ones, unless lb has discovered its own already or
+// discovers them differently.
+func (lb *LoadBalancer) adoptDiscovered(previous *LoadBalancer) {
+	if lb.discovery == nil || lb.discovered.Load() || !previous.discovered.Load() || !reflect.DeepEqual(lb.discovery, previous.discovery) {
+		return
+	}
+
+	static := make(map[string]bool, len(previous.static))
+	for _, cfg := range previous.static {
+		if member, err := newUpstream(cfg); err == nil {
+			static[member.url.String()] = true
+		}
+	}
+
+	upstreams := append([]global.Upstream(nil), lb.static...)
+	previous.mu.Lock()
+	for _, u := range previous.upstreams {
+		if !u.backup && !static[u.url.String()] {
+			upstreams = append(upstreams, global.Upstream{URL: u.url.String(), Weight: u.weight})
+		}
+	}
+	previous.mu.Unlock()
+	if err := lb.setUpstreams(upstreams, false); err != nil {
+		lb.logger.Error("Failed to keep discovered upstreams", "error", err)
+	}
+}
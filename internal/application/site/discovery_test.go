@@ -0,0 +1,70 @@
+package site
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"testing"
+	"time"
+)
+
+func TestStartDiscovery(t *testing.T) {
+	t.Run("slow source doesn't hold up the start", func(t *testing.T) {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+		defer slow.Close()
+		defer close(release)
+
+		static := []global.Upstream{{URL: "http://10.0.0.1:8080"}}
+		lb := newDiscoveryBalancer(t)
+		if err := lb.setUpstreams(static, false); err != nil {
+			t.Fatalf("setUpstreams failed: %v", err)
+		}
+
+		start := time.Now()
+		cfg := &global.Discovery{Consul: &global.ConsulDiscovery{Address: slow.URL, Service: "api"}}
+		if err := lb.StartDiscovery(cfg, static); err != nil {
+			t.Fatalf("StartDiscovery failed: %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Expected StartDiscovery to return right away, took %v", elapsed)
+		}
+		if urls := memberURLs(lb); len(urls) != 1 || urls[0] != "http://10.0.0.1:8080" {
+			t.Errorf("Expected the static member meanwhile, got %v", urls)
+		}
+	})
+
+	t.Run("rebuilt load balancers keep the discovered members", func(t *testing.T) {
+		cfg := &global.Discovery{DNS: &global.DNSDiscovery{Name: "api.internal", Port: 8080}}
+		static := []global.Upstream{{URL: "http://10.0.0.1:8080"}}
+
+		previous := newDiscoveryBalancer(t)
+		previous.discovery, previous.static = cfg, static
+		if err := previous.setUpstreams(append(static, global.Upstream{URL: "http://10.0.0.2:8080", Weight: 3}), false); err != nil {
+			t.Fatalf("setUpstreams failed: %v", err)
+		}
+		previous.discovered.Store(true)
+
+		lb := newDiscoveryBalancer(t)
+		lb.discovery, lb.static = &global.Discovery{DNS: &global.DNSDiscovery{Name: "api.internal", Port: 8080}}, nil
+		lb.adoptDiscovered(previous)
+
+		statuses := lb.Upstreams()
+		if len(statuses) != 1 || statuses[0].URL != "http://10.0.0.2:8080" || statuses[0].Weight != 3 {
+			t.Errorf("Expected only the discovered member, got %+v", statuses)
+		}
+
+		other := newDiscoveryBalancer(t)
+		other.discovery = &global.Discovery{DNS: &global.DNSDiscovery{Name: "web.internal", Port: 8080}}
+		other.adoptDiscovered(previous)
+		if urls := memberURLs(other); len(urls) != 0 {
+			t.Errorf("Expected nothing from another source, got %v", urls)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package site
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reverse-proxy/internal/models/global"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolver is the part of *net.Resolver that DNS discovery uses.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// dnsDiscoverer holds the parsed form of a global.DNSDiscovery.
+type dnsDiscoverer struct {
+	name     string
+	srv      bool
+	port     int
+	scheme   string
+	every    time.Duration
+	resolver resolver
+}
+
+func newDNSDiscoverer(cfg *global.DNSDiscovery) (*dnsDiscoverer, error) {
+	d := &dnsDiscoverer{
+		name:     cfg.Name,
+		port:     cfg.Port,
+		scheme:   "http",
+		every:    30 * time.Second,
+		resolver: net.DefaultResolver,
+	}
+
+	if d.name == "" {
+		return nil, fmt.Errorf("dns discovery needs a name")
+	}
+
+	switch strings.ToUpper(cfg.Type) {
+	case "", "A":
+		if d.port < 1 || d.port > 65535 {
+			return nil, fmt.Errorf("invalid dns discovery port: %d", cfg.Port)
+		}
+	case "SRV":
+		d.srv = true
+	default:
+		return nil, fmt.Errorf("invalid dns discovery type: %s", cfg.Type)
+	}
+
+	if cfg.Scheme != "" {
+		if cfg.Scheme != "http" && cfg.Scheme != "https" {
+			return nil, fmt.Errorf("invalid dns discovery scheme: %s", cfg.Scheme)
+		}
+		d.scheme = cfg.Scheme
+	}
+
+	var err error
+	if cfg.Interval != "" {
+		if d.every, err = time.ParseDuration(cfg.Interval); err != nil || d.every <= 0 {
+			return nil, fmt.Errorf("invalid dns discovery interval: %s", cfg.Interval)
+		}
+	}
+
+	if cfg.Resolver != "" {
+		if _, _, err := net.SplitHostPort(cfg.Resolver); err != nil {
+			return nil, fmt.Errorf("invalid dns resolver address: %s", cfg.Resolver)
+		}
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, cfg.Resolver)
+			},
+		}
+	}
+
+	return d, nil
+}
+
+func (d *dnsDiscoverer) interval() time.Duration {
+	return d.every
+}
+
+func (d *dnsDiscoverer) String() string {
+	return "dns:" + d.name
+}
+
+// discover resolves the name into upstreams, sorted so that unchanged
+// records produce an unchanged list.
+func (d *dnsDiscoverer) discover(ctx context.Context) ([]global.Upstream, error) {
+	var upstreams []global.Upstream
+
+	if d.srv {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the most preferred priority is used, lower ones are fallbacks
+		// in SRV terms
+		for _, srv := range records {
+			if srv.Priority != records[0].Priority {
+				continue
+			}
+			host := strings.TrimSuffix(srv.Target, ".")
+			upstreams = append(upstreams, global.Upstream{
+				URL:    d.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+				Weight: int(srv.Weight),
+			})
+		}
+	} else {
+		addrs, err := d.resolver.LookupIPAddr(ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			upstreams = append(upstreams, global.Upstream{
+				URL: d.scheme + "://" + net.JoinHostPort(addr.IP.String(), strconv.Itoa(d.port)),
+			})
+		}
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool {
+		return upstreams[i].URL < upstreams[j].URL
+	})
+	return upstreams, nil
+}
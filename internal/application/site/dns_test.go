@@ -0,0 +1,229 @@
+package site
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"reverse-proxy/internal/models/global"
+	"sync"
+	"testing"
+)
+
+// fakeResolver stands in for the system resolver with records set by the
+// test.
+type fakeResolver struct {
+	mu    sync.Mutex
+	addrs []net.IPAddr
+	srv   []*net.SRV
+	err   error
+}
+
+func (f *fakeResolver) set(addrs []string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.addrs = nil
+	for _, a := range addrs {
+		f.addrs = append(f.addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	f.err = err
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addrs, f.err
+}
+
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return name, f.srv, f.err
+}
+
+func newDiscoveryBalancer(t *testing.T) *LoadBalancer {
+	t.Helper()
+	lb, err := newBalancer(nil, "round-robin")
+	if err != nil {
+		t.Fatalf("newBalancer failed: %v", err)
+	}
+	lb.logger = slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	t.Cleanup(lb.Close)
+	return lb
+}
+
+func memberURLs(lb *LoadBalancer) []string {
+	var urls []string
+	for _, status := range lb.Upstreams() {
+		urls = append(urls, status.URL)
+	}
+	return urls
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	t.Run("address records become members", func(t *testing.T) {
+		d, err := newDNSDiscoverer(&global.DNSDiscovery{Name: "api.internal", Port: 8080})
+		if err != nil {
+			t.Fatalf("newDNSDiscoverer failed: %v", err)
+		}
+		fake := &fakeResolver{}
+		fake.set([]string{"10.0.0.2", "2001:db8::1", "10.0.0.1"}, nil)
+		d.resolver = fake
+
+		upstreams, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatalf("discover failed: %v", err)
+		}
+
+		expected := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://[2001:db8::1]:8080"}
+		if len(upstreams) != len(expected) {
+			t.Fatalf("Expected %d upstreams, got %d", len(expected), len(upstreams))
+		}
+		for i, u := range upstreams {
+			if u.URL != expected[i] {
+				t.Errorf("Expected upstream %s, got %s", expected[i], u.URL)
+			}
+		}
+	})
+
+	t.Run("srv records of the best priority", func(t *testing.T) {
+		d, err := newDNSDiscoverer(&global.DNSDiscovery{Name: "_api._tcp.internal", Type: "srv", Scheme: "https"})
+		if err != nil {
+			t.Fatalf("newDNSDiscoverer failed: %v", err)
+		}
+		d.resolver = &fakeResolver{srv: []*net.SRV{
+			{Target: "a.internal.", Port: 9000, Priority: 10, Weight: 3},
+			{Target: "b.internal.", Port: 9001, Priority: 10, Weight: 1},
+			{Target: "standby.internal.", Port: 9000, Priority: 20, Weight: 1},
+		}}
+
+		upstreams, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatalf("discover failed: %v", err)
+		}
+
+		if len(upstreams) != 2 {
+			t.Fatalf("Expected 2 upstreams, got %+v", upstreams)
+		}
+		if upstreams[0].URL != "https://a.internal:9000" || upstreams[0].Weight != 3 {
+			t.Errorf("Expected https://a.internal:9000 with weight 3, got %+v", upstreams[0])
+		}
+		if upstreams[1].URL != "https://b.internal:9001" {
+			t.Errorf("Expected https://b.internal:9001, got %+v", upstreams[1])
+		}
+	})
+
+	t.Run("members follow the records", func(t *testing.T) {
+		lb := newDiscoveryBalancer(t)
+		d, err := newDNSDiscoverer(&global.DNSDiscovery{Name: "api.internal", Port: 80, Interval: "10ms"})
+		if err != nil {
+			t.Fatalf("newDNSDiscoverer failed: %v", err)
+		}
+		fake := &fakeResolver{}
+		fake.set([]string{"10.0.0.1", "10.0.0.2"}, nil)
+		d.resolver = fake
+
+		static := []global.Upstream{{URL: "http://static:80"}}
+		lb.refresh(context.Background(), d, static, false)
+		if urls := memberURLs(lb); len(urls) != 3 {
+			t.Fatalf("Expected static and 2 discovered members, got %v", urls)
+		}
+		kept := lb.upstreams[1]
+		kept.ejected.Store(true)
+
+		go lb.runDiscovery(d, static)
+
+		fake.set([]string{"10.0.0.1", "10.0.0.3"}, nil)
+		waitFor(t, func() bool {
+			urls := memberURLs(lb)
+			return len(urls) == 3 && urls[2] == "http://10.0.0.3:80"
+		})
+
+		if members := lb.members(); members[1] != kept || !members[1].ejected.Load() {
+			t.Error("Expected the remaining member to keep its state")
+		}
+	})
+
+	t.Run("failed or empty lookups keep the members", func(t *testing.T) {
+		lb := newDiscoveryBalancer(t)
+		d, err := newDNSDiscoverer(&global.DNSDiscovery{Name: "api.internal", Port: 80})
+		if err != nil {
+			t.Fatalf("newDNSDiscoverer failed: %v", err)
+		}
+		fake := &fakeResolver{}
+		fake.set([]string{"10.0.0.1"}, nil)
+		d.resolver = fake
+		lb.refresh(context.Background(), d, nil, false)
+
+		fake.set(nil, errors.New("server misbehaving"))
+		lb.refresh(context.Background(), d, nil, true)
+		fake.set(nil, nil)
+		lb.refresh(context.Background(), d, nil, true)
+
+		if urls := memberURLs(lb); len(urls) != 1 || urls[0] != "http://10.0.0.1:80" {
+			t.Errorf("Expected the last known member, got %v", urls)
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		testCases := []*global.DNSDiscovery{
+			{Port: 80},
+			{Name: "api.internal"},
+			{Name: "api.internal", Port: 80, Type: "MX"},
+			{Name: "api.internal", Port: 80, Scheme: "ftp"},
+			{Name: "api.internal", Port: 80, Interval: "often"},
+			{Name: "api.internal", Port: 80, Resolver: "10.0.0.53"},
+		}
+		for _, cfg := range testCases {
+			if _, err := newDNSDiscoverer(cfg); err == nil {
+				t.Errorf("Expected error for %+v, got nil", cfg)
+			}
+		}
+	})
+}
+
+func TestSetUpstreams(t *testing.T) {
+	lb, err := NewLoadBalancer([]string{"http://localhost:3000", "http://localhost:3001"}, "hash")
+	if err != nil {
+		t.Fatalf("NewLoadBalancer failed: %v", err)
+	}
+	lb.logger = slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	if err := lb.AddBackups([]global.Upstream{{URL: "http://backup:3000"}}); err != nil {
+		t.Fatalf("AddBackups failed: %v", err)
+	}
+
+	removed := lb.upstreams[0]
+	removed.inflight.Add(1)
+
+	if err := lb.SetUpstreams([]global.Upstream{
+		{URL: "http://localhost:3001", Weight: 2},
+		{URL: "http://localhost:3002"},
+		{URL: "http://localhost:3002"},
+	}); err != nil {
+		t.Fatalf("SetUpstreams failed: %v", err)
+	}
+
+	statuses := lb.Upstreams()
+	expected := []string{"http://localhost:3001", "http://localhost:3002", "http://backup:3000"}
+	if len(statuses) != len(expected) {
+		t.Fatalf("Expected members %v, got %+v", expected, statuses)
+	}
+	for i, status := range statuses {
+		if status.URL != expected[i] {
+			t.Errorf("Expected member %s, got %s", expected[i], status.URL)
+		}
+	}
+	if statuses[0].Weight != 2 {
+		t.Errorf("Expected updated weight 2, got %d", statuses[0].Weight)
+	}
+
+	// The removed member no longer gets picked but its request finishes
+	for i := 0; i < 20; i++ {
+		if u := lb.pick(nil, nil); u == removed {
+			t.Fatal("Expected removed member not to be picked")
+		}
+	}
+	removed.inflight.Add(-1)
+}
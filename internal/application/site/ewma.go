@@ -0,0 +1,99 @@
+package site
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// ewmaDecay is the time constant of the latency moving average: a sample
+// loses about two thirds of its influence after this long.
+const ewmaDecay = 10 * time.Second
+
+// ewmaPenalty is the latency a failed attempt counts as at least. A refused
+// connection fails within a millisecond and would otherwise make a dead
+// upstream look like the fastest.
+const ewmaPenalty = time.Second
+
+// recordLatency folds the duration of a request to u into its moving average.
+func (lb *LoadBalancer) recordLatency(u *upstream, latency time.Duration) {
+	now := time.Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.lastSample.IsZero() {
+		u.ewma = float64(latency)
+	} else {
+		// Weight the old average by how long ago it was updated, so a burst of
+		// samples doesn't wipe out history and an idle upstream's average
+		// converges on its latest sample
+		w := math.Exp(-float64(now.Sub(u.lastSample)) / float64(ewmaDecay))
+		u.ewma = u.ewma*w + float64(latency)*(1-w)
+	}
+	u.lastSample = now
+}
+
+// recordFailure is recordLatency for an attempt that failed after latency,
+// which counts as at least ewmaPenalty.
+func (lb *LoadBalancer) recordFailure(u *upstream, latency time.Duration) {
+	lb.recordLatency(u, max(latency, ewmaPenalty))
+}
+
+// latency returns the moving average of u and whether it has samples.
+func (u *upstream) latency() (float64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.ewma, !u.lastSample.IsZero()
+}
+
+// cost estimates how long a new request to u would take to complete.
+// Upstreams without samples are taken to be as fast as unsampled, so their
+// in-flight requests still count.
+func (u *upstream) cost(unsampled float64) float64 {
+	ewma, sampled := u.latency()
+	if !sampled {
+		ewma = unsampled
+	}
+	return ewma * float64(u.inflight.Load()+1)
+}
+
+// unsampledLatency returns the latency assumed for candidates without
+// samples: the mean of the others, or 1 when none has any.
+func unsampledLatency(candidates []*upstream) float64 {
+	var sum float64
+	var n int
+	for _, u := range candidates {
+		if ewma, sampled := u.latency(); sampled {
+			sum += ewma
+			n++
+		}
+	}
+	if n == 0 || sum == 0 {
+		return 1
+	}
+	return sum / float64(n)
+}
+
+// p2cEWMA picks two random candidates and returns the one with the lower
+// cost, which avoids slow upstreams without herding onto the single fastest.
+// The cost of a warming upstream is raised by the share it lacks.
+func (lb *LoadBalancer) p2cEWMA(candidates []*upstream) *upstream {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := candidates[i], candidates[j]
+	unsampled := unsampledLatency(candidates)
+	if b.cost(unsampled)/lb.share(b) < a.cost(unsampled)/lb.share(a) {
+		return b
+	}
+	return a
+}
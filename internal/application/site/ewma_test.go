@@ -0,0 +1,123 @@
+package site
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordLatency(t *testing.T) {
+	t.Run("first sample sets the average", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://localhost:3000"}, "p2c-ewma")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		u := lb.upstreams[0]
+		lb.recordLatency(u, 100*time.Millisecond)
+
+		if u.ewma != float64(100*time.Millisecond) {
+			t.Errorf("Expected average 100ms, got %v", time.Duration(u.ewma))
+		}
+	})
+
+	t.Run("average moves towards new samples", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://localhost:3000"}, "p2c-ewma")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		u := lb.upstreams[0]
+		lb.recordLatency(u, 100*time.Millisecond)
+		u.lastSample = time.Now().Add(-ewmaDecay)
+		lb.recordLatency(u, 10*time.Millisecond)
+
+		if u.ewma >= float64(100*time.Millisecond) || u.ewma <= float64(10*time.Millisecond) {
+			t.Errorf("Expected average between 10ms and 100ms, got %v", time.Duration(u.ewma))
+		}
+	})
+}
+
+func TestP2CEWMA(t *testing.T) {
+	t.Run("prefers the faster upstream", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://fast:3000",
+			"http://slow:3000",
+		}, "p2c-ewma")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		lb.recordLatency(lb.upstreams[0], 5*time.Millisecond)
+		lb.recordLatency(lb.upstreams[1], 500*time.Millisecond)
+
+		// With two candidates both are always compared
+		for i := 0; i < 10; i++ {
+			if target := lb.Next(); target.String() != "http://fast:3000" {
+				t.Errorf("Expected fast upstream, got %s", target)
+			}
+		}
+	})
+
+	t.Run("in-flight requests raise the cost", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://busy:3000",
+			"http://idle:3000",
+		}, "p2c-ewma")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		lb.recordLatency(lb.upstreams[0], 10*time.Millisecond)
+		lb.recordLatency(lb.upstreams[1], 20*time.Millisecond)
+		lb.upstreams[0].inflight.Store(10)
+
+		if target := lb.Next(); target.String() != "http://idle:3000" {
+			t.Errorf("Expected idle upstream, got %s", target)
+		}
+	})
+
+	t.Run("unsampled upstreams count their in-flight requests", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://sampled:3000",
+			"http://new:3000",
+		}, "p2c-ewma")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		lb.recordLatency(lb.upstreams[0], 10*time.Millisecond)
+		lb.upstreams[1].inflight.Store(10)
+
+		if target := lb.Next(); target.String() != "http://sampled:3000" {
+			t.Errorf("Expected sampled upstream, got %s", target)
+		}
+	})
+
+	t.Run("failures count as slow", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://dead:3000",
+			"http://healthy:3000",
+		}, "p2c-ewma")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		lb.recordFailure(lb.upstreams[0], time.Millisecond)
+		lb.recordLatency(lb.upstreams[1], 50*time.Millisecond)
+
+		if target := lb.Next(); target.String() != "http://healthy:3000" {
+			t.Errorf("Expected healthy upstream, got %s", target)
+		}
+	})
+
+	t.Run("single candidate", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://only:3000"}, "p2c-ewma")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		if target := lb.Next(); target.String() != "http://only:3000" {
+			t.Errorf("Expected only upstream, got %s", target)
+		}
+	})
+}
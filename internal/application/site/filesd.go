@@ -0,0 +1,126 @@
+package site
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reverse-proxy/internal/models/global"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// targetGroup is one entry of a file_sd file. A "weight" label sets the
+// weight of every target in the group.
+type targetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// fileDiscoverer holds the parsed form of a global.FileDiscovery.
+type fileDiscoverer struct {
+	path   string
+	scheme string
+	every  time.Duration
+}
+
+func newFileDiscoverer(cfg *global.FileDiscovery) (*fileDiscoverer, error) {
+	d := &fileDiscoverer{
+		path:   cfg.Path,
+		scheme: "http",
+		every:  5 * time.Second,
+	}
+
+	if d.path == "" {
+		return nil, fmt.Errorf("file discovery needs a path")
+	}
+
+	if cfg.Scheme != "" {
+		if cfg.Scheme != "http" && cfg.Scheme != "https" {
+			return nil, fmt.Errorf("invalid file discovery scheme: %s", cfg.Scheme)
+		}
+		d.scheme = cfg.Scheme
+	}
+
+	var err error
+	if cfg.Interval != "" {
+		if d.every, err = time.ParseDuration(cfg.Interval); err != nil || d.every <= 0 {
+			return nil, fmt.Errorf("invalid file discovery interval: %s", cfg.Interval)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *fileDiscoverer) interval() time.Duration {
+	return d.every
+}
+
+func (d *fileDiscoverer) String() string {
+	return "file:" + d.path
+}
+
+// authoritative is true: a file listing no targets, such as [], is meant to
+// drain the pool.
+func (d *fileDiscoverer) authoritative() bool {
+	return true
+}
+
+// discover reads the target file. JSON is valid YAML, so both are parsed the
+// same way. A file without any content is an error rather than an empty
+// list, as it may be in the middle of being written.
+func (d *fileDiscoverer) discover(ctx context.Context) ([]global.Upstream, error) {
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, fmt.Errorf("%s is empty", d.path)
+	}
+
+	var groups []targetGroup
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", d.path, err)
+	}
+
+	var upstreams []global.Upstream
+	for _, group := range groups {
+		weight := 0
+		if raw, ok := group.Labels["weight"]; ok {
+			if weight, err = strconv.Atoi(raw); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight label in %s: %s", d.path, raw)
+			}
+		}
+
+		for _, target := range group.Targets {
+			u, err := d.targetURL(target)
+			if err != nil {
+				return nil, err
+			}
+			upstreams = append(upstreams, global.Upstream{URL: u, Weight: weight})
+		}
+	}
+	return upstreams, nil
+}
+
+// targetURL turns a target, either a URL or a host:port, into an upstream
+// URL.
+func (d *fileDiscoverer) targetURL(target string) (string, error) {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid target in %s: %s", d.path, target)
+		}
+		return target, nil
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", fmt.Errorf("invalid target in %s: %s", d.path, target)
+	}
+	return d.scheme + "://" + target, nil
+}
@@ -0,0 +1,183 @@
+package site
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/models/global"
+	"testing"
+	"time"
+)
+
+func writeTargets(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write targets file: %v", err)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	t.Run("json targets", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "targets.json")
+		writeTargets(t, path, `[
+  {"targets": ["10.0.0.1:8080", "10.0.0.2:8080"]},
+  {"targets": ["https://canary.internal"], "labels": {"weight": "3"}}
+]`)
+
+		d, err := newFileDiscoverer(&global.FileDiscovery{Path: path})
+		if err != nil {
+			t.Fatalf("newFileDiscoverer failed: %v", err)
+		}
+
+		upstreams, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatalf("discover failed: %v", err)
+		}
+
+		expected := []global.Upstream{
+			{URL: "http://10.0.0.1:8080"},
+			{URL: "http://10.0.0.2:8080"},
+			{URL: "https://canary.internal", Weight: 3},
+		}
+		if len(upstreams) != len(expected) {
+			t.Fatalf("Expected %d upstreams, got %+v", len(expected), upstreams)
+		}
+		for i, u := range upstreams {
+			if u != expected[i] {
+				t.Errorf("Expected %+v, got %+v", expected[i], u)
+			}
+		}
+	})
+
+	t.Run("yaml targets", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "targets.yml")
+		writeTargets(t, path, `- targets:
+    - api-1.internal:443
+    - api-2.internal:443
+  labels:
+    weight: "2"`)
+
+		d, err := newFileDiscoverer(&global.FileDiscovery{Path: path, Scheme: "https"})
+		if err != nil {
+			t.Fatalf("newFileDiscoverer failed: %v", err)
+		}
+
+		upstreams, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatalf("discover failed: %v", err)
+		}
+
+		if len(upstreams) != 2 || upstreams[1].URL != "https://api-2.internal:443" || upstreams[1].Weight != 2 {
+			t.Errorf("Expected 2 https upstreams with weight 2, got %+v", upstreams)
+		}
+	})
+
+	t.Run("invalid files", func(t *testing.T) {
+		dir := t.TempDir()
+		testCases := map[string]string{
+			"not a list":     `targets: ["10.0.0.1:80"]`,
+			"missing port":   `[{"targets": ["10.0.0.1"]}]`,
+			"invalid weight": `[{"targets": ["10.0.0.1:80"], "labels": {"weight": "heavy"}}]`,
+			"no content":     "\n",
+		}
+
+		for name, content := range testCases {
+			path := filepath.Join(dir, "targets.json")
+			writeTargets(t, path, content)
+
+			d, err := newFileDiscoverer(&global.FileDiscovery{Path: path})
+			if err != nil {
+				t.Fatalf("newFileDiscoverer failed: %v", err)
+			}
+			if _, err := d.discover(context.Background()); err == nil {
+				t.Errorf("Expected error for %s, got nil", name)
+			}
+		}
+
+		d, _ := newFileDiscoverer(&global.FileDiscovery{Path: filepath.Join(dir, "missing.json")})
+		if _, err := d.discover(context.Background()); err == nil {
+			t.Error("Expected error for missing file, got nil")
+		}
+	})
+
+	t.Run("membership is updated in place", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "targets.json")
+		writeTargets(t, path, `[{"targets": ["10.0.0.1:8080"]}]`)
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		cfg := &global.SiteConfig{Domain: "example.com"}
+		cfg.Proxy.Discovery = &global.Discovery{File: &global.FileDiscovery{Path: path, Interval: "10ms"}}
+
+		h, err := NewSiteHandler(logger, cfg)
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		defer h.Close()
+
+		lb := h.lb
+		waitFor(t, func() bool {
+			urls := memberURLs(lb)
+			return len(urls) == 1 && urls[0] == "http://10.0.0.1:8080"
+		})
+
+		writeTargets(t, path, `[{"targets": ["10.0.0.1:8080", "10.0.0.2:8080"]}]`)
+		waitFor(t, func() bool { return len(memberURLs(lb)) == 2 })
+
+		if h.lb != lb {
+			t.Error("Expected the load balancer to be kept")
+		}
+	})
+
+	t.Run("an empty target list drains the pool", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "targets.json")
+		writeTargets(t, path, `[{"targets": ["10.0.0.1:8080"]}]`)
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		cfg := &global.SiteConfig{Domain: "example.com"}
+		cfg.Proxy.Upstreams = []global.Upstream{{URL: "http://10.0.0.9:8080"}}
+		cfg.Proxy.Discovery = &global.Discovery{File: &global.FileDiscovery{Path: path, Interval: "10ms"}}
+
+		h, err := NewSiteHandler(logger, cfg)
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		defer h.Close()
+
+		lb := h.lb
+		waitFor(t, func() bool { return len(memberURLs(lb)) == 2 })
+
+		// A broken file keeps the members, an explicitly empty one removes
+		// the discovered ones
+		writeTargets(t, path, "")
+		time.Sleep(50 * time.Millisecond)
+		if urls := memberURLs(lb); len(urls) != 2 {
+			t.Errorf("Expected the members to be kept while the file is empty, got %v", urls)
+		}
+
+		writeTargets(t, path, "[]")
+		waitFor(t, func() bool {
+			urls := memberURLs(lb)
+			return len(urls) == 1 && urls[0] == "http://10.0.0.9:8080"
+		})
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		testCases := []*global.Discovery{
+			{},
+			{File: &global.FileDiscovery{}},
+			{File: &global.FileDiscovery{Path: "targets.json", Scheme: "tcp"}},
+			{File: &global.FileDiscovery{Path: "targets.json", Interval: "never"}},
+			{
+				DNS:  &global.DNSDiscovery{Name: "api.internal", Port: 80},
+				File: &global.FileDiscovery{Path: "targets.json"},
+			},
+		}
+		for _, cfg := range testCases {
+			if _, err := newDiscoverer(cfg); err == nil {
+				t.Errorf("Expected error for %+v, got nil", cfg)
+			}
+		}
+	})
+}
@@ -4,14 +4,12 @@ package site
 
 import (
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
 	"reverse-proxy/internal/models/global"
-	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -58,218 +56,264 @@ type Handler struct {
 	Handler http.Handler
 	Logger  *slog.Logger
 	lb      *LoadBalancer
+
+	// routes holds every path of the site with its upstream or load
+	// balancer, including the per-path ones, so Close can stop their
+	// background work and Status can report them.
+	routes []route
+
+	// applied is Site with the upstreams UpdateUpstreams set since. Only the
+	// manager uses it, under its lock.
+	applied *global.SiteConfig
 }
 
-type LoadBalancer struct {
-	upstreams    []*url.URL
-	algorithm    string
-	currentIndex uint64
-	mu           sync.Mutex
+// route is a path of a site and where it is proxied to. The whole site is
+// the path "/". Routes to a pool share its load balancer, which the site
+// doesn't own.
+type route struct {
+	path     string
+	upstream string
+	pool     string
+	lb       *LoadBalancer
 }
 
-func NewLoadBalancer(upstreams []string, algorithm string) (*LoadBalancer, error) {
-	lb := &LoadBalancer{
-		algorithm: algorithm,
+// UpdateUpstreams reports whether cfg only differs from the configuration of
+// h in the upstreams of paths with a load balancer of their own, and if so
+// gives those load balancers the new upstreams. Their members keep their
+// counters, latencies, breakers and in-flight requests, which rebuilding the
+// site would reset. Paths with discovery, or that gain or lose upstreams of
+// their own, need a rebuild.
+func (h *Handler) UpdateUpstreams(cfg *global.SiteConfig) bool {
+	current := h.applied
+	if !reflect.DeepEqual(withoutUpstreams(current), withoutUpstreams(cfg)) {
+		return false
 	}
 
-	for _, upstream := range upstreams {
-		u, err := url.Parse(upstream)
-		if err != nil {
-			return nil, fmt.Errorf("invalid upstream URL: %s", upstream)
+	// A site without paths has the route "/", and the paths of one without
+	// upstreams of their own use the site's
+	type change struct {
+		route     route
+		upstreams []global.Upstream
+		previous  []global.Upstream
+	}
+	var changes []change
+	if !reflect.DeepEqual(current.Proxy.Upstreams, cfg.Proxy.Upstreams) {
+		if len(cfg.Proxy.Paths) > 0 {
+			return false
+		}
+		changes = append(changes, change{h.routes[0], cfg.Proxy.Upstreams, current.Proxy.Upstreams})
+	}
+	for i, p := range cfg.Proxy.Paths {
+		if previous := current.Proxy.Paths[i].Upstreams; !reflect.DeepEqual(previous, p.Upstreams) {
+			changes = append(changes, change{h.routes[i], p.Upstreams, previous})
 		}
-		lb.upstreams = append(lb.upstreams, u)
 	}
 
-	if len(lb.upstreams) == 0 {
-		return nil, fmt.Errorf("no valid upstreams provided")
+	for _, c := range changes {
+		if c.route.lb == nil || c.route.pool != "" || c.route.lb.discovery != nil || len(c.previous) == 0 || len(c.upstreams) == 0 {
+			return false
+		}
+		for _, u := range c.upstreams {
+			if _, err := newUpstream(u); err != nil {
+				return false
+			}
+		}
+	}
+	for _, c := range changes {
+		// The upstreams were checked above
+		_ = c.route.lb.SetUpstreams(c.upstreams)
 	}
+	h.applied = cfg
+	return true
+}
 
-	return lb, nil
+// withoutUpstreams returns a copy of cfg without the upstreams of its paths.
+func withoutUpstreams(cfg *global.SiteConfig) *global.SiteConfig {
+	stripped := *cfg
+	stripped.Proxy.Upstreams = nil
+	stripped.Proxy.Paths = make([]global.ProxyPath, len(cfg.Proxy.Paths))
+	for i, p := range cfg.Proxy.Paths {
+		p.Upstreams = nil
+		stripped.Proxy.Paths[i] = p
+	}
+	return &stripped
 }
 
-func (lb *LoadBalancer) Next() *url.URL {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
-
-	switch lb.algorithm {
-	case "round-robin", "":
-		// Round-robin algorithm
-		index := atomic.AddUint64(&lb.currentIndex, 1) - 1
-		return lb.upstreams[index%uint64(len(lb.upstreams))]
-	case "random":
-		// Random algorithm (simplified)
-		index := time.Now().UnixNano() % int64(len(lb.upstreams))
-		return lb.upstreams[index]
-	default:
-		// Default to round-robin
-		index := atomic.AddUint64(&lb.currentIndex, 1) - 1
-		return lb.upstreams[index%uint64(len(lb.upstreams))]
+// Close stops the health checks and other background work of the site's load
+// balancers. The handler keeps serving requests that are still in flight.
+// Pools are left running for the other sites using them.
+func (h *Handler) Close() {
+	for _, r := range h.routes {
+		if r.lb != nil && r.pool == "" {
+			r.lb.Close()
+		}
 	}
 }
 
-func NewLoadBalancedProxy(lb *LoadBalancer, logger *slog.Logger, cfg *global.SiteConfig) http.Handler {
-	transport := &http.Transport{
-		MaxIdleConns:        1000,
-		MaxIdleConnsPerHost: 100,
-		IdleConnTimeout:     90 * time.Second,
+// BalancedUpstreams returns the static primary upstreams of p and whether p
+// needs a load balancer. A single upstream gets one too once it has backups
+// to fail over to or discovered members next to it.
+func BalancedUpstreams(p *global.PathBase) ([]global.Upstream, bool) {
+	if len(p.Upstreams) > 0 {
+		return p.Upstreams, true
+	}
+	if len(p.BackupUpstreams) == 0 && p.Discovery == nil {
+		return nil, false
 	}
+	if p.Upstream != "" {
+		return []global.Upstream{{URL: p.Upstream}}, true
+	}
+	return nil, p.Discovery != nil
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Select ONE upstream server for this request
-		target := lb.Next()
-
-		// Clone the original request to avoid modifying it
-		outReq := r.Clone(r.Context())
-		outReq.URL.Scheme = target.Scheme
-		outReq.URL.Host = target.Host
-		// Keep the original request path
-		outReq.URL.Path = r.URL.Path
-		if target.RawPath != "" {
-			outReq.URL.RawPath = target.RawPath
-		}
-		if target.RawQuery == "" || r.URL.RawQuery == "" {
-			outReq.URL.RawQuery = target.RawQuery
-		} else {
-			outReq.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
-		}
+// newLoadBalancer creates a load balancer for the upstreams of p and starts
+// its discovery and health checks when they are enabled.
+func newLoadBalancer(logger *slog.Logger, p *global.PathBase, upstreams []global.Upstream) (*LoadBalancer, error) {
+	cfg := p.LoadBalance
+	algorithm := "round-robin"
+	if cfg != nil && cfg.Algorithm != "" {
+		algorithm = cfg.Algorithm
+	}
 
-		// Add custom headers
-		for k, v := range cfg.Proxy.Headers {
-			outReq.Header.Set(k, v)
-		}
+	var lb *LoadBalancer
+	var err error
+	if p.Discovery != nil {
+		// Members may all come from discovery
+		lb, err = newBalancer(upstreams, algorithm)
+	} else {
+		lb, err = NewWeightedLoadBalancer(upstreams, algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lb.logger = logger
 
-		logger.Info("Load balanced request", "method", r.Method, "path", r.URL.Path, "target", target.String())
+	if err := lb.AddBackups(p.BackupUpstreams); err != nil {
+		return nil, err
+	}
 
-		// Make the request to the selected upstream
-		resp, err := transport.RoundTrip(outReq)
-		if err != nil {
-			logger.Error("Upstream error", "domain", cfg.Domain, "url", r.URL.String(), "target", target.String(), "error", err)
-			http.Error(w, "Upstream error", http.StatusBadGateway)
-			return
+	if cfg != nil && cfg.HashKey != "" {
+		if err := lb.SetHashKey(cfg.HashKey); err != nil {
+			return nil, err
 		}
-		defer func(Body io.ReadCloser) {
-			_ = Body.Close()
-		}(resp.Body)
-
-		logger.Info("Upstream response", "status", resp.StatusCode, "size", resp.ContentLength, "target", target.String())
+	}
 
-		// Copy response headers
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
+	if cfg != nil && cfg.CircuitBreaker != nil {
+		if err := lb.EnableCircuitBreakers(cfg.CircuitBreaker); err != nil {
+			return nil, err
 		}
+	}
 
-		// Copy status code and body
-		w.WriteHeader(resp.StatusCode)
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			logger.Error("Failed to copy response body", "error", err)
+	if cfg != nil && cfg.SlowStart != nil {
+		if err := lb.EnableSlowStart(cfg.SlowStart); err != nil {
+			return nil, err
 		}
-	})
-}
-
-func NewLoadBalancedProxyWithHeaders(lb *LoadBalancer, logger *slog.Logger, cfg *global.SiteConfig, pathCfg *global.ProxyPath) http.Handler {
-	transport := &http.Transport{
-		MaxIdleConns:        1000,
-		MaxIdleConnsPerHost: 100,
-		IdleConnTimeout:     90 * time.Second,
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Select ONE upstream server for this request
-		target := lb.Next()
-
-		// Clone the original request to avoid modifying it
-		outReq := r.Clone(r.Context())
-		outReq.URL.Scheme = target.Scheme
-		outReq.URL.Host = target.Host
-		// Keep the original request path
-		outReq.URL.Path = r.URL.Path
-		if target.RawPath != "" {
-			outReq.URL.RawPath = target.RawPath
-		}
-		if target.RawQuery == "" || r.URL.RawQuery == "" {
-			outReq.URL.RawQuery = target.RawQuery
-		} else {
-			outReq.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+	if cfg != nil && cfg.Retry != nil {
+		if err := lb.EnableRetries(cfg.Retry); err != nil {
+			return nil, err
 		}
+	}
 
-		// Add global headers first
-		for k, v := range cfg.Proxy.Headers {
-			outReq.Header.Set(k, v)
+	if cfg != nil && cfg.Sticky != nil {
+		if err := lb.EnableSticky(cfg.Sticky); err != nil {
+			return nil, err
 		}
+	}
 
-		// Add path-specific headers
-		for k, v := range pathCfg.Headers {
-			outReq.Header.Set(k, v)
+	if cfg != nil && cfg.OutlierDetection != nil {
+		if err := lb.EnableOutlierDetection(cfg.OutlierDetection); err != nil {
+			return nil, err
 		}
+	}
 
-		logger.Info("Load balanced request", "method", r.Method, "path", r.URL.Path, "target", target.String(), "path_config", pathCfg.Path)
-
-		// Make the request to the selected upstream
-		resp, err := transport.RoundTrip(outReq)
-		if err != nil {
-			logger.Error("Upstream error", "domain", cfg.Domain, "url", r.URL.String(), "target", target.String(), "path_config", pathCfg.Path, "error", err)
-			http.Error(w, "Upstream error", http.StatusBadGateway)
-			return
+	if cfg != nil && cfg.HealthCheck != nil {
+		if err := lb.StartHealthChecks(cfg.HealthCheck); err != nil {
+			return nil, err
 		}
-		defer func(Body io.ReadCloser) {
-			_ = Body.Close()
-		}(resp.Body)
-
-		logger.Info("Upstream response", "status", resp.StatusCode, "size", resp.ContentLength, "target", target.String(), "path_config", pathCfg.Path)
+	}
 
-		// Copy response headers
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
+	if p.Discovery != nil {
+		if err := lb.StartDiscovery(p.Discovery, upstreams); err != nil {
+			lb.Close()
+			return nil, err
 		}
+	}
 
-		// Copy status code and body
-		w.WriteHeader(resp.StatusCode)
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			logger.Error("Failed to copy response body", "error", err)
-		}
-	})
+	return lb, nil
 }
 
 func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, error) {
+	return NewSiteHandlerWithPools(logger, cfg, nil)
+}
+
+// NewSiteHandlerWithPools is NewSiteHandler for a site that may refer to the
+// upstream pools in pools, by name. The site shares their load balancers and
+// leaves them running on Close.
+func NewSiteHandlerWithPools(logger *slog.Logger, cfg *global.SiteConfig, pools map[string]*LoadBalancer) (*Handler, error) {
 	// Check if path-based routing is configured
 	if len(cfg.Proxy.Paths) > 0 {
 		mux := http.NewServeMux()
+		var routes []route
 		var err error
 
+		// Stop the health checks already started if a later path fails
+		fail := func(err error) (*Handler, error) {
+			for _, r := range routes {
+				if r.lb != nil && r.pool == "" {
+					r.lb.Close()
+				}
+			}
+			return nil, err
+		}
+
+		rootPool, err := poolBalancer(&cfg.Proxy.PathBase, pools)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool for %s: %w", cfg.Domain, err)
+		}
+
 		// Create a proxy for each path
+		seen := make(map[string]bool)
 		for i, pathCfg := range cfg.Proxy.Paths {
+			// The mux panics on patterns registered twice
+			if seen[pathCfg.Path] {
+				return fail(fmt.Errorf("duplicate path %s", pathCfg.Path))
+			}
+			seen[pathCfg.Path] = true
+
 			var pathProxy http.Handler
 			var pathLb *LoadBalancer
+			var pool string
+
+			ownPool, err := poolBalancer(&pathCfg.PathBase, pools)
+			if err != nil {
+				return fail(fmt.Errorf("invalid pool for path %s: %w", pathCfg.Path, err))
+			}
 
 			// Check if this path has multiple upstreams (load balancing)
-			if len(pathCfg.Upstreams) > 0 {
+			if ownPool != nil {
+				// Path shares a pool
+				pathLb, pool = ownPool, pathCfg.Pool
+				pathProxy = NewLoadBalancedProxyWithHeaders(pathLb, logger, cfg, &cfg.Proxy.Paths[i])
+			} else if upstreams, ok := BalancedUpstreams(&pathCfg.PathBase); ok {
 				// Path has its own upstreams - use path-specific load balancing
-				algorithm := "round-robin"
-				if pathCfg.LoadBalance != nil && pathCfg.LoadBalance.Algorithm != "" {
-					algorithm = pathCfg.LoadBalance.Algorithm
-				}
-
-				pathLb, err = NewLoadBalancer(pathCfg.Upstreams, algorithm)
+				pathLb, err = newLoadBalancer(logger, &pathCfg.PathBase, upstreams)
 				if err != nil {
-					return nil, fmt.Errorf("failed to create load balancer for path %s: %w", pathCfg.Path, err)
+					return fail(fmt.Errorf("failed to create load balancer for path %s: %w", pathCfg.Path, err))
 				}
 
 				// Create a load-balanced proxy for this path with path-specific headers
 				pathProxy = NewLoadBalancedProxyWithHeaders(pathLb, logger, cfg, &cfg.Proxy.Paths[i])
-			} else if len(cfg.Proxy.Upstreams) > 0 {
+			} else if rootPool != nil {
+				// Use the site's pool for this path
+				pathLb, pool = rootPool, cfg.Proxy.Pool
+				pathProxy = NewLoadBalancedProxyWithHeaders(pathLb, logger, cfg, &cfg.Proxy.Paths[i])
+			} else if upstreams, ok := BalancedUpstreams(&cfg.Proxy.PathBase); ok {
 				// Use global upstreams for this path
-				algorithm := "round-robin"
-				if cfg.Proxy.LoadBalance != nil && cfg.Proxy.LoadBalance.Algorithm != "" {
-					algorithm = cfg.Proxy.LoadBalance.Algorithm
-				}
-
-				pathLb, err = NewLoadBalancer(cfg.Proxy.Upstreams, algorithm)
+				pathLb, err = newLoadBalancer(logger, &cfg.Proxy.PathBase, upstreams)
 				if err != nil {
-					return nil, fmt.Errorf("failed to create load balancer for path %s: %w", pathCfg.Path, err)
+					return fail(fmt.Errorf("failed to create load balancer for path %s: %w", pathCfg.Path, err))
 				}
 
 				// Create a load-balanced proxy for this path with path-specific headers
@@ -278,17 +322,11 @@ func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, erro
 				// Single upstream for this path
 				target, err := url.Parse(pathCfg.Upstream)
 				if err != nil {
-					return nil, fmt.Errorf("invalid upstream for path %s: %w", pathCfg.Path, err)
-				}
-
-				transport := &http.Transport{
-					MaxIdleConns:        1000,
-					MaxIdleConnsPerHost: 100,
-					IdleConnTimeout:     90 * time.Second,
+					return fail(fmt.Errorf("invalid upstream for path %s: %w", pathCfg.Path, err))
 				}
 
 				proxy := httputil.NewSingleHostReverseProxy(target)
-				proxy.Transport = transport
+				proxy.Transport = newTransport()
 
 				// Handle headers for single upstream
 				originalDirector := proxy.Director
@@ -306,6 +344,7 @@ func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, erro
 
 				pathProxy = proxy
 			}
+			routes = append(routes, route{path: pathCfg.Path, upstream: pathCfg.Upstream, pool: pool, lb: pathLb})
 
 			// Apply per-site timeouts
 			timeoutHandler := http.TimeoutHandler(
@@ -327,6 +366,9 @@ func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, erro
 			Handler: loggedHandler,
 			Logger:  logger,
 			lb:      nil, // No global load balancer when using paths
+
+			routes:  routes,
+			applied: cfg,
 		}, nil
 	}
 
@@ -336,14 +378,14 @@ func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, erro
 	var err error
 
 	// Check if load balancing is configured
-	if len(cfg.Proxy.Upstreams) > 0 {
+	if lb, err = poolBalancer(&cfg.Proxy.PathBase, pools); err != nil {
+		return nil, fmt.Errorf("invalid pool for %s: %w", cfg.Domain, err)
+	} else if lb != nil {
+		// Use the shared load balancer of the pool
+		proxy = NewLoadBalancedProxy(lb, logger, cfg)
+	} else if upstreams, ok := BalancedUpstreams(&cfg.Proxy.PathBase); ok {
 		// Use load balancing
-		algorithm := "round-robin"
-		if cfg.Proxy.LoadBalance != nil && cfg.Proxy.LoadBalance.Algorithm != "" {
-			algorithm = cfg.Proxy.LoadBalance.Algorithm
-		}
-
-		lb, err = NewLoadBalancer(cfg.Proxy.Upstreams, algorithm)
+		lb, err = newLoadBalancer(logger, &cfg.Proxy.PathBase, upstreams)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create load balancer for %s: %w", cfg.Domain, err)
 		}
@@ -356,14 +398,8 @@ func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, erro
 			return nil, fmt.Errorf("invalid upstream for %s: %w", cfg.Domain, err)
 		}
 
-		transport := &http.Transport{
-			MaxIdleConns:        1000,
-			MaxIdleConnsPerHost: 100,
-			IdleConnTimeout:     90 * time.Second,
-		}
-
 		reverseProxy := httputil.NewSingleHostReverseProxy(target)
-		reverseProxy.Transport = transport
+		reverseProxy.Transport = newTransport()
 
 		// Handle headers for single upstream
 		originalDirector := reverseProxy.Director
@@ -376,7 +412,7 @@ func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, erro
 
 		proxy = reverseProxy
 	} else {
-		return nil, fmt.Errorf("no upstream or upstreams configured for %s", cfg.Domain)
+		return nil, fmt.Errorf("no upstream, upstreams or pool configured for %s", cfg.Domain)
 	}
 
 	// Apply per-site timeouts
@@ -394,5 +430,8 @@ func NewSiteHandler(logger *slog.Logger, cfg *global.SiteConfig) (*Handler, erro
 		Handler: loggedHandler,
 		Logger:  logger,
 		lb:      lb,
+
+		routes:  []route{{path: "/", upstream: cfg.Proxy.Upstream, pool: cfg.Proxy.Pool, lb: lb}},
+		applied: cfg,
 	}, nil
 }
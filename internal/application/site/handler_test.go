@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reverse-proxy/internal/models/global"
+	"strings"
 	"testing"
 	"time"
 )
@@ -17,10 +18,12 @@ func TestNewSiteHandler(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "example.com",
 			Proxy: global.Proxy{
-				Upstream: "http://localhost:3000",
-				Headers: map[string]string{
-					"X-Forwarded-For": "$remote_addr",
-					"X-Custom-Header": "test-value",
+				PathBase: global.PathBase{
+					Upstream: "http://localhost:3000",
+					Headers: map[string]string{
+						"X-Forwarded-For": "$remote_addr",
+						"X-Custom-Header": "test-value",
+					},
 				},
 			},
 			Timeouts: global.Timeouts{
@@ -57,7 +60,9 @@ func TestNewSiteHandler(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "example.com",
 			Proxy: global.Proxy{
-				Upstream: "://invalid-url-without-scheme",
+				PathBase: global.PathBase{
+					Upstream: "://invalid-url-without-scheme",
+				},
 			},
 		}
 
@@ -73,7 +78,9 @@ func TestNewSiteHandler(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "",
 			Proxy: global.Proxy{
-				Upstream: "http://localhost:3000",
+				PathBase: global.PathBase{
+					Upstream: "http://localhost:3000",
+				},
 			},
 		}
 
@@ -87,6 +94,24 @@ func TestNewSiteHandler(t *testing.T) {
 			t.Error("Expected non-nil handler even with empty domain")
 		}
 	})
+
+	t.Run("duplicate path", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+
+		cfg := &global.SiteConfig{
+			Domain: "example.com",
+			Proxy: global.Proxy{
+				Paths: []global.ProxyPath{
+					{Path: "/api/", PathBase: global.PathBase{Upstream: "http://localhost:3000"}},
+					{Path: "/api/", PathBase: global.PathBase{Upstream: "http://localhost:3001"}},
+				},
+			},
+		}
+
+		if _, err := NewSiteHandler(logger, cfg); err == nil || !strings.Contains(err.Error(), "duplicate path /api/") {
+			t.Errorf("Expected duplicate path error, got %v", err)
+		}
+	})
 }
 
 func TestLoadBalancer(t *testing.T) {
@@ -171,15 +196,17 @@ func TestNewSiteHandlerWithLoadBalancing(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "example.com",
 			Proxy: global.Proxy{
-				Upstreams: []string{
-					"http://localhost:3000",
-					"http://localhost:3001",
-				},
-				LoadBalance: &global.LoadBalance{
-					Algorithm: "round-robin",
-				},
-				Headers: map[string]string{
-					"X-Forwarded-For": "$remote_addr",
+				PathBase: global.PathBase{
+					Upstreams: []global.Upstream{
+						{URL: "http://localhost:3000"},
+						{URL: "http://localhost:3001"},
+					},
+					LoadBalance: &global.LoadBalance{
+						Algorithm: "round-robin",
+					},
+					Headers: map[string]string{
+						"X-Forwarded-For": "$remote_addr",
+					},
 				},
 			},
 			Timeouts: global.Timeouts{
@@ -220,7 +247,9 @@ func TestNewSiteHandlerWithLoadBalancing(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "example.com",
 			Proxy: global.Proxy{
-				Upstream: "http://localhost:3000",
+				PathBase: global.PathBase{
+					Upstream: "http://localhost:3000",
+				},
 			},
 			Timeouts: global.Timeouts{
 				Read:  10 * time.Second,
@@ -258,9 +287,11 @@ func TestSiteHandlerServeHTTP(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "example.com",
 			Proxy: global.Proxy{
-				Upstream: upstream.URL,
-				Headers: map[string]string{
-					"X-Test-Header": "test-value",
+				PathBase: global.PathBase{
+					Upstream: upstream.URL,
+					Headers: map[string]string{
+						"X-Test-Header": "test-value",
+					},
 				},
 			},
 			Timeouts: global.Timeouts{
@@ -308,7 +339,9 @@ func TestSiteHandlerServeHTTP(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "example.com",
 			Proxy: global.Proxy{
-				Upstream: upstream.URL,
+				PathBase: global.PathBase{
+					Upstream: upstream.URL,
+				},
 			},
 			Timeouts: global.Timeouts{
 				Read:  5 * time.Second,
@@ -349,7 +382,9 @@ func TestSiteHandlerServeHTTP(t *testing.T) {
 		cfg := &global.SiteConfig{
 			Domain: "example.com",
 			Proxy: global.Proxy{
-				Upstream: upstream.URL,
+				PathBase: global.PathBase{
+					Upstream: upstream.URL,
+				},
 			},
 			Timeouts: global.Timeouts{
 				Read:  1 * time.Millisecond,  // Very short timeout
@@ -0,0 +1,162 @@
+package site
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// virtualNodes is the number of ring points per unit of upstream weight,
+// once the weights are divided by their greatest common divisor.
+const virtualNodes = 100
+
+// maxVirtualNodes bounds the ring points of an upstream, so weights from
+// discovery such as SRV weights of up to 65535 don't blow up the ring. The
+// points of every upstream are scaled down alike to stay within it.
+const maxVirtualNodes = 1000
+
+// hashRing is a consistent-hash ring over the members of a LoadBalancer.
+// Each upstream owns several points on the ring; a key belongs to the first
+// usable upstream clockwise from its hash, so taking an upstream out only
+// moves the keys it owned.
+type hashRing struct {
+	points []uint64
+	owners []*upstream
+	// nodes is the position of each point among its owner's points
+	nodes []int
+	// replicas is the number of points of each upstream
+	replicas map[*upstream]int
+}
+
+func newHashRing(members []*upstream) *hashRing {
+	ring := &hashRing{replicas: ringReplicas(members)}
+	for _, u := range members {
+		for i := 0; i < ring.replicas[u]; i++ {
+			ring.points = append(ring.points, hashString(u.url.String()+"#"+strconv.Itoa(i)))
+			ring.owners = append(ring.owners, u)
+			ring.nodes = append(ring.nodes, i)
+		}
+	}
+	sort.Sort(ring)
+	return ring
+}
+
+// ringReplicas returns the number of ring points of each member: virtualNodes
+// per unit of its weight relative to the others, scaled down so none has more
+// than maxVirtualNodes, and at least one.
+func ringReplicas(members []*upstream) map[*upstream]int {
+	divisor, heaviest := 0, 0
+	for _, u := range members {
+		divisor = gcd(divisor, u.weight)
+		heaviest = max(heaviest, u.weight)
+	}
+
+	replicas := make(map[*upstream]int, len(members))
+	for _, u := range members {
+		units := u.weight / divisor
+		if heaviest/divisor*virtualNodes <= maxVirtualNodes {
+			replicas[u] = units * virtualNodes
+		} else {
+			replicas[u] = max(1, units*maxVirtualNodes/(heaviest/divisor))
+		}
+	}
+	return replicas
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func (r *hashRing) Len() int           { return len(r.points) }
+func (r *hashRing) Less(i, j int) bool { return r.points[i] < r.points[j] }
+func (r *hashRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+	r.nodes[i], r.nodes[j] = r.nodes[j], r.nodes[i]
+}
+
+// get returns the owner of key, skipping upstreams that are not usable and
+// the points beyond the share of their owner.
+func (r *hashRing) get(key string, usable map[*upstream]bool, share func(*upstream) float64) *upstream {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	h := hashString(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for i := 0; i < len(r.points); i++ {
+		point := (start + i) % len(r.points)
+		owner := r.owners[point]
+		if usable != nil && !usable[owner] {
+			continue
+		}
+		if s := share(owner); s < 1 && float64(r.nodes[point]) >= s*float64(r.replicas[owner]) {
+			continue
+		}
+		return owner
+	}
+	return nil
+}
+
+// hashString is FNV-1a followed by a splitmix64 finalizer, which spreads the
+// short, similar strings used for ring points evenly. It is deterministic so
+// every proxy instance maps keys the same way.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// parseHashKey turns a load_balance.hash_key setting into a function that
+// extracts the key from a request. Supported forms are "remote_ip" (the
+// default), "path", "header:<name>" and "cookie:<name>".
+func parseHashKey(spec string) (func(r *http.Request) string, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "remote_ip":
+		return func(r *http.Request) string {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				return r.RemoteAddr
+			}
+			return host
+		}, nil
+	case "path":
+		return func(r *http.Request) string {
+			return r.URL.Path
+		}, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q is missing a header name", spec)
+		}
+		return func(r *http.Request) string {
+			return r.Header.Get(name)
+		}, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q is missing a cookie name", spec)
+		}
+		return func(r *http.Request) string {
+			c, err := r.Cookie(name)
+			if err != nil {
+				return ""
+			}
+			return c.Value
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash key: %s", spec)
+	}
+}
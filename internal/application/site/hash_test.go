@@ -0,0 +1,166 @@
+package site
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"testing"
+)
+
+func TestConsistentHash(t *testing.T) {
+	t.Run("same key maps to same upstream", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+			"http://localhost:3002",
+		}, "hash")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+		if err := lb.SetHashKey("header:X-User"); err != nil {
+			t.Fatalf("SetHashKey failed: %v", err)
+		}
+
+		used := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+
+			first := lb.pick(req, nil)
+			for j := 0; j < 3; j++ {
+				if again := lb.pick(req, nil); again != first {
+					t.Fatalf("Expected key user-%d to stick to %s, got %s", i, first.url, again.url)
+				}
+			}
+			used[first.url.String()] = true
+		}
+
+		if len(used) != 3 {
+			t.Errorf("Expected keys to spread over 3 upstreams, got %d", len(used))
+		}
+	})
+
+	t.Run("unavailable upstream only moves its own keys", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+			"http://localhost:3002",
+		}, "hash")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+		if err := lb.SetHashKey("path"); err != nil {
+			t.Fatalf("SetHashKey failed: %v", err)
+		}
+
+		before := make(map[string]*upstream)
+		for i := 0; i < 300; i++ {
+			path := fmt.Sprintf("/item/%d", i)
+			before[path] = lb.pick(httptest.NewRequest("GET", "http://example.com"+path, nil), nil)
+		}
+
+		down := lb.upstreams[1]
+		down.healthy.Store(false)
+
+		for path, owner := range before {
+			after := lb.pick(httptest.NewRequest("GET", "http://example.com"+path, nil), nil)
+			if after == down {
+				t.Errorf("Expected %s to avoid the unhealthy upstream", path)
+			}
+			if owner != down && after != owner {
+				t.Errorf("Expected %s to stay on %s, moved to %s", path, owner.url, after.url)
+			}
+		}
+	})
+
+	t.Run("weights are normalised and bounded", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://a:3000", "http://b:3000"}, withAlgorithm("hash"), withWeights(300, 100))
+		if n := lb.ring.replicas[lb.upstreams[0]]; n != 3*virtualNodes {
+			t.Errorf("Expected %d points for weight 300 of 400, got %d", 3*virtualNodes, n)
+		}
+		if n := lb.ring.replicas[lb.upstreams[1]]; n != virtualNodes {
+			t.Errorf("Expected %d points for weight 100 of 400, got %d", virtualNodes, n)
+		}
+
+		lb = testBalancer(t, []string{"http://a:3000", "http://b:3000"}, withAlgorithm("hash"), withWeights(65535, 1))
+		if n := lb.ring.Len(); n != maxVirtualNodes+1 {
+			t.Errorf("Expected %d points, got %d", maxVirtualNodes+1, n)
+		}
+	})
+
+	t.Run("refreshes keep the ring unless members change", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://a:3000", "http://b:3000"}, withAlgorithm("hash"))
+		members := []global.Upstream{{URL: "http://a:3000"}, {URL: "http://b:3000"}}
+
+		ring := lb.ring
+		if err := lb.SetUpstreams(members); err != nil {
+			t.Fatalf("SetUpstreams failed: %v", err)
+		}
+		if lb.ring != ring {
+			t.Error("Expected an unchanged refresh to keep the ring")
+		}
+
+		members[1].Weight = 2
+		if err := lb.SetUpstreams(members); err != nil {
+			t.Fatalf("SetUpstreams failed: %v", err)
+		}
+		if lb.ring == ring {
+			t.Error("Expected a weight change to rebuild the ring")
+		}
+	})
+
+	t.Run("remote ip is the default key", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+		}, "hash")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		first := httptest.NewRequest("GET", "http://example.com/a", nil)
+		first.RemoteAddr = "10.0.0.1:1234"
+		second := httptest.NewRequest("GET", "http://example.com/b", nil)
+		second.RemoteAddr = "10.0.0.1:5678"
+
+		if lb.pick(first, nil) != lb.pick(second, nil) {
+			t.Error("Expected requests from the same IP to reach the same upstream")
+		}
+	})
+}
+
+func TestParseHashKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/some/path", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("Cookie", "session=abc123")
+
+	testCases := []struct {
+		spec     string
+		expected string
+	}{
+		{"", "192.0.2.1"},
+		{"remote_ip", "192.0.2.1"},
+		{"path", "/some/path"},
+		{"header:X-Tenant", "acme"},
+		{"cookie:session", "abc123"},
+		{"cookie:missing", ""},
+	}
+
+	for _, tc := range testCases {
+		key, err := parseHashKey(tc.spec)
+		if err != nil {
+			t.Errorf("parseHashKey(%q) failed: %v", tc.spec, err)
+			continue
+		}
+		if got := key(req); got != tc.expected {
+			t.Errorf("parseHashKey(%q) key = %q, expected %q", tc.spec, got, tc.expected)
+		}
+	}
+
+	for _, spec := range []string{"header:", "cookie:", "query"} {
+		if _, err := parseHashKey(spec); err == nil {
+			t.Errorf("Expected error for hash key %q, got nil", spec)
+		}
+	}
+}
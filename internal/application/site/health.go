@@ -0,0 +1,189 @@
+package site
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reverse-proxy/internal/models/global"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthChecker holds the parsed form of a global.HealthCheck.
+type healthChecker struct {
+	path      string
+	interval  time.Duration
+	timeout   time.Duration
+	rise      int
+	fall      int
+	statusMin int
+	statusMax int
+	client    *http.Client
+}
+
+func newHealthChecker(cfg *global.HealthCheck) (*healthChecker, error) {
+	hc := &healthChecker{
+		path:      cfg.Path,
+		interval:  10 * time.Second,
+		timeout:   2 * time.Second,
+		rise:      2,
+		fall:      3,
+		statusMin: 200,
+		statusMax: 399,
+	}
+
+	if hc.path == "" {
+		hc.path = "/"
+	}
+
+	var err error
+	if cfg.Interval != "" {
+		if hc.interval, err = time.ParseDuration(cfg.Interval); err != nil || hc.interval <= 0 {
+			return nil, fmt.Errorf("invalid health check interval: %s", cfg.Interval)
+		}
+	}
+	if cfg.Timeout != "" {
+		if hc.timeout, err = time.ParseDuration(cfg.Timeout); err != nil || hc.timeout <= 0 {
+			return nil, fmt.Errorf("invalid health check timeout: %s", cfg.Timeout)
+		}
+	}
+	if cfg.Rise > 0 {
+		hc.rise = cfg.Rise
+	}
+	if cfg.Fall > 0 {
+		hc.fall = cfg.Fall
+	}
+	if cfg.ExpectedStatus != "" {
+		if hc.statusMin, hc.statusMax, err = parseStatusRange(cfg.ExpectedStatus); err != nil {
+			return nil, err
+		}
+	}
+
+	hc.client = &http.Client{
+		Timeout: hc.timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		// A redirect is an answer in itself, don't follow it
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return hc, nil
+}
+
+// parseStatusRange accepts either a single status code or a "min-max" range.
+func parseStatusRange(s string) (int, int, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid expected status: %s", s)
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	hi, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil || hi < lo {
+		return 0, 0, fmt.Errorf("invalid expected status: %s", s)
+	}
+	return lo, hi, nil
+}
+
+// StartHealthChecks probes every upstream in the background until Close is
+// called. An upstream is marked unhealthy after cfg.Fall consecutive failed
+// probes and healthy again after cfg.Rise consecutive successful ones.
+func (lb *LoadBalancer) StartHealthChecks(cfg *global.HealthCheck) error {
+	hc, err := newHealthChecker(cfg)
+	if err != nil {
+		return err
+	}
+
+	go lb.runHealthChecks(hc)
+	return nil
+}
+
+func (lb *LoadBalancer) runHealthChecks(hc *healthChecker) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	defer hc.client.CloseIdleConnections()
+
+	// Consecutive probe results per upstream, guarded by mu
+	var mu sync.Mutex
+	successes := make(map[*upstream]int)
+	failures := make(map[*upstream]int)
+
+	for {
+		// Members may change between rounds, forget the ones that are gone
+		members := lb.members()
+		current := make(map[*upstream]bool, len(members))
+		for _, u := range members {
+			current[u] = true
+		}
+		for u := range successes {
+			if !current[u] {
+				delete(successes, u)
+				delete(failures, u)
+			}
+		}
+
+		var wg sync.WaitGroup
+		for _, u := range members {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				err := hc.probe(u)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					successes[u] = 0
+					failures[u]++
+					if failures[u] >= hc.fall && u.healthy.Swap(false) {
+						lb.logger.Warn("Upstream marked unhealthy", "upstream", u.url.String(), "failures", failures[u], "error", err)
+					}
+					return
+				}
+
+				failures[u] = 0
+				successes[u]++
+				if successes[u] >= hc.rise && !u.healthy.Swap(true) {
+					lb.warm(u)
+					lb.logger.Info("Upstream marked healthy", "upstream", u.url.String(), "successes", successes[u])
+				}
+			}(u)
+		}
+		wg.Wait()
+
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends a single health check request to u.
+func (hc *healthChecker) probe(u *upstream) error {
+	target := *u.url
+	target.Path = hc.path
+	target.RawPath = ""
+	target.RawQuery = ""
+
+	resp, err := hc.client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < hc.statusMin || resp.StatusCode > hc.statusMax {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
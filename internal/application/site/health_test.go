@@ -0,0 +1,133 @@
+package site
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the deadline passes.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Condition not met before deadline")
+}
+
+func TestHealthChecks(t *testing.T) {
+	t.Run("unhealthy upstream is skipped and readmitted", func(t *testing.T) {
+		var down atomic.Bool
+		flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer flaky.Close()
+
+		stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer stable.Close()
+
+		lb, err := NewLoadBalancer([]string{flaky.URL, stable.URL}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+		defer lb.Close()
+
+		down.Store(true)
+		if err := lb.StartHealthChecks(&global.HealthCheck{
+			Path:     "/health",
+			Interval: "10ms",
+			Timeout:  "1s",
+			Rise:     1,
+			Fall:     2,
+		}); err != nil {
+			t.Fatalf("StartHealthChecks failed: %v", err)
+		}
+
+		waitFor(t, func() bool { return !lb.upstreams[0].healthy.Load() })
+
+		for i := 0; i < 4; i++ {
+			if target := lb.Next(); target.String() != stable.URL {
+				t.Errorf("Expected only healthy upstream %s, got %s", stable.URL, target)
+			}
+		}
+
+		down.Store(false)
+		waitFor(t, func() bool { return lb.upstreams[0].healthy.Load() })
+	})
+
+	t.Run("all upstreams down falls back to every member", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+		}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		for _, u := range lb.upstreams {
+			u.healthy.Store(false)
+		}
+
+		urls := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			urls[lb.Next().String()]++
+		}
+
+		if len(urls) != 2 {
+			t.Errorf("Expected both upstreams to be used, got %d", len(urls))
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://localhost:3000"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		if err := lb.StartHealthChecks(&global.HealthCheck{Interval: "often"}); err == nil {
+			t.Error("Expected error for invalid interval, got nil")
+		}
+
+		if err := lb.StartHealthChecks(&global.HealthCheck{ExpectedStatus: "500-200"}); err == nil {
+			t.Error("Expected error for invalid status range, got nil")
+		}
+	})
+}
+
+func TestParseStatusRange(t *testing.T) {
+	testCases := []struct {
+		input   string
+		lo, hi  int
+		wantErr bool
+	}{
+		{"200", 200, 200, false},
+		{"200-399", 200, 399, false},
+		{" 200 - 204 ", 200, 204, false},
+		{"abc", 0, 0, true},
+		{"300-200", 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		lo, hi, err := parseStatusRange(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseStatusRange(%q) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+			continue
+		}
+		if lo != tc.lo || hi != tc.hi {
+			t.Errorf("parseStatusRange(%q) = %d-%d, expected %d-%d", tc.input, lo, hi, tc.lo, tc.hi)
+		}
+	}
+}
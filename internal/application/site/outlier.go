@@ -0,0 +1,147 @@
+package site
+
+import (
+	"fmt"
+	"net/http"
+	"reverse-proxy/internal/models/global"
+	"time"
+)
+
+// outlierDetector holds the parsed form of a global.OutlierDetection.
+type outlierDetector struct {
+	consecutiveErrors int
+	baseEjection      time.Duration
+	maxEjection       time.Duration
+}
+
+func newOutlierDetector(cfg *global.OutlierDetection) (*outlierDetector, error) {
+	od := &outlierDetector{
+		consecutiveErrors: 5,
+		baseEjection:      30 * time.Second,
+		maxEjection:       5 * time.Minute,
+	}
+
+	var err error
+	if cfg.ConsecutiveErrors > 0 {
+		od.consecutiveErrors = cfg.ConsecutiveErrors
+	}
+	if cfg.BaseEjectionTime != "" {
+		if od.baseEjection, err = time.ParseDuration(cfg.BaseEjectionTime); err != nil || od.baseEjection <= 0 {
+			return nil, fmt.Errorf("invalid base ejection time: %s", cfg.BaseEjectionTime)
+		}
+	}
+	if cfg.MaxEjectionTime != "" {
+		if od.maxEjection, err = time.ParseDuration(cfg.MaxEjectionTime); err != nil || od.maxEjection <= 0 {
+			return nil, fmt.Errorf("invalid max ejection time: %s", cfg.MaxEjectionTime)
+		}
+	}
+	if od.maxEjection < od.baseEjection {
+		od.maxEjection = od.baseEjection
+	}
+
+	return od, nil
+}
+
+// ejectionTime returns how long an upstream stays out of rotation on its
+// n-th consecutive ejection, starting at n = 0.
+func (od *outlierDetector) ejectionTime(n int) time.Duration {
+	d := od.baseEjection
+	for i := 0; i < n && d < od.maxEjection; i++ {
+		d *= 2
+	}
+	if d > od.maxEjection {
+		d = od.maxEjection
+	}
+	return d
+}
+
+// EnableOutlierDetection makes the load balancer eject upstreams that keep
+// failing requests, in addition to any active health checks.
+func (lb *LoadBalancer) EnableOutlierDetection(cfg *global.OutlierDetection) error {
+	od, err := newOutlierDetector(cfg)
+	if err != nil {
+		return err
+	}
+
+	lb.outlier = od
+	return nil
+}
+
+// observe records the outcome of a request sent to u for its counters,
+// circuit breaker and outlier detection. Connection errors and 5xx responses
+// count as failures.
+func (lb *LoadBalancer) observe(u *upstream, status int, err error) {
+	failed := err != nil || status >= http.StatusInternalServerError
+	u.requests.Add(1)
+	if failed {
+		u.failures.Add(1)
+	}
+	from, to := u.breaker.record(failed)
+	lb.logTransition(u, from, to)
+	if to == CircuitClosed {
+		lb.warm(u)
+	}
+
+	od := lb.outlier
+	if od == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !failed {
+		u.consecutiveErrors = 0
+		// A full base ejection time without being ejected again forgives the
+		// upstream its earlier ejections
+		if u.ejections > 0 && !u.ejected.Load() && time.Since(u.readmittedAt) >= od.baseEjection {
+			u.ejections = 0
+		}
+		return
+	}
+
+	u.consecutiveErrors++
+	if u.consecutiveErrors < od.consecutiveErrors || u.ejected.Load() {
+		return
+	}
+
+	cooldown := od.ejectionTime(u.ejections)
+	u.ejections++
+	u.consecutiveErrors = 0
+	u.ejected.Store(true)
+
+	reason := fmt.Sprintf("status %d", status)
+	if err != nil {
+		reason = err.Error()
+	}
+	lb.logger.Warn("Upstream ejected", "upstream", u.url.String(), "cooldown", cooldown, "ejections", u.ejections, "reason", reason)
+
+	u.readmit = time.AfterFunc(cooldown, func() {
+		// Close may have missed a timer started by a late request
+		select {
+		case <-lb.stop:
+			return
+		default:
+		}
+
+		u.mu.Lock()
+		u.ejected.Store(false)
+		u.readmittedAt = time.Now()
+		u.readmit = nil
+		u.mu.Unlock()
+		lb.logger.Info("Upstream readmitted", "upstream", u.url.String())
+		lb.warm(u)
+	})
+}
+
+// stopReadmit cancels the pending readmission of u, for a member that is
+// removed or whose load balancer is closed.
+func (u *upstream) stopReadmit() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.readmit != nil {
+		u.readmit.Stop()
+		u.readmit = nil
+	}
+}
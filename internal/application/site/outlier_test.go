@@ -0,0 +1,137 @@
+package site
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	t.Run("failing upstream is ejected and readmitted", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer failing.Close()
+
+		stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer stable.Close()
+
+		lb, err := NewLoadBalancer([]string{failing.URL, stable.URL}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+		if err := lb.EnableOutlierDetection(&global.OutlierDetection{
+			ConsecutiveErrors: 2,
+			BaseEjectionTime:  "50ms",
+		}); err != nil {
+			t.Fatalf("EnableOutlierDetection failed: %v", err)
+		}
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		proxy := NewLoadBalancedProxy(lb, logger, &global.SiteConfig{Domain: "example.com"})
+
+		// Four requests round-robin over both upstreams: two failures in a row
+		for i := 0; i < 4; i++ {
+			proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+		}
+
+		if !lb.upstreams[0].ejected.Load() {
+			t.Fatal("Expected failing upstream to be ejected")
+		}
+
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("Expected status 200 while failing upstream is ejected, got %d", rec.Code)
+			}
+		}
+
+		waitFor(t, func() bool { return !lb.upstreams[0].ejected.Load() })
+	})
+
+	t.Run("connection errors count as failures", func(t *testing.T) {
+		dead := httptest.NewServer(http.NotFoundHandler())
+		deadURL := dead.URL
+		dead.Close()
+
+		lb, err := NewLoadBalancer([]string{deadURL}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+		if err := lb.EnableOutlierDetection(&global.OutlierDetection{ConsecutiveErrors: 1}); err != nil {
+			t.Fatalf("EnableOutlierDetection failed: %v", err)
+		}
+
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		proxy := NewLoadBalancedProxy(lb, logger, &global.SiteConfig{Domain: "example.com"})
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", rec.Code)
+		}
+		if !lb.upstreams[0].ejected.Load() {
+			t.Error("Expected unreachable upstream to be ejected")
+		}
+	})
+
+	t.Run("closing stops pending readmissions", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000", "http://localhost:3001"}, withSetup(func(lb *LoadBalancer) error {
+			return lb.EnableOutlierDetection(&global.OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: "20ms"})
+		}))
+
+		closed, removed := lb.upstreams[0], lb.upstreams[1]
+		lb.observe(closed, http.StatusInternalServerError, nil)
+		lb.observe(removed, http.StatusInternalServerError, nil)
+
+		if err := lb.SetUpstreams([]global.Upstream{{URL: "http://localhost:3000"}}); err != nil {
+			t.Fatalf("SetUpstreams failed: %v", err)
+		}
+		lb.Close()
+		time.Sleep(50 * time.Millisecond)
+
+		for _, u := range []*upstream{closed, removed} {
+			if !u.ejected.Load() {
+				t.Errorf("Expected %s not to be readmitted", u.url)
+			}
+			u.mu.Lock()
+			if u.readmit != nil {
+				t.Errorf("Expected the readmission of %s to be stopped", u.url)
+			}
+			u.mu.Unlock()
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://localhost:3000"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		if err := lb.EnableOutlierDetection(&global.OutlierDetection{BaseEjectionTime: "soon"}); err == nil {
+			t.Error("Expected error for invalid base ejection time, got nil")
+		}
+	})
+}
+
+func TestEjectionTime(t *testing.T) {
+	od := &outlierDetector{
+		baseEjection: 10 * time.Second,
+		maxEjection:  time.Minute,
+	}
+
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for n, want := range expected {
+		if got := od.ejectionTime(n); got != want {
+			t.Errorf("ejectionTime(%d) = %v, expected %v", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package site
+
+import (
+	"fmt"
+	"log/slog"
+	"reverse-proxy/internal/models/global"
+)
+
+// NewPool creates the load balancer of the upstream pool name. Every site and
+// path referring to the pool is given this one load balancer, so they share
+// its health checks, counters and connections.
+func NewPool(logger *slog.Logger, name string, cfg *global.Pool) (*LoadBalancer, error) {
+	p := &global.PathBase{
+		Upstreams:       cfg.Upstreams,
+		BackupUpstreams: cfg.BackupUpstreams,
+		Discovery:       cfg.Discovery,
+		LoadBalance:     cfg.LoadBalance,
+	}
+	upstreams, ok := BalancedUpstreams(p)
+	if !ok {
+		return nil, fmt.Errorf("no upstreams or discovery configured for pool %s", name)
+	}
+
+	lb, err := newLoadBalancer(logger.With("pool", name), p, upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create load balancer for pool %s: %w", name, err)
+	}
+	return lb, nil
+}
+
+// CheckPoolReference returns an error if p refers to a pool and also
+// configures upstreams or load balancing of its own, which belong to the pool.
+func CheckPoolReference(p *global.PathBase) error {
+	if p.Pool == "" {
+		return nil
+	}
+	if p.Upstream != "" || len(p.Upstreams) > 0 || len(p.BackupUpstreams) > 0 || p.Discovery != nil || p.LoadBalance != nil {
+		return fmt.Errorf("pool %s can't be combined with upstreams, discovery or load_balance", p.Pool)
+	}
+	return nil
+}
+
+// poolBalancer returns the load balancer of the pool p refers to, or nil if p
+// doesn't refer to one.
+func poolBalancer(p *global.PathBase, pools map[string]*LoadBalancer) (*LoadBalancer, error) {
+	if p.Pool == "" {
+		return nil, nil
+	}
+	if err := CheckPoolReference(p); err != nil {
+		return nil, err
+	}
+	lb, ok := pools[p.Pool]
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream pool %s", p.Pool)
+	}
+	return lb, nil
+}
+
+// Pools returns the pools the paths of h are proxied to, by name.
+func (h *Handler) Pools() map[string]*LoadBalancer {
+	pools := make(map[string]*LoadBalancer)
+	for _, r := range h.routes {
+		if r.pool != "" {
+			pools[r.pool] = r.lb
+		}
+	}
+	return pools
+}
+
+// Inherit carries over the state of previous, the load balancer of the same
+// pool that lb replaces: its discovered members until lb discovers its own,
+// upstreams previous didn't have go into slow start and the states operators
+// set are kept.
+func (lb *LoadBalancer) Inherit(previous *LoadBalancer) {
+	lb.adoptDiscovered(previous)
+
+	known := make(map[string]int32)
+	for _, u := range previous.members() {
+		known[u.url.String()] = u.state.Load()
+	}
+
+	for _, u := range lb.members() {
+		state, ok := known[u.url.String()]
+		if !ok {
+			lb.warm(u)
+			continue
+		}
+		u.state.Store(state)
+	}
+}
@@ -0,0 +1,176 @@
+package site
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewSiteHandlerWithPools(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pool"))
+	}))
+	defer upstream.Close()
+
+	api, err := NewPool(logger, "api", &global.Pool{Upstreams: []global.Upstream{{URL: upstream.URL}}})
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	defer api.Close()
+	pools := map[string]*LoadBalancer{"api": api}
+
+	t.Run("sites and paths share the pool", func(t *testing.T) {
+		whole, err := NewSiteHandlerWithPools(logger, &global.SiteConfig{
+			Domain:   "a.com",
+			Proxy:    global.Proxy{PathBase: global.PathBase{Pool: "api"}},
+			Timeouts: global.Timeouts{Read: 5 * time.Second},
+		}, pools)
+		if err != nil {
+			t.Fatalf("NewSiteHandlerWithPools failed: %v", err)
+		}
+
+		paths, err := NewSiteHandlerWithPools(logger, &global.SiteConfig{
+			Domain: "b.com",
+			Proxy: global.Proxy{
+				PathBase: global.PathBase{Pool: "api"},
+				Paths: []global.ProxyPath{
+					{Path: "/api/"},
+					{Path: "/v2/", PathBase: global.PathBase{Pool: "api"}},
+					{Path: "/static/", PathBase: global.PathBase{Upstreams: []global.Upstream{{URL: upstream.URL}}}},
+				},
+			},
+			Timeouts: global.Timeouts{Read: 5 * time.Second},
+		}, pools)
+		if err != nil {
+			t.Fatalf("NewSiteHandlerWithPools failed: %v", err)
+		}
+
+		if whole.Pools()["api"] != api || paths.Pools()["api"] != api {
+			t.Error("Expected both sites to use the pool's load balancer")
+		}
+		if paths.routes[0].lb != api || paths.routes[1].lb != api || paths.routes[2].lb == api {
+			t.Error("Expected only the paths without upstreams of their own to use the pool")
+		}
+
+		req := httptest.NewRequest("GET", "http://b.com/api/", nil)
+		rec := httptest.NewRecorder()
+		paths.Handler.ServeHTTP(rec, req)
+		if rec.Body.String() != "pool" {
+			t.Errorf("Expected 'pool', got '%s'", rec.Body.String())
+		}
+
+		status := paths.Status()
+		if status.Paths[0].Pool != "api" || status.Paths[2].Pool != "" {
+			t.Errorf("Expected the pool in the status of pooled paths only, got %+v", status.Paths)
+		}
+
+		// Closing a site leaves the pool to the other sites
+		whole.Close()
+		paths.Close()
+		select {
+		case <-api.stop:
+			t.Error("Expected the pool to keep running when its sites close")
+		default:
+		}
+	})
+
+	t.Run("sites share the pool's connections", func(t *testing.T) {
+		var connections atomic.Int32
+		counted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		counted.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				connections.Add(1)
+			}
+		}
+		counted.Start()
+		defer counted.Close()
+
+		shared, err := NewPool(logger, "shared", &global.Pool{Upstreams: []global.Upstream{{URL: counted.URL}}})
+		if err != nil {
+			t.Fatalf("NewPool failed: %v", err)
+		}
+		defer shared.Close()
+
+		for _, domain := range []string{"a.com", "b.com"} {
+			h, err := NewSiteHandlerWithPools(logger, &global.SiteConfig{
+				Domain:   domain,
+				Proxy:    global.Proxy{PathBase: global.PathBase{Pool: "shared"}},
+				Timeouts: global.Timeouts{Read: 5 * time.Second},
+			}, map[string]*LoadBalancer{"shared": shared})
+			if err != nil {
+				t.Fatalf("NewSiteHandlerWithPools failed: %v", err)
+			}
+			rec := httptest.NewRecorder()
+			h.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+domain+"/", nil))
+			if rec.Body.String() != "ok" {
+				t.Errorf("Expected 'ok', got '%s'", rec.Body.String())
+			}
+		}
+
+		if n := connections.Load(); n != 1 {
+			t.Errorf("Expected both sites to reuse one connection, got %d", n)
+		}
+	})
+
+	t.Run("invalid references", func(t *testing.T) {
+		testCases := []struct {
+			name     string
+			base     global.PathBase
+			expected string
+		}{
+			{"unknown pool", global.PathBase{Pool: "web"}, "unknown upstream pool web"},
+			{"pool with upstreams", global.PathBase{Pool: "api", Upstream: upstream.URL}, "pool api can't be combined"},
+			{"pool with load balancing", global.PathBase{Pool: "api", LoadBalance: &global.LoadBalance{}}, "pool api can't be combined"},
+		}
+		for _, tc := range testCases {
+			_, err := NewSiteHandlerWithPools(logger, &global.SiteConfig{
+				Domain: "example.com",
+				Proxy:  global.Proxy{Paths: []global.ProxyPath{{Path: "/", PathBase: tc.base}}},
+			}, pools)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.expected, err)
+			}
+		}
+	})
+
+	t.Run("pool without upstreams", func(t *testing.T) {
+		if _, err := NewPool(logger, "empty", &global.Pool{}); err == nil {
+			t.Error("Expected an error for a pool without upstreams")
+		}
+	})
+}
+
+func TestInherit(t *testing.T) {
+	previous := testBalancer(t, []string{"http://localhost:3000", "http://localhost:3001"}, withSlowStart(&global.SlowStart{Duration: "30s"}))
+	if err := previous.SetUpstreamState("http://localhost:3001", UpstreamDraining); err != nil {
+		t.Fatalf("SetUpstreamState failed: %v", err)
+	}
+
+	lb := testBalancer(t, []string{"http://localhost:3001", "http://localhost:3002"}, withSlowStart(&global.SlowStart{Duration: "30s"}))
+
+	lb.Inherit(previous)
+
+	for _, u := range lb.Upstreams() {
+		switch u.URL {
+		case "http://localhost:3001":
+			if u.State != UpstreamDraining {
+				t.Errorf("Expected %s to stay draining, got %s", u.URL, u.State)
+			}
+		case "http://localhost:3002":
+			if !u.Warming {
+				t.Errorf("Expected added %s to warm up", u.URL)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package site
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"reverse-proxy/internal/models/global"
+	"strings"
+	"time"
+)
+
+func newTransport() *http.Transport {
+	return &http.Transport{
+		MaxIdleConns:        1000,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// balancedProxy forwards requests to the members of a load balancer and,
+// when the balancer has a retry policy, retries failed attempts on another
+// member.
+type balancedProxy struct {
+	lb      *LoadBalancer
+	logger  *slog.Logger
+	cfg     *global.SiteConfig
+	pathCfg *global.ProxyPath // nil when proxying the whole site
+}
+
+func NewLoadBalancedProxy(lb *LoadBalancer, logger *slog.Logger, cfg *global.SiteConfig) http.Handler {
+	return &balancedProxy{
+		lb:     lb,
+		logger: logger,
+		cfg:    cfg,
+	}
+}
+
+func NewLoadBalancedProxyWithHeaders(lb *LoadBalancer, logger *slog.Logger, cfg *global.SiteConfig, pathCfg *global.ProxyPath) http.Handler {
+	return &balancedProxy{
+		lb:      lb,
+		logger:  logger,
+		cfg:     cfg,
+		pathCfg: pathCfg,
+	}
+}
+
+// logArgs appends the path configuration to log attributes for path proxies.
+func (p *balancedProxy) logArgs(args ...any) []any {
+	if p.pathCfg != nil {
+		args = append(args, "path_config", p.pathCfg.Path)
+	}
+	return args
+}
+
+func (p *balancedProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The proxy keeps its own deadline for the site timeout, so a request the
+	// upstream doesn't answer in time counts against it rather than passing
+	// for a client that went away
+	if timeout := Max(p.cfg.Timeouts.Read, p.cfg.Timeouts.Write); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	attempts := 1
+	var body []byte
+
+	// Only requests whose body fits in memory can be replayed
+	if policy := p.lb.retry; policy != nil && policy.allows(r) {
+		buffered, ok, err := bufferBody(r, policy.maxBodyBytes)
+		if err != nil {
+			p.logger.Error("Failed to read request body", p.logArgs("domain", p.cfg.Domain, "url", r.URL.String(), "error", err)...)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if ok {
+			attempts += policy.attempts
+			body = buffered
+		}
+	}
+
+	// Select ONE upstream server for this request
+	member, affinity := p.lb.route(r, p.cookiePath())
+	if member == nil {
+		p.unavailable(w, r)
+		return
+	}
+	tried := make(map[*upstream]bool)
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(p.lb.retry.delay(attempt - 1)):
+			}
+
+			// Prefer an upstream that hasn't failed this request yet
+			next := p.lb.pick(r, tried)
+			if next == nil {
+				p.unavailable(w, r)
+				return
+			}
+			if next != member {
+				member = next
+				affinity = p.lb.affinityCookie(r, member, p.cookiePath())
+			}
+		}
+		tried[member] = true
+
+		if p.forward(w, r, member, affinity, body, attempt, attempt >= attempts) {
+			return
+		}
+	}
+}
+
+// cookiePath returns the path the affinity cookies of the proxy are scoped
+// to, so the load balancers of a site's paths don't overwrite each other's.
+func (p *balancedProxy) cookiePath() string {
+	if p.pathCfg != nil && strings.HasPrefix(p.pathCfg.Path, "/") {
+		return p.pathCfg.Path
+	}
+	return "/"
+}
+
+// unavailable fails r fast because the circuit of every upstream is open.
+func (p *balancedProxy) unavailable(w http.ResponseWriter, r *http.Request) {
+	p.logger.Error("No upstream available", p.logArgs("domain", p.cfg.Domain, "url", r.URL.String())...)
+	http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+}
+
+// clientCanceled reports whether err, from sending r upstream, is down to
+// the client going away. Deadlines, whether the proxy's own or that of the
+// site timeout, are the upstream's fault.
+func clientCanceled(r *http.Request, err error) bool {
+	return errors.Is(context.Cause(r.Context()), context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// forward sends one attempt of r to member. It returns false when the
+// attempt failed in a way the retry policy covers and this isn't the last
+// attempt; otherwise a response has been written to w.
+func (p *balancedProxy) forward(w http.ResponseWriter, r *http.Request, member *upstream, affinity *http.Cookie, body []byte, attempt int, last bool) bool {
+	target := member.url
+
+	// The request counts as in flight until the response body is copied
+	member.inflight.Add(1)
+	defer member.inflight.Add(-1)
+
+	// The per-try timeout bounds the wait for the response headers only, the
+	// body may stream for as long as it takes
+	ctx := r.Context()
+	var headerTimer *time.Timer
+	if policy := p.lb.retry; policy != nil && policy.perTryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		headerTimer = time.AfterFunc(policy.perTryTimeout, cancel)
+	}
+
+	// Clone the original request to avoid modifying it
+	outReq := r.Clone(ctx)
+	if body != nil {
+		outReq.Body = io.NopCloser(bytes.NewReader(body))
+		outReq.ContentLength = int64(len(body))
+	}
+	outReq.URL.Scheme = target.Scheme
+	outReq.URL.Host = target.Host
+	// Keep the original request path
+	outReq.URL.Path = r.URL.Path
+	if target.RawPath != "" {
+		outReq.URL.RawPath = target.RawPath
+	}
+	if target.RawQuery == "" || r.URL.RawQuery == "" {
+		outReq.URL.RawQuery = target.RawQuery
+	} else {
+		outReq.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+	}
+
+	// Add global headers first
+	for k, v := range p.cfg.Proxy.Headers {
+		outReq.Header.Set(k, v)
+	}
+
+	// Add path-specific headers
+	if p.pathCfg != nil {
+		for k, v := range p.pathCfg.Headers {
+			outReq.Header.Set(k, v)
+		}
+	}
+
+	p.logger.Info("Load balanced request", p.logArgs("method", r.Method, "path", r.URL.Path, "target", target.String(), "attempt", attempt)...)
+
+	// Make the request to the selected upstream
+	start := time.Now()
+	resp, err := p.lb.transport.RoundTrip(outReq)
+	if headerTimer != nil && !headerTimer.Stop() {
+		// The timeout fired, if only just after the headers came in: the body
+		// would be cut off, so the attempt failed
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		err = errPerTryTimeout
+	}
+	if err != nil {
+		// A client that went away says nothing about the upstream
+		clientGone := clientCanceled(r, err)
+		if clientGone {
+			member.breaker.release()
+		} else {
+			p.lb.recordFailure(member, time.Since(start))
+			p.lb.observe(member, 0, err)
+		}
+		p.logger.Error("Upstream error", p.logArgs("domain", p.cfg.Domain, "url", r.URL.String(), "target", target.String(), "attempt", attempt, "error", err)...)
+
+		if !last && !clientGone && p.lb.retry.onError {
+			return false
+		}
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return true
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	p.lb.recordLatency(member, time.Since(start))
+	p.lb.observe(member, resp.StatusCode, nil)
+
+	if !last && p.lb.retry.retryStatus(resp.StatusCode) {
+		p.logger.Warn("Retrying upstream response", p.logArgs("status", resp.StatusCode, "target", target.String(), "attempt", attempt)...)
+		return false
+	}
+
+	p.logger.Info("Upstream response", p.logArgs("status", resp.StatusCode, "size", resp.ContentLength, "target", target.String())...)
+
+	// Copy response headers
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	// Pin the client to the upstream that served it
+	if affinity != nil {
+		http.SetCookie(w, affinity)
+	}
+
+	// Copy status code and body
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		p.logger.Error("Failed to copy response body", "error", err)
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package site
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reverse-proxy/internal/models/global"
+	"strconv"
+	"time"
+)
+
+// maxRetryAttempts is the most retries a request gets.
+const maxRetryAttempts = 10
+
+// maxRetryBackoff bounds the backoff, which doubles with every retry.
+const maxRetryBackoff = 10 * time.Second
+
+// errPerTryTimeout fails an attempt whose upstream didn't send the response
+// headers within the per-try timeout.
+var errPerTryTimeout = errors.New("per-try timeout exceeded")
+
+// retryPolicy holds the parsed form of a global.Retry.
+type retryPolicy struct {
+	attempts      int
+	onError       bool
+	on5xx         bool
+	statuses      map[int]bool
+	nonIdempotent bool
+	perTryTimeout time.Duration
+	backoff       time.Duration
+	maxBodyBytes  int64
+}
+
+func newRetryPolicy(cfg *global.Retry) (*retryPolicy, error) {
+	p := &retryPolicy{
+		attempts:      2,
+		statuses:      make(map[int]bool),
+		nonIdempotent: cfg.NonIdempotent,
+		backoff:       25 * time.Millisecond,
+		maxBodyBytes:  64 << 10,
+	}
+
+	if cfg.Attempts > maxRetryAttempts {
+		return nil, fmt.Errorf("invalid retry attempts: %d, at most %d", cfg.Attempts, maxRetryAttempts)
+	}
+	if cfg.Attempts > 0 {
+		p.attempts = cfg.Attempts
+	}
+
+	on := cfg.On
+	if len(on) == 0 {
+		on = []string{"error", "502", "503", "504"}
+	}
+	for _, cond := range on {
+		switch cond {
+		case "error":
+			p.onError = true
+		case "5xx":
+			p.on5xx = true
+		default:
+			status, err := strconv.Atoi(cond)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid retry condition: %s", cond)
+			}
+			p.statuses[status] = true
+		}
+	}
+
+	var err error
+	if cfg.PerTryTimeout != "" {
+		if p.perTryTimeout, err = time.ParseDuration(cfg.PerTryTimeout); err != nil || p.perTryTimeout <= 0 {
+			return nil, fmt.Errorf("invalid per-try timeout: %s", cfg.PerTryTimeout)
+		}
+	}
+	if cfg.Backoff != "" {
+		if p.backoff, err = time.ParseDuration(cfg.Backoff); err != nil || p.backoff < 0 {
+			return nil, fmt.Errorf("invalid retry backoff: %s", cfg.Backoff)
+		}
+	}
+	if cfg.MaxBodyBytes > 0 {
+		p.maxBodyBytes = cfg.MaxBodyBytes
+	}
+
+	return p, nil
+}
+
+// EnableRetries makes the load-balanced proxies retry failed requests on a
+// different upstream.
+func (lb *LoadBalancer) EnableRetries(cfg *global.Retry) error {
+	p, err := newRetryPolicy(cfg)
+	if err != nil {
+		return err
+	}
+
+	lb.retry = p
+	return nil
+}
+
+// retryStatus reports whether a response with the given status is retried.
+func (p *retryPolicy) retryStatus(status int) bool {
+	return p.statuses[status] || (p.on5xx && status >= http.StatusInternalServerError)
+}
+
+// allows reports whether r may be retried at all.
+func (p *retryPolicy) allows(r *http.Request) bool {
+	if p.nonIdempotent {
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	// Clients mark requests they are fine with replaying
+	return r.Header.Get("Idempotency-Key") != ""
+}
+
+// delay returns the backoff before the n-th retry, starting at n = 1, at
+// most maxRetryBackoff.
+func (p *retryPolicy) delay(n int) time.Duration {
+	d := p.backoff
+	for i := 1; i < n && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// bufferBody reads r's body into memory so it can be sent more than once.
+// It returns false, and leaves r with an equivalent unread body, when the
+// body is larger than limit.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	_ = r.Body.Close()
+	return data, true, nil
+}
@@ -0,0 +1,216 @@
+package site
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newRetryProxy(t *testing.T, upstreams []string, cfg *global.Retry) http.Handler {
+	t.Helper()
+	lb := testBalancer(t, upstreams, withRetries(cfg))
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	return NewLoadBalancedProxy(lb, logger, &global.SiteConfig{Domain: "example.com"})
+}
+
+func TestRetries(t *testing.T) {
+	t.Run("connection error fails over to another upstream", func(t *testing.T) {
+		dead := httptest.NewServer(http.NotFoundHandler())
+		deadURL := dead.URL
+		dead.Close()
+		healthy := newNamedUpstream(t, "healthy")
+
+		proxy := newRetryProxy(t, []string{deadURL, healthy.URL}, &global.Retry{Backoff: "1ms"})
+
+		for i := 0; i < 4; i++ {
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+			if rec.Code != http.StatusOK || rec.Body.String() != "healthy" {
+				t.Errorf("Expected 200 from healthy upstream, got %d '%s'", rec.Code, rec.Body.String())
+			}
+		}
+	})
+
+	t.Run("retryable status with replayed body", func(t *testing.T) {
+		var failingHits atomic.Int32
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			failingHits.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+
+		echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Write(body)
+		}))
+		defer echo.Close()
+
+		proxy := newRetryProxy(t, []string{failing.URL, echo.URL}, &global.Retry{Backoff: "1ms"})
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("PUT", "http://example.com/", strings.NewReader("payload")))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", rec.Code)
+		}
+		if rec.Body.String() != "payload" {
+			t.Errorf("Expected replayed body 'payload', got '%s'", rec.Body.String())
+		}
+		if failingHits.Load() != 1 {
+			t.Errorf("Expected failing upstream to be tried once, got %d", failingHits.Load())
+		}
+	})
+
+	t.Run("non-idempotent methods are not retried by default", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer failing.Close()
+		healthy := newNamedUpstream(t, "healthy")
+
+		proxy := newRetryProxy(t, []string{failing.URL, healthy.URL}, &global.Retry{Backoff: "1ms"})
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("POST", "http://example.com/", strings.NewReader("order")))
+
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503 without retry, got %d", rec.Code)
+		}
+	})
+
+	t.Run("per-try timeout moves on to the next upstream", func(t *testing.T) {
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer slow.Close()
+		fast := newNamedUpstream(t, "fast")
+
+		proxy := newRetryProxy(t, []string{slow.URL, fast.URL}, &global.Retry{
+			PerTryTimeout: "50ms",
+			Backoff:       "1ms",
+		})
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+
+		if rec.Body.String() != "fast" {
+			t.Errorf("Expected response from fast upstream, got '%s'", rec.Body.String())
+		}
+	})
+
+	t.Run("per-try timeout doesn't cut off a slow body", func(t *testing.T) {
+		streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 3; i++ {
+				w.Write([]byte("chunk "))
+				w.(http.Flusher).Flush()
+				time.Sleep(40 * time.Millisecond)
+			}
+		}))
+		defer streaming.Close()
+
+		proxy := newRetryProxy(t, []string{streaming.URL}, &global.Retry{PerTryTimeout: "50ms"})
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+
+		if rec.Body.String() != "chunk chunk chunk " {
+			t.Errorf("Expected the whole body, got '%s'", rec.Body.String())
+		}
+	})
+
+	t.Run("last attempt's response is returned", func(t *testing.T) {
+		var hits atomic.Int32
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer failing.Close()
+
+		proxy := newRetryProxy(t, []string{failing.URL}, &global.Retry{Attempts: 2, Backoff: "1ms"})
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", rec.Code)
+		}
+		if hits.Load() != 3 {
+			t.Errorf("Expected 3 attempts, got %d", hits.Load())
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://localhost:3000"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		if err := lb.EnableRetries(&global.Retry{On: []string{"sometimes"}}); err == nil {
+			t.Error("Expected error for invalid retry condition, got nil")
+		}
+
+		if err := lb.EnableRetries(&global.Retry{PerTryTimeout: "fast"}); err == nil {
+			t.Error("Expected error for invalid per-try timeout, got nil")
+		}
+
+		if err := lb.EnableRetries(&global.Retry{Attempts: maxRetryAttempts + 1}); err == nil {
+			t.Error("Expected error for too many attempts, got nil")
+		}
+	})
+
+	t.Run("backoff doubles up to the maximum", func(t *testing.T) {
+		p, err := newRetryPolicy(&global.Retry{Backoff: "1s"})
+		if err != nil {
+			t.Fatalf("newRetryPolicy failed: %v", err)
+		}
+
+		for n, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: maxRetryBackoff, 100: maxRetryBackoff} {
+			if d := p.delay(n); d != want {
+				t.Errorf("Expected delay %s before retry %d, got %s", want, n, d)
+			}
+		}
+	})
+}
+
+func TestBufferBody(t *testing.T) {
+	t.Run("small body is buffered", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "http://example.com/", strings.NewReader("small"))
+
+		data, ok, err := bufferBody(req, 16)
+		if err != nil || !ok {
+			t.Fatalf("Expected body to be buffered, got ok=%v err=%v", ok, err)
+		}
+		if string(data) != "small" {
+			t.Errorf("Expected 'small', got '%s'", data)
+		}
+	})
+
+	t.Run("large body is left intact", func(t *testing.T) {
+		payload := strings.Repeat("x", 32)
+		req := httptest.NewRequest("PUT", "http://example.com/", strings.NewReader(payload))
+		req.ContentLength = -1
+
+		_, ok, err := bufferBody(req, 16)
+		if err != nil {
+			t.Fatalf("bufferBody failed: %v", err)
+		}
+		if ok {
+			t.Error("Expected body over the limit not to be buffered")
+		}
+
+		rest, _ := io.ReadAll(req.Body)
+		if string(rest) != payload {
+			t.Errorf("Expected untouched body, got %d bytes", len(rest))
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package site
+
+import (
+	"fmt"
+	"reverse-proxy/internal/models/global"
+	"time"
+)
+
+// slowStart holds the parsed form of a global.SlowStart.
+type slowStart struct {
+	duration  time.Duration
+	minWeight float64
+}
+
+func newSlowStart(cfg *global.SlowStart) (*slowStart, error) {
+	s := &slowStart{
+		duration:  30 * time.Second,
+		minWeight: 0.1,
+	}
+
+	var err error
+	if cfg.Duration != "" {
+		if s.duration, err = time.ParseDuration(cfg.Duration); err != nil || s.duration <= 0 {
+			return nil, fmt.Errorf("invalid slow start duration: %s", cfg.Duration)
+		}
+	}
+	if cfg.MinWeight < 0 || cfg.MinWeight > 1 {
+		return nil, fmt.Errorf("invalid slow start min weight: %v", cfg.MinWeight)
+	}
+	if cfg.MinWeight > 0 {
+		s.minWeight = cfg.MinWeight
+	}
+
+	return s, nil
+}
+
+// factor returns the share of its weight u currently gets, between
+// minWeight right after it started warming up and 1 once it is done.
+func (s *slowStart) factor(u *upstream, now time.Time) float64 {
+	since := u.warmingSince.Load()
+	if since == 0 {
+		return 1
+	}
+
+	elapsed := now.Sub(time.Unix(0, since))
+	if elapsed >= s.duration {
+		return 1
+	}
+	return s.minWeight + (1-s.minWeight)*float64(elapsed)/float64(s.duration)
+}
+
+// EnableSlowStart makes upstreams that were just added or recovered ramp up
+// their traffic instead of getting their full share at once.
+func (lb *LoadBalancer) EnableSlowStart(cfg *global.SlowStart) error {
+	s, err := newSlowStart(cfg)
+	if err != nil {
+		return err
+	}
+
+	lb.slowStart = s
+	return nil
+}
+
+// warm starts the slow start window of u. It does nothing unless slow start
+// is enabled.
+func (lb *LoadBalancer) warm(u *upstream) {
+	if lb.slowStart == nil {
+		return
+	}
+
+	u.warmingSince.Store(time.Now().UnixNano())
+	lb.logger.Info("Upstream warming up", "upstream", u.url.String(), "duration", lb.slowStart.duration)
+}
+
+// share returns the part of its weight u currently gets: 1 unless u is
+// warming up. Every algorithm scales its notion of weight by it, so a warming
+// upstream's traffic ramps up linearly and keys stay on their upstream.
+func (lb *LoadBalancer) share(u *upstream) float64 {
+	if lb.slowStart == nil || u.warmingSince.Load() == 0 {
+		return 1
+	}
+	return lb.slowStart.factor(u, time.Now())
+}
+
+// warming reports whether any of candidates is short of its full weight.
+func (lb *LoadBalancer) warming(candidates []*upstream) bool {
+	if lb.slowStart == nil {
+		return false
+	}
+	for _, u := range candidates {
+		if lb.share(u) < 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// SlowStartAdded puts the upstreams of h that previous didn't have into slow
+// start, so members added by a reload ramp up like recovered ones. Pools are
+// left out, see Inherit.
+func (h *Handler) SlowStartAdded(previous *Handler) {
+	known := make(map[string]bool)
+	for _, r := range previous.routes {
+		if r.lb == nil || r.pool != "" {
+			continue
+		}
+		for _, u := range r.lb.members() {
+			known[u.url.String()] = true
+		}
+	}
+
+	for _, r := range h.routes {
+		if r.lb == nil || r.pool != "" {
+			continue
+		}
+		for _, u := range r.lb.members() {
+			if !known[u.url.String()] {
+				r.lb.warm(u)
+			}
+		}
+	}
+}
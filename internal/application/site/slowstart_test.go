@@ -0,0 +1,196 @@
+package site
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"testing"
+	"time"
+)
+
+func TestSlowStart(t *testing.T) {
+	t.Run("effective weight ramps linearly", func(t *testing.T) {
+		s, err := newSlowStart(&global.SlowStart{Duration: "10s", MinWeight: 0.2})
+		if err != nil {
+			t.Fatalf("newSlowStart failed: %v", err)
+		}
+
+		u := &upstream{}
+		now := time.Now()
+		if f := s.factor(u, now); f != 1 {
+			t.Errorf("Expected factor 1 for an upstream that never warmed, got %v", f)
+		}
+
+		testCases := []struct {
+			elapsed  time.Duration
+			expected float64
+		}{
+			{0, 0.2},
+			{5 * time.Second, 0.6},
+			{10 * time.Second, 1},
+			{time.Minute, 1},
+		}
+		for _, tc := range testCases {
+			u.warmingSince.Store(now.Add(-tc.elapsed).UnixNano())
+			if f := s.factor(u, now); f < tc.expected-0.001 || f > tc.expected+0.001 {
+				t.Errorf("After %v expected factor %v, got %v", tc.elapsed, tc.expected, f)
+			}
+		}
+	})
+
+	for _, algorithm := range []string{"round-robin", "weighted-round-robin", "least-conn", "random", "p2c-ewma", "hash"} {
+		t.Run("warming upstream gets a reduced share with "+algorithm, func(t *testing.T) {
+			lb := testBalancer(t, []string{"http://localhost:3000", "http://localhost:3001"}, withAlgorithm(algorithm), withSlowStart(&global.SlowStart{Duration: "1h", MinWeight: 0.1}))
+			warming := lb.upstreams[1]
+			lb.warm(warming)
+
+			// Keep a few requests in flight, the load-aware algorithms weigh
+			// them against the share
+			var inflight []*upstream
+			picks := 0
+			for i := 0; i < 2000; i++ {
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+				u := lb.pick(req, nil)
+				if u == warming {
+					picks++
+				}
+				u.inflight.Add(1)
+				inflight = append(inflight, u)
+				if len(inflight) > 10 {
+					inflight[0].inflight.Add(-1)
+					inflight = inflight[1:]
+				}
+			}
+
+			if picks == 0 || picks > 300 {
+				t.Errorf("Expected a warming upstream to get a small share, got %d of 2000", picks)
+			}
+		})
+	}
+
+	t.Run("hash keys move to a warming upstream once", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000", "http://localhost:3001"}, withAlgorithm("hash"), withSlowStart(&global.SlowStart{Duration: "10s", MinWeight: 0.1}))
+		warming := lb.upstreams[1]
+
+		requests := make([]*http.Request, 500)
+		for i := range requests {
+			requests[i] = httptest.NewRequest("GET", "http://example.com/", nil)
+			requests[i].RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+		}
+
+		previous := make([]*upstream, len(requests))
+		for _, elapsed := range []time.Duration{0, 2 * time.Second, 5 * time.Second, 8 * time.Second, 10 * time.Second} {
+			warming.warmingSince.Store(time.Now().Add(-elapsed).UnixNano())
+
+			picks := 0
+			for i, req := range requests {
+				u := lb.pick(req, nil)
+				if u != lb.pick(req, nil) {
+					t.Fatalf("After %v expected the same upstream for the same key", elapsed)
+				}
+				if previous[i] == warming && u != warming {
+					t.Errorf("After %v expected key %d to stay on the warming upstream", elapsed, i)
+				}
+				if u == warming {
+					picks++
+				}
+				previous[i] = u
+			}
+			if elapsed == 0 && (picks == 0 || picks > 100) {
+				t.Errorf("Expected a small share of the keys at first, got %d of %d", picks, len(requests))
+			}
+			if elapsed == 10*time.Second && (picks < 150 || picks > 350) {
+				t.Errorf("Expected about half of the keys when warm, got %d of %d", picks, len(requests))
+			}
+		}
+	})
+
+	t.Run("full share after the window", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000", "http://localhost:3001"}, withSlowStart(&global.SlowStart{Duration: "20ms"}))
+		warming := lb.upstreams[1]
+		lb.warm(warming)
+
+		if status := lb.Upstreams()[1]; !status.Warming {
+			t.Error("Expected upstream to report warming")
+		}
+
+		time.Sleep(30 * time.Millisecond)
+
+		picks := 0
+		for i := 0; i < 100; i++ {
+			if lb.pick(nil, nil) == warming {
+				picks++
+			}
+		}
+		if picks != 50 {
+			t.Errorf("Expected an even split after slow start, got %d of 100", picks)
+		}
+		if status := lb.Upstreams()[1]; status.Warming {
+			t.Error("Expected upstream to be done warming")
+		}
+	})
+
+	t.Run("readmitted upstream warms up", func(t *testing.T) {
+		lb := testBalancer(t, []string{"http://localhost:3000", "http://localhost:3001"}, withSlowStart(&global.SlowStart{Duration: "1h"}))
+		if err := lb.EnableOutlierDetection(&global.OutlierDetection{
+			ConsecutiveErrors: 1,
+			BaseEjectionTime:  "10ms",
+		}); err != nil {
+			t.Fatalf("EnableOutlierDetection failed: %v", err)
+		}
+
+		u := lb.upstreams[0]
+		lb.observe(u, 500, nil)
+		waitFor(t, func() bool { return !u.ejected.Load() })
+
+		if u.warmingSince.Load() == 0 {
+			t.Error("Expected readmitted upstream to start warming up")
+		}
+	})
+
+	t.Run("upstreams added on reload warm up", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+		newHandler := func(upstreams ...string) *Handler {
+			cfg := &global.SiteConfig{Domain: "example.com"}
+			for _, u := range upstreams {
+				cfg.Proxy.Upstreams = append(cfg.Proxy.Upstreams, global.Upstream{URL: u})
+			}
+			cfg.Proxy.LoadBalance = &global.LoadBalance{SlowStart: &global.SlowStart{}}
+			h, err := NewSiteHandler(logger, cfg)
+			if err != nil {
+				t.Fatalf("NewSiteHandler failed: %v", err)
+			}
+			return h
+		}
+
+		previous := newHandler("http://localhost:3000", "http://localhost:3001")
+		current := newHandler("http://localhost:3000", "http://localhost:3001", "http://localhost:3002")
+		current.SlowStartAdded(previous)
+
+		for _, status := range current.lb.Upstreams() {
+			expected := status.URL == "http://localhost:3002"
+			if status.Warming != expected {
+				t.Errorf("Expected %s warming=%v, got %v", status.URL, expected, status.Warming)
+			}
+		}
+	})
+
+	t.Run("invalid configuration", func(t *testing.T) {
+		lb, err := NewLoadBalancer([]string{"http://localhost:3000"}, "round-robin")
+		if err != nil {
+			t.Fatalf("NewLoadBalancer failed: %v", err)
+		}
+
+		if err := lb.EnableSlowStart(&global.SlowStart{Duration: "-1s"}); err == nil {
+			t.Error("Expected error for invalid duration, got nil")
+		}
+
+		if err := lb.EnableSlowStart(&global.SlowStart{MinWeight: 2}); err == nil {
+			t.Error("Expected error for invalid min weight, got nil")
+		}
+	})
+}
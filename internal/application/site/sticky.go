@@ -0,0 +1,176 @@
+package site
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reverse-proxy/internal/models/global"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processSecret signs affinity cookies of sites that don't configure a secret.
+var processSecret = sync.OnceValue(func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(fmt.Sprintf("failed to generate sticky session secret: %v", err))
+	}
+	return secret
+})
+
+// stickiness holds the parsed form of a global.Sticky.
+type stickiness struct {
+	cookie string
+	secret []byte
+	maxAge time.Duration
+}
+
+func newStickiness(cfg *global.Sticky) (*stickiness, error) {
+	s := &stickiness{
+		cookie: cfg.Cookie,
+		secret: []byte(cfg.Secret),
+	}
+
+	if s.cookie == "" {
+		s.cookie = "rp_affinity"
+	}
+	if len(s.secret) == 0 {
+		s.secret = processSecret()
+	}
+	if cfg.MaxAge != "" {
+		var err error
+		if s.maxAge, err = time.ParseDuration(cfg.MaxAge); err != nil || s.maxAge < 0 {
+			return nil, fmt.Errorf("invalid sticky max age: %s", cfg.MaxAge)
+		}
+	}
+
+	return s, nil
+}
+
+// upstreamID identifies an upstream in affinity cookies without exposing its
+// address to clients.
+func upstreamID(u *url.URL) string {
+	sum := sha256.Sum256([]byte(u.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *stickiness) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the upstream ID carried by a cookie value, or false if the
+// signature doesn't match.
+func (s *stickiness) verify(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+	return id, hmac.Equal([]byte(s.sign(id)), []byte(value))
+}
+
+// EnableSticky pins clients to the upstream that served their first request
+// by issuing a signed affinity cookie.
+func (lb *LoadBalancer) EnableSticky(cfg *global.Sticky) error {
+	s, err := newStickiness(cfg)
+	if err != nil {
+		return err
+	}
+
+	lb.sticky = s
+	return nil
+}
+
+// route picks the upstream for r, which was routed to the proxy for path.
+// With sticky sessions it honours a valid affinity cookie as long as its
+// upstream is still a member and serving, which includes draining, and isn't
+// a backup while a primary is back, and otherwise returns the cookie the
+// response must carry to re-pin the client.
+func (lb *LoadBalancer) route(r *http.Request, path string) (*upstream, *http.Cookie) {
+	if u := lb.pinned(r); u != nil {
+		return u, nil
+	}
+
+	u := lb.pick(r, nil)
+	if u == nil {
+		return nil, nil
+	}
+	return u, lb.affinityCookie(r, u, path)
+}
+
+// pinned returns the upstream an affinity cookie of r pins it to, if it may
+// serve r. Paths of a site each have their own cookie, and the client sends
+// those of every path above the request's, so the first one naming a member
+// wins.
+func (lb *LoadBalancer) pinned(r *http.Request) *upstream {
+	s := lb.sticky
+	if s == nil {
+		return nil
+	}
+
+	for _, c := range r.Cookies() {
+		if c.Name != s.cookie {
+			continue
+		}
+		id, ok := s.verify(c.Value)
+		if !ok {
+			continue
+		}
+		u := lb.member(id)
+		if u == nil {
+			continue
+		}
+		if !u.serving() || (u.backup && lb.primaryAvailable()) {
+			return nil
+		}
+		ok, from, to := u.breaker.tryAcquire()
+		lb.logTransition(u, from, to)
+		if !ok {
+			return nil
+		}
+		return u
+	}
+	return nil
+}
+
+// affinityCookie returns the cookie pinning the client of r to u for the
+// requests under path, or nil without sticky sessions.
+func (lb *LoadBalancer) affinityCookie(r *http.Request, u *upstream, path string) *http.Cookie {
+	s := lb.sticky
+	if s == nil {
+		return nil
+	}
+
+	cookie := &http.Cookie{
+		Name:     s.cookie,
+		Value:    s.sign(u.id),
+		Path:     path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if s.maxAge > 0 {
+		cookie.MaxAge = int(s.maxAge / time.Second)
+	}
+	return cookie
+}
+
+// member returns the upstream with the given ID.
+func (lb *LoadBalancer) member(id string) *upstream {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for _, u := range lb.upstreams {
+		if u.id == id {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package site
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"reverse-proxy/internal/models/global"
+	"testing"
+	"time"
+)
+
+func newNamedUpstream(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newStickyProxy(t *testing.T, upstreams []string) (*LoadBalancer, http.Handler) {
+	t.Helper()
+	lb := testBalancer(t, upstreams, withSticky(&global.Sticky{Secret: "test-secret"}))
+	logger := slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	return lb, NewLoadBalancedProxy(lb, logger, &global.SiteConfig{Domain: "example.com"})
+}
+
+// send issues a request carrying cookie (if any) and returns the body and the
+// affinity cookie set by the response, if any.
+func send(proxy http.Handler, cookie *http.Cookie) (string, *http.Cookie) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "rp_affinity" {
+			return rec.Body.String(), c
+		}
+	}
+	return rec.Body.String(), nil
+}
+
+func TestStickySessions(t *testing.T) {
+	t.Run("client stays on its upstream", func(t *testing.T) {
+		a := newNamedUpstream(t, "a")
+		b := newNamedUpstream(t, "b")
+		_, proxy := newStickyProxy(t, []string{a.URL, b.URL})
+
+		first, cookie := send(proxy, nil)
+		if cookie == nil {
+			t.Fatal("Expected affinity cookie on first response")
+		}
+
+		for i := 0; i < 4; i++ {
+			body, reissued := send(proxy, cookie)
+			if body != first {
+				t.Errorf("Expected sticky upstream %s, got %s", first, body)
+			}
+			if reissued != nil {
+				t.Error("Expected no new cookie while pinned upstream is available")
+			}
+		}
+	})
+
+	t.Run("unhealthy upstream re-pins client", func(t *testing.T) {
+		a := newNamedUpstream(t, "a")
+		b := newNamedUpstream(t, "b")
+		lb, proxy := newStickyProxy(t, []string{a.URL, b.URL})
+
+		first, cookie := send(proxy, nil)
+		pinned := a.URL
+		if first == "b" {
+			pinned = b.URL
+		}
+		for _, u := range lb.upstreams {
+			if u.url.String() == pinned {
+				u.healthy.Store(false)
+			}
+		}
+
+		body, reissued := send(proxy, cookie)
+		if body == first {
+			t.Errorf("Expected to move away from unhealthy upstream %s", first)
+		}
+		if reissued == nil {
+			t.Error("Expected new affinity cookie after re-pinning")
+		}
+	})
+
+	t.Run("removed upstream re-pins client", func(t *testing.T) {
+		a := newNamedUpstream(t, "a")
+		b := newNamedUpstream(t, "b")
+		_, before := newStickyProxy(t, []string{a.URL})
+
+		_, cookie := send(before, nil)
+
+		// Same secret, as after a reload that dropped upstream a
+		_, after := newStickyProxy(t, []string{b.URL})
+		body, reissued := send(after, cookie)
+		if body != "b" {
+			t.Errorf("Expected remaining upstream b, got %s", body)
+		}
+		if reissued == nil {
+			t.Error("Expected new affinity cookie after re-pinning")
+		}
+	})
+
+	t.Run("tampered cookie is ignored", func(t *testing.T) {
+		a := newNamedUpstream(t, "a")
+		_, proxy := newStickyProxy(t, []string{a.URL})
+
+		_, reissued := send(proxy, &http.Cookie{Name: "rp_affinity", Value: "deadbeef.forged"})
+		if reissued == nil {
+			t.Error("Expected forged cookie to be replaced")
+		}
+	})
+	t.Run("paths keep their own pins", func(t *testing.T) {
+		sticky := &global.LoadBalance{Sticky: &global.Sticky{Secret: "test-secret"}}
+		handler, err := NewSiteHandler(slog.New(slog.NewTextHandler(io.Discard, nil)), &global.SiteConfig{
+			Domain: "example.com",
+			Proxy: global.Proxy{
+				Paths: []global.ProxyPath{
+					{Path: "/api/", PathBase: global.PathBase{
+						Upstreams: []global.Upstream{
+							{URL: newNamedUpstream(t, "api-a").URL},
+							{URL: newNamedUpstream(t, "api-b").URL},
+						},
+						LoadBalance: sticky,
+					}},
+					{Path: "/", PathBase: global.PathBase{
+						Upstreams: []global.Upstream{
+							{URL: newNamedUpstream(t, "web-a").URL},
+							{URL: newNamedUpstream(t, "web-b").URL},
+						},
+						LoadBalance: sticky,
+					}},
+				},
+			},
+			Timeouts: global.Timeouts{Read: 5 * time.Second},
+		})
+		if err != nil {
+			t.Fatalf("NewSiteHandler failed: %v", err)
+		}
+		defer handler.Close()
+
+		server := httptest.NewServer(handler.Handler)
+		defer server.Close()
+		jar, _ := cookiejar.New(nil)
+		client := &http.Client{Jar: jar}
+
+		get := func(path string) string {
+			resp, err := client.Get(server.URL + path)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", path, err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return string(body)
+		}
+
+		api, web := get("/api/users"), get("/")
+		for i := 0; i < 4; i++ {
+			if body := get("/api/users"); body != api {
+				t.Errorf("Expected /api/ to stay on %s, got %s", api, body)
+			}
+			if body := get("/"); body != web {
+				t.Errorf("Expected / to stay on %s, got %s", web, body)
+			}
+		}
+	})
+}
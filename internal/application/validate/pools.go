@@ -0,0 +1,41 @@
+package validate
+
+import (
+	"reverse-proxy/internal/application/config"
+	"reverse-proxy/internal/application/site"
+	"reverse-proxy/internal/models/global"
+)
+
+// checkPools checks every pool file in the upstreams.d directory of dir and
+// returns the names of the pools sites can refer to.
+func checkPools(dir string) (map[string]bool, []Problem) {
+	files, err := config.PoolFiles(dir)
+	if err != nil {
+		return nil, []Problem{{File: dir, Message: err.Error()}}
+	}
+
+	var problems []Problem
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		// A broken pool is reported here, not again by every site using it
+		names[config.PoolName(file)] = true
+
+		c := &checker{file: file, dir: dir}
+		var pool global.Pool
+		if root := c.read(&pool); root != nil {
+			p := &global.PathBase{
+				Upstreams:       pool.Upstreams,
+				BackupUpstreams: pool.BackupUpstreams,
+				Discovery:       pool.Discovery,
+				LoadBalance:     pool.LoadBalance,
+			}
+			c.pathBase(root, p, nil)
+			if _, ok := site.BalancedUpstreams(p); !ok {
+				c.add(root, "no upstreams or discovery configured")
+			}
+		}
+		problems = append(problems, c.problems...)
+	}
+
+	return names, problems
+}
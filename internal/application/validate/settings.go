@@ -0,0 +1,107 @@
+package validate
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"reverse-proxy/internal/application/config"
+	"reverse-proxy/internal/application/provider"
+	"reverse-proxy/internal/models/global"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkSettings checks the settings file at path. It also returns how site
+// files declaring the same domain are to be combined.
+func checkSettings(path string) ([]Problem, string) {
+	c := &checker{file: path, dir: filepath.Dir(path)}
+	var cfg global.Settings
+	root := c.read(&cfg)
+	if root == nil {
+		return c.problems, config.DuplicatesError
+	}
+	config.ResolveSettingsPaths(&cfg, c.dir)
+
+	duplicates, err := config.ParseDuplicates(cfg.Sites.Duplicates)
+	if err != nil {
+		c.add(position(field(root, "sites"), "duplicates"), "%v", err)
+		duplicates = config.DuplicatesError
+	}
+
+	server := orParent(field(root, "server"), root)
+	c.listen(position(server, "listen"), cfg.Server.Listen)
+
+	if cfg.Server.TLS != nil {
+		tlsNode := orParent(field(server, "tls"), server)
+		c.listen(position(tlsNode, "listen"), cfg.Server.TLS.Listen)
+		c.certificate(tlsNode, cfg.Server.TLS)
+	}
+
+	if cfg.Admin != nil {
+		admin := orParent(field(root, "admin"), root)
+		c.listen(position(admin, "listen"), cfg.Admin.Listen)
+	}
+
+	providers := orParent(field(root, "providers"), root)
+	if cfg.Providers.Docker != nil {
+		// The constructor only checks the endpoint, it doesn't connect
+		if _, err := provider.NewDocker(nil, cfg.Providers.Docker); err != nil {
+			c.add(position(providers, "docker"), "%v", err)
+		}
+	}
+	if k := cfg.Providers.Kubernetes; k != nil {
+		node := orParent(field(providers, "kubernetes"), providers)
+		c.readable(position(node, "token_file"), "kubernetes token", k.TokenFile)
+		c.readable(position(node, "ca_file"), "kubernetes CA", k.CAFile)
+	}
+
+	return c.problems, duplicates
+}
+
+// listen checks that the address at node is a host:port, if it is set.
+func (c *checker) listen(node *yaml.Node, address string) {
+	if address == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		c.add(node, "invalid listen address %s: %v", address, err)
+	}
+}
+
+// certificate checks that the TLS certificate and key files are readable and
+// belong together.
+func (c *checker) certificate(node *yaml.Node, cfg *global.TLS) {
+	certOK := c.required(node, "cert_file", cfg.CertFile) && c.readable(position(node, "cert_file"), "TLS certificate", cfg.CertFile)
+	keyOK := c.required(node, "key_file", cfg.KeyFile) && c.readable(position(node, "key_file"), "TLS key", cfg.KeyFile)
+	if !certOK || !keyOK {
+		return
+	}
+
+	if _, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+		c.add(node, "invalid TLS certificate: %v", err)
+	}
+}
+
+// required reports a problem if the value of key in node is empty.
+func (c *checker) required(node *yaml.Node, key, value string) bool {
+	if value == "" {
+		c.add(node, "%s missing", key)
+		return false
+	}
+	return true
+}
+
+// readable reports a problem if the file at path, when set, can't be read.
+func (c *checker) readable(node *yaml.Node, what, path string) bool {
+	if path == "" {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		c.add(node, "%s not readable: %v", what, err)
+		return false
+	}
+	f.Close()
+	return true
+}
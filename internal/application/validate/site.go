@@ -0,0 +1,174 @@
+package validate
+
+import (
+	"net/url"
+	"path/filepath"
+	"reverse-proxy/internal/application/config"
+	"reverse-proxy/internal/application/site"
+	"reverse-proxy/internal/models/global"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkSites checks every site file in dir and returns how many there are.
+// Files declaring the same domain are combined according to duplicates, and
+// sites may refer to the pools named in pools.
+func checkSites(dir, duplicates string, pools map[string]bool) (int, []Problem) {
+	files, err := config.SiteFiles(dir)
+	if err != nil {
+		return 0, []Problem{{File: dir, Message: err.Error()}}
+	}
+
+	var problems []Problem
+	var domains []string
+	declared := make(map[string][]config.SiteFile)
+	domainNodes := make(map[string]*yaml.Node)
+
+	for _, file := range files {
+		c := &checker{file: file, dir: dir}
+		var cfg global.SiteConfig
+		if root := c.read(&cfg); root != nil {
+			c.site(root, &cfg, pools)
+
+			if config.CheckDomain(cfg.Domain) == nil {
+				domain := config.CanonicalDomain(cfg.Domain)
+				if _, ok := declared[domain]; !ok {
+					domains = append(domains, domain)
+				}
+				declared[domain] = append(declared[domain], config.SiteFile{Name: filepath.Base(file), Site: &cfg})
+				domainNodes[file] = position(root, "domain")
+			}
+		}
+		problems = append(problems, c.problems...)
+	}
+
+	// Reported in the second file, where the domain stops being unique
+	for _, domain := range domains {
+		if _, err := config.CombineSites(declared[domain], duplicates); err != nil {
+			file := filepath.Join(dir, declared[domain][1].Name)
+			c := &checker{file: file, dir: dir}
+			c.add(domainNodes[file], "%v", err)
+			problems = append(problems, c.problems...)
+		}
+	}
+
+	return len(files), problems
+}
+
+// site checks what NewSiteHandler would reject, and what it accepts but
+// can't proxy to.
+func (c *checker) site(root *yaml.Node, cfg *global.SiteConfig, pools map[string]bool) {
+	if err := config.CheckDomain(cfg.Domain); err != nil {
+		c.add(position(root, "domain"), "%v", err)
+	}
+
+	proxy := field(root, "proxy")
+	c.pathBase(orParent(proxy, root), &cfg.Proxy.PathBase, pools)
+
+	if len(cfg.Proxy.Paths) == 0 {
+		if _, ok := site.BalancedUpstreams(&cfg.Proxy.PathBase); !ok && cfg.Proxy.Upstream == "" && cfg.Proxy.Pool == "" {
+			c.add(orParent(proxy, root), "no upstream, upstreams or pool configured")
+		}
+		return
+	}
+
+	_, rootBalanced := site.BalancedUpstreams(&cfg.Proxy.PathBase)
+	rootBalanced = rootBalanced || cfg.Proxy.Pool != ""
+	paths := field(proxy, "paths")
+	seen := make(map[string]*yaml.Node)
+	for i := range cfg.Proxy.Paths {
+		p := &cfg.Proxy.Paths[i]
+		node := orParent(item(paths, i), paths)
+		c.pathBase(node, &p.PathBase, pools)
+
+		pathNode := position(node, "path")
+		switch {
+		case p.Path == "":
+			c.add(node, "path missing")
+			continue
+		case p.Path[0] != '/':
+			c.add(pathNode, "path %s must start with /", p.Path)
+		}
+		if first, ok := seen[p.Path]; ok {
+			c.add(pathNode, "duplicate path %s, first defined at line %d", p.Path, first.Line)
+		} else {
+			seen[p.Path] = pathNode
+		}
+
+		if _, ok := site.BalancedUpstreams(&p.PathBase); !ok && p.Upstream == "" && p.Pool == "" && !rootBalanced {
+			c.add(node, "no upstream configured for path %s", p.Path)
+		}
+	}
+}
+
+// pathBase checks the upstreams and load balancing options of the site, of
+// one of its paths or of a pool, found at node, and that the pool it refers
+// to is one of pools.
+func (c *checker) pathBase(node *yaml.Node, p *global.PathBase, pools map[string]bool) {
+	if p.Pool != "" {
+		poolNode := position(node, "pool")
+		if err := site.CheckPoolReference(p); err != nil {
+			c.add(poolNode, "%v", err)
+		}
+		if !pools[p.Pool] {
+			c.add(poolNode, "unknown upstream pool %s", p.Pool)
+		}
+	}
+	if p.Upstream != "" {
+		c.upstreamURL(position(node, "upstream"), p.Upstream)
+	}
+	c.upstreams(node, "upstreams", p.Upstreams)
+	c.upstreams(node, "backup_upstreams", p.BackupUpstreams)
+
+	if p.Discovery != nil {
+		if err := site.CheckDiscovery(p.Discovery); err != nil {
+			c.add(position(node, "discovery"), "%v", err)
+		}
+	}
+
+	if p.LoadBalance != nil {
+		lbNode := field(node, "load_balance")
+		problems := site.CheckLoadBalance(p.LoadBalance)
+		keys := make([]string, 0, len(problems))
+		for key := range problems {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			c.add(orParent(position(lbNode, key), position(node, "load_balance")), "%v", problems[key])
+		}
+	}
+}
+
+// upstreams checks the list of upstreams under key. A list that is present
+// but empty is a problem, as it most likely lost its entries by mistake.
+func (c *checker) upstreams(node *yaml.Node, key string, upstreams []global.Upstream) {
+	list := field(node, key)
+	if list == nil {
+		return
+	}
+	if len(upstreams) == 0 {
+		c.add(list, "%s is empty", key)
+		return
+	}
+	for i, u := range upstreams {
+		entry := orParent(item(list, i), list)
+		c.upstreamURL(position(entry, "url"), u.URL)
+	}
+}
+
+// upstreamURL checks that raw is an absolute http or https URL.
+func (c *checker) upstreamURL(node *yaml.Node, raw string) {
+	u, err := url.Parse(raw)
+	switch {
+	case raw == "":
+		c.add(node, "upstream URL missing")
+	case err != nil:
+		c.add(node, "invalid upstream URL %s: %v", raw, err)
+	case u.Scheme != "http" && u.Scheme != "https":
+		c.add(node, "upstream URL %s must start with http:// or https://", raw)
+	case u.Host == "":
+		c.add(node, "upstream URL %s has no host", raw)
+	}
+}
@@ -0,0 +1,293 @@
+// Package validate checks the settings and site files without starting
+// anything. Unlike loading, which stops at the first error, it reports every
+// problem it finds with the file and position it was found at.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"reverse-proxy/internal/application/config"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one thing wrong with a configuration file. Line and Column are
+// 0 when the problem is not about a particular position.
+type Problem struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Line == 0:
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	case p.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	default:
+		return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+	}
+}
+
+// Report is the outcome of checking a configuration.
+type Report struct {
+	// Sites is the number of site files that were checked.
+	Sites    int
+	Problems []Problem
+}
+
+// Config checks the settings file at settingsPath and every site and pool
+// file in dir.
+func Config(settingsPath, dir string) *Report {
+	report := &Report{}
+	problems, duplicates := checkSettings(settingsPath)
+	report.Problems = append(report.Problems, problems...)
+
+	pools, problems := checkPools(dir)
+	report.Problems = append(report.Problems, problems...)
+
+	sites, problems := checkSites(dir, duplicates, pools)
+	report.Sites = sites
+	report.Problems = append(report.Problems, problems...)
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		a, b := report.Problems[i], report.Problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return report
+}
+
+// checker collects the problems of one file. Relative paths in the file are
+// relative to dir.
+type checker struct {
+	file     string
+	dir      string
+	problems []Problem
+}
+
+// add records a problem at node, or about the whole file if node is nil.
+func (c *checker) add(node *yaml.Node, format string, args ...any) {
+	p := Problem{File: c.file, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		p.Line, p.Column = node.Line, node.Column
+	}
+	c.problems = append(c.problems, p)
+}
+
+// linePrefix matches the position yaml puts in front of its error messages.
+var linePrefix = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// addError records err, at the line its message starts with if there is one.
+func (c *checker) addError(err error) {
+	msg := strings.TrimPrefix(err.Error(), "yaml: ")
+	p := Problem{File: c.file, Message: msg}
+	if m := linePrefix.FindStringSubmatch(msg); m != nil {
+		p.Line, _ = strconv.Atoi(m[1])
+		p.Message = m[2]
+	}
+	c.problems = append(c.problems, p)
+}
+
+// read parses the file into v and reports syntax errors, values of the wrong
+// type and unknown keys. It returns the root mapping, or nil if v could not be
+// decoded and the file shouldn't be checked any further.
+func (c *checker) read(v any) *yaml.Node {
+	data, err := os.ReadFile(c.file)
+	if err != nil {
+		c.addError(err)
+		return nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		c.addError(err)
+		return nil
+	}
+	if len(doc.Content) == 0 {
+		// An empty file decodes to the zero value
+		return &yaml.Node{Kind: yaml.MappingNode, Line: 1, Column: 1}
+	}
+	root := doc.Content[0]
+
+	// Unresolved references are reported, the rest of the file is still
+	// checked
+	if joined, ok := config.Interpolate(root, c.dir).(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			var ref *config.InterpolationError
+			if errors.As(err, &ref) {
+				c.problems = append(c.problems, Problem{File: c.file, Line: ref.Line, Column: ref.Column, Message: ref.Err.Error()})
+			}
+		}
+	}
+
+	c.unknownKeys(root, reflect.TypeOf(v).Elem(), "")
+
+	if err := root.Decode(v); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			c.addError(err)
+			return nil
+		}
+		for _, e := range typeErr.Errors {
+			c.addError(errors.New(e))
+		}
+	}
+	return root
+}
+
+// unknownKeys reports the keys of node that don't match a field of t, which
+// yaml would otherwise silently ignore.
+func (c *checker) unknownKeys(node *yaml.Node, t reflect.Type, at string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+			field, ok := fields[key.Value]
+			if !ok {
+				if at == "" {
+					c.add(key, "unknown key %q", key.Value)
+				} else {
+					c.add(key, "unknown key %q in %s", key.Value, at)
+				}
+				continue
+			}
+			c.unknownKeys(value, field, join(at, key.Value))
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			c.unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", at, i))
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			c.unknownKeys(node.Content[i+1], t.Elem(), join(at, node.Content[i].Value))
+		}
+	}
+}
+
+// yamlFields returns the types of the fields of struct type t by their YAML
+// key, including the fields of inlined structs.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// field returns the value of key in the mapping node, or nil if node is not a
+// mapping or doesn't have the key.
+func field(node *yaml.Node, key string) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			value := node.Content[i+1]
+			if value.Kind == yaml.AliasNode {
+				return value.Alias
+			}
+			return value
+		}
+	}
+	return nil
+}
+
+// position returns where to report a problem with the value of key in the
+// mapping node: the value itself if it is a scalar, otherwise the key, since
+// a block value starts at its first entry. It returns node if key is missing.
+func position(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return node
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			if node.Content[i+1].Kind == yaml.ScalarNode {
+				return node.Content[i+1]
+			}
+			return node.Content[i]
+		}
+	}
+	return node
+}
+
+// item returns the i-th entry of the sequence node, or nil.
+func item(node *yaml.Node, i int) *yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+		return nil
+	}
+	return node.Content[i]
+}
+
+// orParent returns node, or parent where node is missing so problems about
+// defaults still point somewhere close.
+func orParent(node, parent *yaml.Node) *yaml.Node {
+	if node != nil {
+		return node
+	}
+	return parent
+}
+
+func join(at, key string) string {
+	if at == "" {
+		return key
+	}
+	return at + "." + key
+}
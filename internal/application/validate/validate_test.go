@@ -0,0 +1,238 @@
+package validate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	t.Run("valid configuration", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			"settings.yml": "server:\n  listen: \":8080\"\nadmin: {}\n",
+			"example.com.yml": `domain: example.com
+proxy:
+  upstreams:
+    - http://10.0.0.1:8080
+    - url: http://10.0.0.2:8080
+      weight: 2
+  load_balance:
+    algorithm: least-conn
+    health_check:
+      path: /health
+      interval: 5s
+  paths:
+    - path: /api/
+      upstream: https://api.internal
+    - path: /static/
+timeouts:
+  read: 5s
+`,
+		})
+
+		report := Config(filepath.Join(dir, "settings.yml"), dir)
+		if len(report.Problems) != 0 {
+			t.Errorf("Expected no problems, got %v", report.Problems)
+		}
+		if report.Sites != 1 {
+			t.Errorf("Expected 1 site, got %d", report.Sites)
+		}
+	})
+
+	t.Run("reports every problem with its position", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			"settings.yml": `server:
+  lisen: ":8080"
+  tls:
+    cert_file: missing.pem
+    key_file: missing-key.pem
+`,
+			"a.yml": `domain: a.com
+proxy:
+  upstreams:
+    - localhost:3000
+    - ftp://files.internal
+  load_balance:
+    algorithm: fastest
+    health_check:
+      interval: 5x
+  paths:
+    - path: /api/
+    - path: /api/
+      upstreams: []
+timeouts:
+  read: soon
+`,
+			"b.yml": "proxy:\n  upstream: http://localhost:3000\n",
+			"c.yml": "domain: c.com\nproxy:\n  upstream: [\n",
+		})
+
+		report := Config(filepath.Join(dir, "settings.yml"), dir)
+
+		var got []string
+		for _, p := range report.Problems {
+			got = append(got, strings.TrimPrefix(p.String(), dir+string(filepath.Separator)))
+		}
+
+		expected := []string{
+			`a.yml:4:7: upstream URL localhost:3000 must start with http:// or https://`,
+			`a.yml:5:7: upstream URL ftp://files.internal must start with http:// or https://`,
+			`a.yml:7:16: unknown load balancing algorithm: fastest`,
+			`a.yml:8:5: invalid health check interval: 5x`,
+			`a.yml:12:13: duplicate path /api/, first defined at line 11`,
+			`a.yml:13:18: upstreams is empty`,
+			`a.yml:15: cannot unmarshal !!str ` + "`soon`" + ` into time.Duration`,
+			`b.yml:1:1: domain missing`,
+			`c.yml:3: did not find expected node content`,
+			`settings.yml:2:3: unknown key "lisen" in server`,
+		}
+		if len(got) < len(expected) {
+			t.Fatalf("Expected %d problems, got %d:\n%s", len(expected), len(got), strings.Join(got, "\n"))
+		}
+		for _, want := range expected {
+			found := false
+			for _, g := range got {
+				if g == want {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Expected problem %q, got:\n%s", want, strings.Join(got, "\n"))
+			}
+		}
+
+		tlsProblems := 0
+		for _, g := range got {
+			if strings.HasPrefix(g, "settings.yml:") && strings.Contains(g, "not readable") {
+				tlsProblems++
+			}
+		}
+		if tlsProblems != 2 {
+			t.Errorf("Expected both TLS files to be reported, got:\n%s", strings.Join(got, "\n"))
+		}
+	})
+
+	t.Run("duplicate domains", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			"settings.yml": "server:\n  listen: \":8080\"\n",
+			"a.yml":        "domain: example.com\nproxy:\n  upstream: http://localhost:3000\n",
+			"b.yml":        "proxy:\n  paths:\n    - path: /api/\n      upstream: http://localhost:4000\ndomain: EXAMPLE.com.\n",
+		})
+
+		report := Config(filepath.Join(dir, "settings.yml"), dir)
+		expected := Problem{File: filepath.Join(dir, "b.yml"), Line: 5, Column: 9, Message: "domain example.com is declared in a.yml and b.yml"}
+		if len(report.Problems) != 1 || report.Problems[0] != expected {
+			t.Errorf("Expected %v, got %v", expected, report.Problems)
+		}
+
+		writeFiles(t, dir, map[string]string{"settings.yml": "sites:\n  duplicates: merge\n"})
+		if report := Config(filepath.Join(dir, "settings.yml"), dir); len(report.Problems) != 0 {
+			t.Errorf("Expected the sites to merge, got %v", report.Problems)
+		}
+	})
+
+	t.Run("unresolved references", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			"settings.yml":    "admin:\n  token: ${TEST_UNSET_TOKEN}\n",
+			"example.com.yml": "domain: example.com\nproxy:\n  upstream: ${TEST_UNSET_UPSTREAM:-http://localhost:3000}\n",
+		})
+
+		report := Config(filepath.Join(dir, "settings.yml"), dir)
+		expected := Problem{File: filepath.Join(dir, "settings.yml"), Line: 2, Column: 10, Message: "environment variable TEST_UNSET_TOKEN is not set"}
+		if len(report.Problems) != 1 || report.Problems[0] != expected {
+			t.Errorf("Expected %v, got %v", expected, report.Problems)
+		}
+	})
+
+	t.Run("relative paths are resolved like when serving", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			"settings.yml":    "providers:\n  kubernetes:\n    endpoint: https://kubernetes.local\n    token_file: token\n",
+			"token":           "secret-token",
+			"api-key":         "key-value",
+			"example.com.yml": "domain: example.com\nproxy:\n  upstream: http://localhost:3000\n  headers:\n    X-API-Key: ${file:api-key}\n",
+		})
+
+		if report := Config(filepath.Join(dir, "settings.yml"), dir); len(report.Problems) != 0 {
+			t.Errorf("Expected no problems, got %v", report.Problems)
+		}
+	})
+
+	t.Run("upstream pools", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.Mkdir(filepath.Join(dir, "upstreams.d"), 0755); err != nil {
+			t.Fatalf("Failed to create upstreams.d: %v", err)
+		}
+		writeFiles(t, dir, map[string]string{
+			"settings.yml":        "server:\n  listen: \":8080\"\n",
+			"upstreams.d/api.yml": "upstreams:\n  - http://10.0.0.1:8080\nload_balance:\n  algorithm: fastest\n",
+			"upstreams.d/web.yml": "upstrems:\n  - http://10.0.0.2:8080\n",
+			"example.com.yml": `domain: example.com
+proxy:
+  pool: api
+  paths:
+    - path: /api/
+    - path: /v2/
+      pool: v2
+    - path: /web/
+      pool: web
+      upstream: http://10.0.0.3:8080
+`,
+		})
+
+		report := Config(filepath.Join(dir, "settings.yml"), dir)
+
+		var got []string
+		for _, p := range report.Problems {
+			got = append(got, strings.TrimPrefix(p.String(), dir+string(filepath.Separator)))
+		}
+		expected := []string{
+			`example.com.yml:7:13: unknown upstream pool v2`,
+			`example.com.yml:9:13: pool web can't be combined with upstreams, discovery or load_balance`,
+			`upstreams.d/api.yml:4:14: unknown load balancing algorithm: fastest`,
+			`upstreams.d/web.yml:1:1: unknown key "upstrems"`,
+			`upstreams.d/web.yml:1:1: no upstreams or discovery configured`,
+		}
+		if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+		}
+	})
+
+	t.Run("missing settings and directory", func(t *testing.T) {
+		dir := t.TempDir()
+		report := Config(filepath.Join(dir, "settings.yml"), filepath.Join(dir, "missing"))
+		if len(report.Problems) != 2 {
+			t.Errorf("Expected 2 problems, got %v", report.Problems)
+		}
+	})
+}
+
+func TestProblemString(t *testing.T) {
+	testCases := []struct {
+		problem  Problem
+		expected string
+	}{
+		{Problem{File: "a.yml", Message: "broken"}, "a.yml: broken"},
+		{Problem{File: "a.yml", Line: 3, Message: "broken"}, "a.yml:3: broken"},
+		{Problem{File: "a.yml", Line: 3, Column: 5, Message: "broken"}, "a.yml:3:5: broken"},
+	}
+	for _, tc := range testCases {
+		if s := tc.problem.String(); s != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, s)
+		}
+	}
+}
@@ -2,38 +2,220 @@
 // used throughout the reverse proxy application.
 package global
 
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
 // SiteConfig represents the configuration for a single proxy site.
 type SiteConfig struct {
 	Domain   string   `yaml:"domain"`
-	Listen   string   `yaml:"listen"`
-	Proxy    Proxy    `yaml:"proxy"`
-	Timeouts Timeouts `yaml:"timeouts"`
+	Listen   string   `yaml:"listen,omitempty"`
+	Proxy    Proxy    `yaml:"proxy,omitempty"`
+	Timeouts Timeouts `yaml:"timeouts,omitempty"`
 }
 
 type Proxy struct {
-	PathBase
-	Paths []ProxyPath `yaml:"paths"`
+	PathBase `yaml:",inline"`
+	Paths    []ProxyPath `yaml:"paths,omitempty"`
 }
 
 type ProxyPath struct {
-	PathBase
-	Path string `yaml:"path"`
+	PathBase `yaml:",inline"`
+	Path     string `yaml:"path"`
 }
 
 type LoadBalance struct {
-	Algorithm   string       `yaml:"algorithm"`
-	HealthCheck *HealthCheck `yaml:"health_check"`
+	Algorithm string `yaml:"algorithm,omitempty"`
+	// HashKey selects what the "hash" algorithm hashes: "remote_ip" (default),
+	// "path", "header:<name>" or "cookie:<name>".
+	HashKey          string            `yaml:"hash_key,omitempty"`
+	HealthCheck      *HealthCheck      `yaml:"health_check,omitempty"`
+	OutlierDetection *OutlierDetection `yaml:"outlier_detection,omitempty"`
+	Sticky           *Sticky           `yaml:"sticky,omitempty"`
+	Retry            *Retry            `yaml:"retry,omitempty"`
+	CircuitBreaker   *CircuitBreaker   `yaml:"circuit_breaker,omitempty"`
+	SlowStart        *SlowStart        `yaml:"slow_start,omitempty"`
+}
+
+// SlowStart ramps up the traffic of an upstream that was just added or came
+// back after being unhealthy, ejected or circuit-open. Its effective weight
+// grows linearly from MinWeight times its weight to the full weight over
+// Duration.
+type SlowStart struct {
+	Duration  string  `yaml:"duration,omitempty"`
+	MinWeight float64 `yaml:"min_weight,omitempty"`
+}
+
+// CircuitBreaker stops sending requests to an upstream whose recent requests
+// keep failing. The circuit opens after ConsecutiveFailures failures in a row
+// or once ErrorRate of at least MinRequests requests within Window failed. It
+// half-opens after OpenTimeout and closes again once HalfOpenRequests trial
+// requests succeed.
+type CircuitBreaker struct {
+	ConsecutiveFailures int     `yaml:"consecutive_failures,omitempty"`
+	ErrorRate           float64 `yaml:"error_rate,omitempty"`
+	MinRequests         int     `yaml:"min_requests,omitempty"`
+	Window              string  `yaml:"window,omitempty"`
+	OpenTimeout         string  `yaml:"open_timeout,omitempty"`
+	HalfOpenRequests    int     `yaml:"half_open_requests,omitempty"`
+}
+
+// Retry configures retrying failed requests on another upstream.
+type Retry struct {
+	// Attempts is the number of retries after the first try, at most 10.
+	Attempts int `yaml:"attempts,omitempty"`
+	// On lists what is retried: "error" for connection errors, "5xx" for any
+	// server error or individual status codes such as "503".
+	On []string `yaml:"on,omitempty"`
+	// NonIdempotent also retries methods like POST and PATCH.
+	NonIdempotent bool   `yaml:"non_idempotent,omitempty"`
+	PerTryTimeout string `yaml:"per_try_timeout,omitempty"`
+	// Backoff is the delay before the first retry, doubled for every
+	// following one up to 10s.
+	Backoff string `yaml:"backoff,omitempty"`
+	// MaxBodyBytes is the largest request body buffered for replay. Requests
+	// with bigger bodies are not retried.
+	MaxBodyBytes int64 `yaml:"max_body_bytes,omitempty"`
+}
+
+// Sticky pins clients to an upstream with a signed affinity cookie.
+type Sticky struct {
+	Cookie string `yaml:"cookie,omitempty"`
+	// Secret signs the cookie. When empty a random per-process secret is used,
+	// which keeps cookies valid across reloads but not across restarts.
+	Secret string `yaml:"secret,omitempty"`
+	MaxAge string `yaml:"max_age,omitempty"`
 }
 
 type HealthCheck struct {
 	Path     string `yaml:"path"`
-	Interval string `yaml:"interval"`
-	Timeout  string `yaml:"timeout"`
+	Interval string `yaml:"interval,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty"`
+	// Rise and Fall are the number of consecutive successful or failed probes
+	// needed to mark an upstream healthy or unhealthy.
+	Rise int `yaml:"rise,omitempty"`
+	Fall int `yaml:"fall,omitempty"`
+	// ExpectedStatus is the accepted status range, e.g. "200-399" or "204".
+	ExpectedStatus string `yaml:"expected_status,omitempty"`
+}
+
+// OutlierDetection configures passive health checking: upstreams that fail
+// ConsecutiveErrors requests in a row are ejected for BaseEjectionTime, doubled
+// on every consecutive ejection up to MaxEjectionTime.
+type OutlierDetection struct {
+	ConsecutiveErrors int    `yaml:"consecutive_errors,omitempty"`
+	BaseEjectionTime  string `yaml:"base_ejection_time,omitempty"`
+	MaxEjectionTime   string `yaml:"max_ejection_time,omitempty"`
 }
 
 type PathBase struct {
-	Upstream    string            `yaml:"upstream"`
-	Upstreams   []string          `yaml:"upstreams"`
-	Headers     map[string]string `yaml:"headers"`
-	LoadBalance *LoadBalance      `yaml:"load_balance"`
+	// Pool names an upstream pool from upstreams.d to proxy to instead of
+	// upstreams of its own.
+	Pool      string     `yaml:"pool,omitempty"`
+	Upstream  string     `yaml:"upstream,omitempty"`
+	Upstreams []Upstream `yaml:"upstreams,omitempty"`
+	// BackupUpstreams only receive traffic while every primary upstream is
+	// unhealthy, ejected or circuit-open.
+	BackupUpstreams []Upstream `yaml:"backup_upstreams,omitempty"`
+	// Discovery adds upstreams found at runtime to the static ones.
+	Discovery   *Discovery        `yaml:"discovery,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	LoadBalance *LoadBalance      `yaml:"load_balance,omitempty"`
+}
+
+// Pool is a named set of upstreams, defined in a file of upstreams.d and
+// named after it. Every site and path referring to the pool shares one load
+// balancer, with its health state, counters and connections.
+type Pool struct {
+	Upstreams       []Upstream   `yaml:"upstreams,omitempty"`
+	BackupUpstreams []Upstream   `yaml:"backup_upstreams,omitempty"`
+	Discovery       *Discovery   `yaml:"discovery,omitempty"`
+	LoadBalance     *LoadBalance `yaml:"load_balance,omitempty"`
+}
+
+// Discovery configures where upstreams are discovered. Exactly one source
+// must be set.
+type Discovery struct {
+	DNS    *DNSDiscovery    `yaml:"dns,omitempty"`
+	File   *FileDiscovery   `yaml:"file,omitempty"`
+	Consul *ConsulDiscovery `yaml:"consul,omitempty"`
+}
+
+// DNSDiscovery resolves Name every Interval and turns each record into an
+// upstream. A and AAAA records are combined with Port, SRV records carry
+// their own port and weight.
+type DNSDiscovery struct {
+	Name string `yaml:"name,omitempty"`
+	// Type is "A" (the default, covering A and AAAA records) or "SRV".
+	Type     string `yaml:"type,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	Scheme   string `yaml:"scheme,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+	// Resolver is the host:port of the DNS server to query instead of the
+	// system resolver.
+	Resolver string `yaml:"resolver,omitempty"`
+}
+
+// FileDiscovery reads upstreams from a JSON or YAML file in the format of
+// Prometheus file_sd: a list of groups, each with targets and labels. The file
+// is re-read every Interval.
+type FileDiscovery struct {
+	Path string `yaml:"path"`
+	// Scheme is used for targets given as host:port.
+	Scheme   string `yaml:"scheme,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+}
+
+// ConsulDiscovery follows the passing instances of a service in the Consul
+// catalog with blocking queries. An instance's "weight" meta key or
+// "weight=<n>" tag sets its weight.
+type ConsulDiscovery struct {
+	// Address is the Consul agent's HTTP API, by default
+	// http://127.0.0.1:8500.
+	Address    string `yaml:"address,omitempty"`
+	Service    string `yaml:"service,omitempty"`
+	Tag        string `yaml:"tag,omitempty"`
+	Datacenter string `yaml:"datacenter,omitempty"`
+	Token      string `yaml:"token,omitempty"`
+	Scheme     string `yaml:"scheme,omitempty"`
+	// Wait is how long a blocking query waits for a change (default 5m).
+	Wait string `yaml:"wait,omitempty"`
+}
+
+// Upstream is one entry of an upstreams list. In YAML it is either a plain
+// URL or a mapping with url and weight keys.
+type Upstream struct {
+	URL    string `yaml:"url,omitempty"`
+	Weight int    `yaml:"weight,omitempty"`
+}
+
+func (u *Upstream) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*u = Upstream{URL: value.Value}
+		return nil
+	}
+
+	// Decode through an alias type so this method isn't called recursively
+	type plain Upstream
+	var p plain
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	if p.Weight < 0 {
+		return fmt.Errorf("line %d: negative weight %d for upstream %s", value.Line, p.Weight, p.URL)
+	}
+
+	*u = Upstream(p)
+	return nil
+}
+
+func (u Upstream) MarshalYAML() (interface{}, error) {
+	if u.Weight == 0 {
+		return u.URL, nil
+	}
+
+	type plain Upstream
+	return plain(u), nil
 }
@@ -3,7 +3,13 @@ package global
 import "time"
 
 type Settings struct {
-	Server Server `yaml:"server"`
+	Server    Server    `yaml:"server"`
+	Reload    Reload    `yaml:"reload"`
+	Providers Providers `yaml:"providers"`
+	// Admin enables the admin API, it is off unless the block is present.
+	Admin   *Admin  `yaml:"admin"`
+	Control Control `yaml:"control"`
+	Sites   Sites   `yaml:"sites"`
 }
 
 type Server struct {
@@ -14,9 +20,9 @@ type Server struct {
 }
 
 type Timeouts struct {
-	Read  time.Duration `yaml:"read"`
-	Write time.Duration `yaml:"write"`
-	Idle  time.Duration `yaml:"idle"`
+	Read  time.Duration `yaml:"read,omitempty"`
+	Write time.Duration `yaml:"write,omitempty"`
+	Idle  time.Duration `yaml:"idle,omitempty"`
 }
 
 type Limits struct {
@@ -29,3 +35,67 @@ type TLS struct {
 	KeyFile      string `yaml:"key_file"`
 	RedirectHTTP bool   `yaml:"redirect_http"`
 }
+
+// Reload controls how site configuration changes are picked up at runtime.
+type Reload struct {
+	Watch    *bool         `yaml:"watch"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Sites controls how the site files are combined.
+type Sites struct {
+	// Duplicates decides what happens when several site files declare the
+	// same domain: "error" (the default) refuses to load them, "merge"
+	// serves the paths of all of them.
+	Duplicates string `yaml:"duplicates"`
+}
+
+// Admin configures the JSON API for inspecting and controlling the running
+// proxy. It listens apart from the proxied traffic and should not be
+// reachable from outside.
+type Admin struct {
+	// Listen is the admin address, by default 127.0.0.1:9901.
+	Listen string `yaml:"listen"`
+	// Token, when set, must be sent as a bearer token with every request.
+	Token string `yaml:"token"`
+}
+
+// Control is the local unix socket the ctl subcommand talks to. It is off
+// unless enabled. It serves the admin API without a token, access is limited
+// by the socket's file permissions.
+type Control struct {
+	Enabled *bool  `yaml:"enabled"`
+	Socket  string `yaml:"socket"`
+}
+
+// Providers configures sources of sites other than the site files. Each one
+// is off unless its block is present.
+type Providers struct {
+	Docker     *Docker     `yaml:"docker"`
+	Kubernetes *Kubernetes `yaml:"kubernetes"`
+}
+
+// Docker generates sites from the labels of running containers.
+type Docker struct {
+	// Endpoint is the Docker Engine API socket, by default
+	// unix:///var/run/docker.sock.
+	Endpoint string `yaml:"endpoint"`
+	// Network selects the container network whose address is proxied to
+	// when a container is attached to several.
+	Network string `yaml:"network"`
+}
+
+// Kubernetes generates sites from Ingress objects, with the ready endpoints of
+// their backend services as upstreams.
+type Kubernetes struct {
+	// Endpoint is the API server URL. When empty the in-cluster API server,
+	// service account token and CA are used.
+	Endpoint  string `yaml:"endpoint"`
+	TokenFile string `yaml:"token_file"`
+	CAFile    string `yaml:"ca_file"`
+	// Namespace limits the provider to one namespace, all when empty.
+	Namespace string `yaml:"namespace"`
+	// IngressClass limits the provider to Ingresses of this class, all when
+	// empty.
+	IngressClass string `yaml:"ingress_class"`
+}